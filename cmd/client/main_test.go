@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// console types into a running REPL.
+type console struct {
+	t    *testing.T
+	w    *io.PipeWriter
+	done chan error
+}
+
+// startClient runs a client on its own connection to server and logs in
+// as username.
+func startClient(t *testing.T, server *pubsub.MemoryServer, username string) *console {
+	t.Helper()
+	broker := dial(t, server)
+	r, w := io.Pipe()
+	c := &console{t: t, w: w, done: make(chan error, 1)}
+	go func() {
+		err := run(context.Background(), broker, r, io.Discard)
+		// Fail anything still typing rather than leave it waiting.
+		r.CloseWithError(fmt.Errorf("run returned %v", err))
+		c.done <- err
+	}()
+	t.Cleanup(func() { w.Close() })
+	c.send(username)
+	return c
+}
+
+// send types line and waits for the REPL to finish with it, which it has
+// once it's read the two blank lines that follow.
+func (c *console) send(line string) {
+	c.t.Helper()
+	for _, s := range []string{line, "", ""} {
+		if _, err := io.WriteString(c.w, s+"\n"); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+}
+
+// quit types "quit" and waits for the REPL to return.
+func (c *console) quit() {
+	c.t.Helper()
+	if _, err := io.WriteString(c.w, "quit\n"); err != nil {
+		c.t.Fatal(err)
+	}
+	select {
+	case err := <-c.done:
+		if err != nil {
+			c.t.Errorf("run returned %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		c.t.Fatal("timed out waiting for quit")
+	}
+}
+
+func dial(t *testing.T, server *pubsub.MemoryServer) pubsub.Broker {
+	t.Helper()
+	broker, err := server.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { broker.Close() })
+	return broker
+}
+
+// collect subscribes to key on the topic exchange and sends what arrives
+// on the channel it returns.
+func collect[T any](t *testing.T, broker pubsub.Broker, key string) <-chan T {
+	t.Helper()
+	got := make(chan T, 16)
+	sub, err := pubsub.SubscribeJSON(context.Background(), broker, routing.ExchangePerilTopic, "", key, pubsub.Transient, func(v T) pubsub.AckType {
+		got <- v
+		return pubsub.Ack
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sub.Close() })
+	return got
+}
+
+func receive[T any](t *testing.T, ch <-chan T) T {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for a message")
+		var zero T
+		return zero
+	}
+}
+
+// serveJoinsAndLeaves stands in for the server, sending the usernames that
+// join and leave on the channels it returns.
+func serveJoinsAndLeaves(t *testing.T, broker pubsub.Broker) (joins, leaves <-chan string) {
+	t.Helper()
+	joined := make(chan string, 4)
+	left := make(chan string, 4)
+
+	sub, err := pubsub.Serve(context.Background(), broker, routing.ExchangePerilDirect, routing.RPCJoinKey, routing.RPCJoinKey, pubsub.Transient,
+		func(_ context.Context, req routing.JoinRequest) (routing.ServerStatus, error) {
+			joined <- req.Username
+			return routing.ServerStatus{Players: []string{req.Username}}, nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sub.Close() })
+
+	sub, err = pubsub.Serve(context.Background(), broker, routing.ExchangePerilDirect, routing.RPCLeaveKey, routing.RPCLeaveKey, pubsub.Transient,
+		func(_ context.Context, req routing.LeaveRequest) (routing.ServerStatus, error) {
+			left <- req.Username
+			return routing.ServerStatus{}, nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sub.Close() })
+	return joined, left
+}
+
+func TestMoveIntoAnotherPlayersUnitsMakesWar(t *testing.T) {
+	server := pubsub.NewMemoryServer()
+	broker := dial(t, server)
+	if err := routing.Topology.Apply(broker); err != nil {
+		t.Fatal(err)
+	}
+	joins, leaves := serveJoinsAndLeaves(t, broker)
+	moves := collect[gamelogic.ArmyMove](t, broker, routing.ArmyMovesPrefix+".*")
+	wars := collect[gamelogic.RecognitionOfWar](t, broker, routing.WarRecognitionsPrefix+".*")
+
+	alice := startClient(t, server, "alice")
+	if got := receive(t, joins); got != "alice" {
+		t.Errorf("%s joined, want alice", got)
+	}
+	bob := startClient(t, server, "bob")
+	if got := receive(t, joins); got != "bob" {
+		t.Errorf("%s joined, want bob", got)
+	}
+
+	bob.send("spawn asia infantry")
+	alice.send("spawn europe infantry")
+	alice.send("move asia 1")
+
+	move := receive(t, moves)
+	if move.Player.Username != "alice" || move.ToLocation != "asia" || len(move.Units) != 1 {
+		t.Errorf("got a move of %d unit(s) by %s to %s, want 1 by alice to asia", len(move.Units), move.Player.Username, move.ToLocation)
+	}
+
+	war := receive(t, wars)
+	if war.Attacker.Username != "alice" || war.Defender.Username != "bob" {
+		t.Errorf("got a war of %s on %s, want alice on bob", war.Attacker.Username, war.Defender.Username)
+	}
+
+	alice.quit()
+	bob.quit()
+	left := map[string]bool{receive(t, leaves): true, receive(t, leaves): true}
+	if !left["alice"] || !left["bob"] {
+		t.Errorf("%v left, want alice and bob", left)
+	}
+}
+
+func TestClientQuitsAtEndOfInput(t *testing.T) {
+	server := pubsub.NewMemoryServer()
+	broker := dial(t, server)
+	if err := routing.Topology.Apply(broker); err != nil {
+		t.Fatal(err)
+	}
+	_, leaves := serveJoinsAndLeaves(t, broker)
+
+	alice := startClient(t, server, "alice")
+	alice.w.Close()
+	select {
+	case err := <-alice.done:
+		if err != nil {
+			t.Errorf("run returned %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the client to quit")
+	}
+	if got := receive(t, leaves); got != "alice" {
+		t.Errorf("%s left, want alice", got)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+const (
+	// sendBuffer is how many events may wait for a browser to read them
+	// before it's dropped as too slow.
+	sendBuffer = 64
+	writeWait  = 10 * time.Second
+	pongWait   = 60 * time.Second
+	pingPeriod = pongWait * 9 / 10
+	// maxCommandSize is the most a browser may send in one message.
+	maxCommandSize = 4096
+)
+
+// command is a message from a browser. ID, if set, is copied into the
+// reply so the browser can match them up.
+//
+//	{"type": "subscribe", "pattern": "army_moves.*"}
+//	{"type": "unsubscribe", "pattern": "army_moves.*"}
+//	{"type": "spawn", "location": "europe", "rank": "infantry"}
+//	{"type": "move", "location": "asia", "units": [1, 2]}
+type command struct {
+	ID       string `json:"id,omitempty"`
+	Type     string `json:"type"`
+	Pattern  string `json:"pattern,omitempty"`
+	Location string `json:"location,omitempty"`
+	Rank     string `json:"rank,omitempty"`
+	Units    []int  `json:"units,omitempty"`
+}
+
+// serverEvent is a message to a browser: a reply to one of its commands,
+// a "message" that arrived on a pattern it subscribed to, or a "war" its
+// player fought, with the outcome and what's left of the player's army.
+type serverEvent struct {
+	ID         string          `json:"id,omitempty"`
+	Type       string          `json:"type"`
+	Pattern    string          `json:"pattern,omitempty"`
+	RoutingKey string          `json:"routing_key,omitempty"`
+	Body       json.RawMessage `json:"body,omitempty"`
+	Error      string          `json:"error,omitempty"`
+}
+
+// client is one browser's socket, bound to the username it connected
+// with. Its game state is kept here, so everything it publishes is checked
+// and attributed the way the client's REPL does it.
+type client struct {
+	gw       *gateway
+	username string
+	state    *gamelogic.GameState
+
+	send chan []byte
+	done chan struct{}
+	once sync.Once
+	// closeCode and closeText are what the socket is closed with. They're
+	// set before done is closed.
+	closeCode int
+	closeText string
+
+	mu       sync.Mutex
+	patterns map[string]bool
+}
+
+func newClient(gw *gateway, username string, state *gamelogic.GameState) *client {
+	return &client{
+		gw:       gw,
+		username: username,
+		state:    state,
+		send:     make(chan []byte, sendBuffer),
+		done:     make(chan struct{}),
+		patterns: map[string]bool{},
+	}
+}
+
+func (c *client) subscribed(pattern string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.patterns[pattern]
+}
+
+// enqueue queues event to be sent without waiting. If the browser has let
+// its queue fill up it's dropped instead.
+func (c *client) enqueue(event []byte) {
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	select {
+	case c.send <- event:
+	default:
+		log.Printf("Dropping %s: %d events unread\n", c.username, sendBuffer)
+		c.drop(websocket.CloseTryAgainLater, "too slow to keep up")
+	}
+}
+
+// drop closes the socket with code and text, discarding unsent events.
+func (c *client) drop(code int, text string) {
+	c.once.Do(func() {
+		c.closeCode = code
+		c.closeText = text
+		close(c.done)
+	})
+}
+
+// serve runs the socket until either side hangs up.
+func (c *client) serve(ws *websocket.Conn) {
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		c.writeLoop(ws)
+	}()
+	c.readLoop(ws)
+	c.drop(websocket.CloseNormalClosure, "")
+	<-written
+}
+
+func (c *client) writeLoop(ws *websocket.Conn) {
+	defer ws.Close()
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event := <-c.send:
+			// Once dropped, hang up rather than send what's queued.
+			select {
+			case <-c.done:
+				c.hangUp(ws)
+				return
+			default:
+			}
+			ws.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := ws.WriteMessage(websocket.TextMessage, event); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				return
+			}
+		case <-c.done:
+			c.hangUp(ws)
+			return
+		}
+	}
+}
+
+func (c *client) hangUp(ws *websocket.Conn) {
+	msg := websocket.FormatCloseMessage(c.closeCode, c.closeText)
+	ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
+}
+
+func (c *client) readLoop(ws *websocket.Conn) {
+	ws.SetReadLimit(maxCommandSize)
+	ws.SetReadDeadline(time.Now().Add(pongWait))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		var cmd command
+		if err := json.Unmarshal(data, &cmd); err != nil {
+			c.reply(cmd, "error", nil, fmt.Errorf("invalid command: %w", err))
+			continue
+		}
+		c.handle(cmd)
+	}
+}
+
+// reply sends the outcome of cmd, an error event if err isn't nil.
+func (c *client) reply(cmd command, kind string, body any, err error) {
+	event := serverEvent{ID: cmd.ID, Type: kind, Pattern: cmd.Pattern}
+	if err != nil {
+		event.Type = "error"
+		event.Error = err.Error()
+	} else if body != nil {
+		event.Body, err = json.Marshal(body)
+		if err != nil {
+			c.reply(cmd, kind, nil, err)
+			return
+		}
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	c.enqueue(data)
+}
+
+func (c *client) handle(cmd command) {
+	switch cmd.Type {
+	case "subscribe", "unsubscribe":
+		if !validPattern(cmd.Pattern) {
+			c.reply(cmd, cmd.Type+"d", nil, fmt.Errorf("can't subscribe to %q, only to %s", cmd.Pattern, patternList()))
+			return
+		}
+		c.mu.Lock()
+		if cmd.Type == "subscribe" {
+			c.patterns[cmd.Pattern] = true
+		} else {
+			delete(c.patterns, cmd.Pattern)
+		}
+		c.mu.Unlock()
+		c.reply(cmd, cmd.Type+"d", nil, nil)
+	case "spawn":
+		err := c.state.CommandSpawn([]string{"spawn", cmd.Location, cmd.Rank})
+		c.reply(cmd, "spawned", c.state.GetPlayerSnap(), err)
+	case "move":
+		move, err := c.move(cmd)
+		c.reply(cmd, "moved", move, err)
+	default:
+		c.reply(cmd, "", nil, fmt.Errorf("unknown command %q", cmd.Type))
+	}
+}
+
+// move moves the player's units and publishes the move for the other
+// players, under the player's own routing key. The gateway's own move
+// queue is bound to every player's moves, so a move is only unroutable if
+// that has gone, which Mandatory turns into an error.
+func (c *client) move(cmd command) (gamelogic.ArmyMove, error) {
+	words := []string{"move", cmd.Location}
+	for _, id := range cmd.Units {
+		words = append(words, strconv.Itoa(id))
+	}
+	move, err := c.state.CommandMove(words)
+	if err != nil {
+		return gamelogic.ArmyMove{}, err
+	}
+
+	err = pubsub.PublishJSON(
+		c.gw.confirms,
+		routing.ExchangePerilTopic,
+		fmt.Sprintf("%s.%s", routing.ArmyMovesPrefix, c.username),
+		move,
+		pubsub.Mandatory(),
+	)
+	if err != nil {
+		return gamelogic.ArmyMove{}, fmt.Errorf("failed to publish move: %w", err)
+	}
+	return move, nil
+}
+
+func validPattern(pattern string) bool {
+	for _, t := range topics {
+		if t.pattern == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+func patternList() string {
+	patterns := make([]string, len(topics))
+	for i, t := range topics {
+		patterns[i] = t.pattern
+	}
+	return strings.Join(patterns, ", ")
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+var movesPattern = fmt.Sprintf("%s.*", routing.ArmyMovesPrefix)
+
+// topic is a routing pattern browsers may subscribe to.
+type topic struct {
+	exchange string
+	pattern  string
+}
+
+var topics = []topic{
+	{routing.ExchangePerilTopic, movesPattern},
+	{routing.ExchangePerilTopic, fmt.Sprintf("%s.*", routing.WarRecognitionsPrefix)},
+	{routing.ExchangePerilDirect, routing.PauseKey},
+}
+
+// usernamePattern keeps usernames to a single routing key word.
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// gateway carries messages between browsers and the broker. It subscribes
+// to each topic once and fans what arrives out to the sockets that asked
+// for it, so browsers don't cost the broker a queue each.
+type gateway struct {
+	conn     *pubsub.Manager
+	confirms *pubsub.ConfirmPublisher
+	rpc      *pubsub.RPCClient
+	upgrader websocket.Upgrader
+	// sockets counts the sockets being served, which Shutdown doesn't wait
+	// for.
+	sockets sync.WaitGroup
+
+	mu      sync.Mutex
+	clients map[string]*client
+	paused  bool
+}
+
+func newGateway(conn *pubsub.Manager, confirms *pubsub.ConfirmPublisher, rpc *pubsub.RPCClient, origins []string) *gateway {
+	gw := &gateway{
+		conn:     conn,
+		confirms: confirms,
+		rpc:      rpc,
+		clients:  map[string]*client{},
+	}
+	if len(origins) > 0 {
+		gw.upgrader.CheckOrigin = func(r *http.Request) bool {
+			for _, origin := range origins {
+				if origin == "*" || origin == r.Header.Get("Origin") {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	return gw
+}
+
+// subscribe starts the subscriptions the gateway fans out from, and its
+// share of the war queue. Each topic gets a transient queue of its own, so
+// the gateway sees a copy of every message rather than taking turns with
+// the clients on shared queues like "war".
+func (gw *gateway) subscribe(ctx context.Context) ([]*pubsub.Subscription, error) {
+	wars, err := pubsub.SubscribeJSONEnvelope(
+		ctx,
+		gw.conn,
+		routing.ExchangePerilTopic,
+		routing.WarRecognitionsPrefix,
+		fmt.Sprintf("%s.*", routing.WarRecognitionsPrefix),
+		pubsub.Durable,
+		gw.handlerWar,
+		pubsub.WithRetry(routing.WarRetryPolicy),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("subscribe to wars: %w", err)
+	}
+
+	subs := []*pubsub.Subscription{wars}
+	for _, t := range topics {
+		sub, err := pubsub.SubscribeJSONEnvelope(
+			ctx,
+			gw.conn,
+			t.exchange,
+			"",
+			t.pattern,
+			pubsub.Transient,
+			gw.handlerTopic(t),
+		)
+		if err != nil {
+			for _, sub := range subs {
+				sub.Close()
+			}
+			return nil, fmt.Errorf("subscribe to %s@%s: %w", t.exchange, t.pattern, err)
+		}
+		subs = append(subs, sub)
+	}
+	return subs, nil
+}
+
+func (gw *gateway) handlerTopic(t topic) func(pubsub.Message[json.RawMessage]) pubsub.AckType {
+	return func(msg pubsub.Message[json.RawMessage]) pubsub.AckType {
+		switch t.pattern {
+		case routing.PauseKey:
+			var ps routing.PlayingState
+			if err := json.Unmarshal(msg.Body, &ps); err != nil {
+				return pubsub.NackDiscard
+			}
+			gw.handlePause(ps)
+		case movesPattern:
+			var move gamelogic.ArmyMove
+			if err := json.Unmarshal(msg.Body, &move); err != nil {
+				return pubsub.NackDiscard
+			}
+			gw.handleMove(msg.Context(), move)
+		}
+
+		event, err := json.Marshal(serverEvent{
+			Type:       "message",
+			Pattern:    t.pattern,
+			RoutingKey: msg.RoutingKey,
+			Body:       msg.Body,
+		})
+		if err != nil {
+			return pubsub.NackDiscard
+		}
+
+		gw.mu.Lock()
+		receivers := make([]*client, 0, len(gw.clients))
+		for _, c := range gw.clients {
+			if c.subscribed(t.pattern) {
+				receivers = append(receivers, c)
+			}
+		}
+		gw.mu.Unlock()
+
+		// Sending never blocks, so one slow browser can't hold up the
+		// queue for everyone else.
+		for _, c := range receivers {
+			c.enqueue(event)
+		}
+		return pubsub.Ack
+	}
+}
+
+// handlePause pauses or resumes every player's game, so their moves are
+// refused while paused just as the client refuses them.
+func (gw *gateway) handlePause(ps routing.PlayingState) {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	gw.paused = ps.IsPaused
+	for _, c := range gw.clients {
+		c.state.HandlePause(ps)
+	}
+}
+
+// handleMove shows a move to every player here, as each client does with
+// the moves it sees, and recognises war for those it brings into contact.
+// A recognition that can't be published is logged rather than retried, so
+// the other players don't see the move twice.
+func (gw *gateway) handleMove(ctx context.Context, move gamelogic.ArmyMove) {
+	for _, c := range gw.players() {
+		if c.state.HandleMove(move) != gamelogic.MoveOutcomeMakeWar {
+			continue
+		}
+		err := pubsub.PublishJSON(
+			gw.confirms,
+			routing.ExchangePerilTopic,
+			fmt.Sprintf("%s.%s", routing.WarRecognitionsPrefix, move.Player.Username),
+			gamelogic.RecognitionOfWar{
+				Attacker: move.Player,
+				Defender: c.state.GetPlayerSnap(),
+			},
+			pubsub.WithContext(ctx),
+		)
+		if err != nil {
+			log.Printf("Failed to recognise war between %s and %s: %v\n", move.Player.Username, c.username, err)
+		}
+	}
+}
+
+// handlerWar fights the wars of players here, as the client does, and
+// tells their browsers how it went. Wars are fought by the player who
+// moved, so one whose attacker is elsewhere is left to the other clients.
+func (gw *gateway) handlerWar(msg pubsub.Message[gamelogic.RecognitionOfWar]) pubsub.AckType {
+	recognition := msg.Body
+	gw.mu.Lock()
+	c := gw.clients[recognition.Attacker.Username]
+	gw.mu.Unlock()
+	if c == nil {
+		return pubsub.RetryLater
+	}
+
+	outcome, winner, loser := c.state.HandleWar(recognition)
+	var message string
+	switch outcome {
+	case gamelogic.WarOutcomeNotInvolved:
+		return pubsub.RetryLater
+	case gamelogic.WarOutcomeNoUnits:
+		return pubsub.NackDiscard
+	case gamelogic.WarOutcomeOpponentWon, gamelogic.WarOutcomeYouWon:
+		message = fmt.Sprintf("%s won a war against %s", winner, loser)
+	case gamelogic.WarOutcomeDraw:
+		message = fmt.Sprintf("A war between %s and %s resulted in a draw", winner, loser)
+	default:
+		log.Printf("Unexpected war outcome for %s: %d\n", c.username, outcome)
+		return pubsub.NackDiscard
+	}
+
+	err := pubsub.PublishGob(
+		gw.confirms,
+		routing.ExchangePerilTopic,
+		fmt.Sprintf("%s.%s", routing.GameLogSlug, recognition.Attacker.Username),
+		routing.GameLog{
+			CurrentTime: time.Now(),
+			Message:     message,
+			Username:    c.username,
+		},
+		pubsub.WithContext(msg.Context()),
+	)
+	if err != nil {
+		log.Println("Failed to publish game log:", err)
+		return pubsub.RetryLater
+	}
+	c.reply(command{}, "war", warResult{Message: message, Player: c.state.GetPlayerSnap()}, nil)
+	return pubsub.Ack
+}
+
+// warResult is the body of a "war" event.
+type warResult struct {
+	Message string           `json:"message"`
+	Player  gamelogic.Player `json:"player"`
+}
+
+// players returns the clients connected now.
+func (gw *gateway) players() []*client {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	clients := make([]*client, 0, len(gw.clients))
+	for _, c := range gw.clients {
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+// join binds username to c, refusing it if another socket here or a
+// client elsewhere in the game already has it.
+func (gw *gateway) join(ctx context.Context, c *client) error {
+	gw.mu.Lock()
+	if _, ok := gw.clients[c.username]; ok {
+		gw.mu.Unlock()
+		return errUsernameTaken
+	}
+	gw.clients[c.username] = c
+	if gw.paused {
+		c.state.HandlePause(routing.PlayingState{IsPaused: true})
+	}
+	gw.mu.Unlock()
+
+	status, err := pubsub.Request[routing.JoinRequest, routing.ServerStatus](
+		ctx,
+		gw.rpc,
+		routing.ExchangePerilDirect,
+		routing.RPCJoinKey,
+		routing.JoinRequest{Username: c.username},
+	)
+	var rpcErr *pubsub.RPCError
+	switch {
+	case errors.As(err, &rpcErr) && rpcErr.Code == routing.ErrCodeUsernameTaken:
+		gw.mu.Lock()
+		delete(gw.clients, c.username)
+		gw.mu.Unlock()
+		return errUsernameTaken
+	case err != nil:
+		log.Printf("Couldn't reach the server to join %s, playing anyway: %v\n", c.username, err)
+	case status.IsPaused:
+		c.state.HandlePause(routing.PlayingState{IsPaused: true})
+	}
+	return nil
+}
+
+// leave unbinds c's username and tells the server the player has gone.
+func (gw *gateway) leave(c *client) {
+	gw.mu.Lock()
+	if gw.clients[c.username] == c {
+		delete(gw.clients, c.username)
+	}
+	gw.mu.Unlock()
+
+	_, err := pubsub.Request[routing.LeaveRequest, routing.ServerStatus](
+		context.Background(),
+		gw.rpc,
+		routing.ExchangePerilDirect,
+		routing.RPCLeaveKey,
+		routing.LeaveRequest{Username: c.username},
+	)
+	if err != nil {
+		log.Printf("Failed to tell the server %s left: %v\n", c.username, err)
+	}
+}
+
+var errUsernameTaken = errors.New("username is already taken")
+
+// ServeHTTP upgrades /ws?username=<name> to a WebSocket that plays as name.
+func (gw *gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	gw.sockets.Add(1)
+	defer gw.sockets.Done()
+
+	username := r.URL.Query().Get("username")
+	if !usernamePattern.MatchString(username) {
+		http.Error(w, "username must be 1 to 32 letters, digits, '-' or '_'", http.StatusBadRequest)
+		return
+	}
+
+	// Browsers are told what happens through events, so the commentary
+	// the game writes for a terminal is dropped.
+	c := newClient(gw, username, gamelogic.NewGameState(username, io.Discard))
+	if err := gw.join(r.Context(), c); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	ws, err := gw.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already answered the request.
+		gw.leave(c)
+		return
+	}
+	log.Printf("%s connected from %s\n", username, r.RemoteAddr)
+
+	c.serve(ws)
+	gw.leave(c)
+	log.Printf("%s disconnected\n", username)
+}
+
+// closeAll hangs up on every browser and waits for them to leave.
+func (gw *gateway) closeAll() {
+	gw.mu.Lock()
+	for _, c := range gw.clients {
+		c.drop(websocket.CloseGoingAway, "gateway shutting down")
+	}
+	gw.mu.Unlock()
+	gw.sockets.Wait()
+}
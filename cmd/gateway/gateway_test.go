@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// startGateway runs a gateway on a memory server, without any sockets.
+func startGateway(t *testing.T) *gateway {
+	t.Helper()
+	server := pubsub.NewMemoryServer()
+	conn, err := pubsub.NewManager(server.Dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := routing.Topology.Apply(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	confirms, err := pubsub.NewConfirmPublisher(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { confirms.Close() })
+	rpc, err := pubsub.NewRPCClient(conn, pubsub.WithRequestTimeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { rpc.Close() })
+
+	gw := newGateway(conn, confirms, rpc, nil)
+	subs, err := gw.subscribe(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for _, sub := range subs {
+			sub.Close()
+		}
+	})
+	return gw
+}
+
+// play joins username to the gateway with a unit of rank at location.
+func play(t *testing.T, gw *gateway, username, location, rank string) *client {
+	t.Helper()
+	c := newClient(gw, username, gamelogic.NewGameState(username, io.Discard))
+	if err := gw.join(context.Background(), c); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.state.CommandSpawn([]string{"spawn", location, rank}); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// receiveEvent waits for an event of kind to be queued for c.
+func receiveEvent(t *testing.T, c *client, kind string) serverEvent {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case data := <-c.send:
+			var event serverEvent
+			if err := json.Unmarshal(data, &event); err != nil {
+				t.Fatal(err)
+			}
+			if event.Type == kind {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for a %q event for %s", kind, c.username)
+			return serverEvent{}
+		}
+	}
+}
+
+func TestGatewayPlayersFightWars(t *testing.T) {
+	gw := startGateway(t)
+	alice := play(t, gw, "alice", "europe", "artillery")
+	bob := play(t, gw, "bob", "asia", "infantry")
+
+	alice.handle(command{Type: "move", Location: "asia", Units: []int{1}})
+	receiveEvent(t, alice, "moved")
+
+	// Bob sees alice's artillery arrive, and alice fights the war.
+	event := receiveEvent(t, alice, "war")
+	var result warResult
+	if err := json.Unmarshal(event.Body, &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Message != "alice won a war against bob" {
+		t.Errorf("war result %q, want alice to win", result.Message)
+	}
+	if len(result.Player.Units) != 1 {
+		t.Errorf("alice has %d unit(s) left, want 1", len(result.Player.Units))
+	}
+	select {
+	case data := <-bob.send:
+		t.Errorf("bob got %s, want nothing", data)
+	default:
+	}
+}
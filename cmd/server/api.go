@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+)
+
+// serveAPI serves the HTTP control API on addr in the background:
+//
+//	POST /pause[?resume_after=5m]  pause the game, like "pause [5m]"
+//	POST /resume                   resume the game, like "resume"
+//	GET  /status                   whether the game is paused, and who's playing
+//	GET  /players                  who's playing
+//	GET  /logs[?limit=20]          the most recent game logs, oldest first
+//	GET  /health                   200 while connected to RabbitMQ, 503 otherwise
+func serveAPI(addr string, conn pubsub.Broker, pub pubsub.Publisher, state *serverState) (*http.Server, error) {
+	server := &http.Server{Addr: addr, Handler: apiHandler(conn, pub, state)}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.Println("HTTP API stopped:", err)
+		}
+	}()
+	return server, nil
+}
+
+// apiHandler routes the HTTP control API served by serveAPI.
+func apiHandler(conn pubsub.Broker, pub pubsub.Publisher, state *serverState) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("POST /pause", func(w http.ResponseWriter, r *http.Request) {
+		var resumeAfter time.Duration
+		if s := r.URL.Query().Get("resume_after"); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil || d <= 0 {
+				writeError(w, http.StatusBadRequest, "resume_after must be a duration, such as 5m")
+				return
+			}
+			resumeAfter = d
+		}
+		if err := pauseGame(conn, pub, state, resumeAfter); err != nil {
+			writeError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, state.currentStatus())
+	})
+
+	mux.HandleFunc("POST /resume", func(w http.ResponseWriter, r *http.Request) {
+		if err := resumeGame(conn, pub, state); err != nil {
+			writeError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, state.currentStatus())
+	})
+
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, state.currentStatus())
+	})
+
+	mux.HandleFunc("GET /players", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, state.currentStatus().Players)
+	})
+
+	mux.HandleFunc("GET /logs", func(w http.ResponseWriter, r *http.Request) {
+		limit := maxRecentLogs
+		if s := r.URL.Query().Get("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				writeError(w, http.StatusBadRequest, "limit must be a number of logs")
+				return
+			}
+			limit = n
+		}
+		writeJSON(w, http.StatusOK, state.recentLogs(limit))
+	})
+
+	mux.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {
+		if !state.isConnected() {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "disconnected"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, map[string]string{"error": message})
+}
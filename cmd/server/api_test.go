@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// newAPI serves the HTTP API on its own connection to server, with state
+// of its own.
+func newAPI(t *testing.T, server *pubsub.MemoryServer) (*httptest.Server, *serverState) {
+	t.Helper()
+	broker := dial(t, server)
+	if err := routing.Topology.Apply(broker); err != nil {
+		t.Fatal(err)
+	}
+	pub := pubsub.NewPublisherPool(broker, 1)
+	t.Cleanup(func() { pub.Close() })
+	state := newServerState()
+	api := httptest.NewServer(apiHandler(broker, pub, state))
+	t.Cleanup(api.Close)
+	return api, state
+}
+
+// call makes a request of the API and decodes the JSON it answers with
+// into v.
+func call(t *testing.T, api *httptest.Server, method, path string, v any) int {
+	t.Helper()
+	req, err := http.NewRequest(method, api.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := api.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("%s %s answered with Content-Type %q, want application/json", method, path, ct)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	return resp.StatusCode
+}
+
+func TestAPIPausesLikeTheREPL(t *testing.T) {
+	server := pubsub.NewMemoryServer()
+	c := startServer(t, server)
+	api, state := newAPI(t, server)
+
+	broker := dial(t, server)
+	pauses := make(chan routing.PlayingState, 4)
+	sub, err := pubsub.SubscribeJSON(context.Background(), broker, routing.ExchangePerilDirect, "", routing.PauseKey, pubsub.Transient, func(ps routing.PlayingState) pubsub.AckType {
+		pauses <- ps
+		return pubsub.Ack
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	for _, command := range []string{"pause", "resume"} {
+		c.send(command)
+		typed := receive(t, pauses)
+
+		var status routing.ServerStatus
+		if code := call(t, api, http.MethodPost, "/"+command, &status); code != http.StatusOK {
+			t.Fatalf("POST /%s answered %d, want %d", command, code, http.StatusOK)
+		}
+		posted := receive(t, pauses)
+		if posted != typed {
+			t.Errorf("POST /%s published %+v, want %+v like typing %q", command, posted, typed, command)
+		}
+		if status.IsPaused != typed.IsPaused || state.currentStatus().IsPaused != typed.IsPaused {
+			t.Errorf("after POST /%s the game's paused is %v, want %v", command, status.IsPaused, typed.IsPaused)
+		}
+	}
+
+	var body map[string]string
+	if code := call(t, api, http.MethodPost, "/pause?resume_after=soon", &body); code != http.StatusBadRequest {
+		t.Errorf("POST /pause?resume_after=soon answered %d, want %d", code, http.StatusBadRequest)
+	}
+	select {
+	case ps := <-pauses:
+		t.Errorf("a bad resume_after published %+v", ps)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	c.quit()
+}
+
+func TestAPIReportsState(t *testing.T) {
+	api, state := newAPI(t, pubsub.NewMemoryServer())
+
+	for _, username := range []string{"bob", "alice"} {
+		if _, err := state.handlerJoin(context.Background(), routing.JoinRequest{Username: username}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	state.setPaused(true)
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	var logs []routing.GameLog
+	for i, message := range []string{"first", "second", "third"} {
+		gamelog := routing.GameLog{CurrentTime: start.Add(time.Duration(i) * time.Second), Message: message, Username: "alice"}
+		state.addLog(gamelog)
+		logs = append(logs, gamelog)
+	}
+
+	var status routing.ServerStatus
+	if code := call(t, api, http.MethodGet, "/status", &status); code != http.StatusOK {
+		t.Errorf("GET /status answered %d, want %d", code, http.StatusOK)
+	}
+	if want := (routing.ServerStatus{IsPaused: true, Players: []string{"alice", "bob"}}); !reflect.DeepEqual(status, want) {
+		t.Errorf("GET /status = %+v, want %+v", status, want)
+	}
+
+	var players []string
+	if code := call(t, api, http.MethodGet, "/players", &players); code != http.StatusOK {
+		t.Errorf("GET /players answered %d, want %d", code, http.StatusOK)
+	}
+	if want := []string{"alice", "bob"}; !slices.Equal(players, want) {
+		t.Errorf("GET /players = %v, want %v", players, want)
+	}
+
+	for path, want := range map[string][]routing.GameLog{
+		"/logs":         logs,
+		"/logs?limit=2": logs[1:],
+		"/logs?limit=0": {},
+	} {
+		var got []routing.GameLog
+		if code := call(t, api, http.MethodGet, path, &got); code != http.StatusOK {
+			t.Errorf("GET %s answered %d, want %d", path, code, http.StatusOK)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("GET %s = %+v, want %+v", path, got, want)
+		}
+	}
+	var body map[string]string
+	if code := call(t, api, http.MethodGet, "/logs?limit=-1", &body); code != http.StatusBadRequest {
+		t.Errorf("GET /logs?limit=-1 answered %d, want %d", code, http.StatusBadRequest)
+	}
+}
+
+func TestAPIHealth(t *testing.T) {
+	api, state := newAPI(t, pubsub.NewMemoryServer())
+
+	var body map[string]string
+	if code := call(t, api, http.MethodGet, "/health", &body); code != http.StatusOK || body["status"] != "ok" {
+		t.Errorf("GET /health while connected = %d %v, want %d ok", code, body, http.StatusOK)
+	}
+
+	state.setConnected(false)
+	if code := call(t, api, http.MethodGet, "/health", &body); code != http.StatusServiceUnavailable || body["status"] != "disconnected" {
+		t.Errorf("GET /health while disconnected = %d %v, want %d disconnected", code, body, http.StatusServiceUnavailable)
+	}
+}
+
+// syncBuffer is a bytes.Buffer that's safe to write from one goroutine and
+// read from another.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestServerRunsOnWithoutInput(t *testing.T) {
+	logs := &syncBuffer{}
+	prev := log.Writer()
+	log.SetOutput(logs)
+	t.Cleanup(func() { log.SetOutput(prev) })
+
+	server := pubsub.NewMemoryServer()
+	broker := dial(t, server)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	out := &syncBuffer{}
+	done := make(chan error, 1)
+	go func() { done <- run(ctx, broker, strings.NewReader(""), out) }()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !strings.Contains(logs.String(), "No more input") && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !strings.Contains(logs.String(), "No more input") {
+		t.Fatal("run never noticed its input had ended")
+	}
+
+	// It's still answering queries.
+	rpc := newRPCClient(t, dial(t, server))
+	if _, err := join(rpc, "alice"); err != nil {
+		t.Fatalf("joining after the input ended: %v", err)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("run returned %v once its input ended", err)
+	default:
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("run returned %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for run to stop")
+	}
+	// A closed input isn't read again, so there's only the one prompt.
+	if n := strings.Count(out.String(), "> "); n != 1 {
+		t.Errorf("printed %d prompts, want 1", n)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// commandDLQ handles "dlq", "dlq replay all|<n>...", and "dlq purge",
+// writing what it finds or does to w.
+func commandDLQ(conn pubsub.Broker, args []string, w io.Writer) error {
+	if len(args) == 0 {
+		return listDeadLetters(conn, w)
+	}
+
+	switch args[0] {
+	case "replay":
+		keep, err := selectDeadLetters(args[1:])
+		if err != nil {
+			return err
+		}
+		n, err := pubsub.ReplayDeadLetters(conn, routing.QueuePerilDLQ, keep)
+		fmt.Fprintf(w, "Replayed %d message(s)\n", n)
+		return err
+	case "purge":
+		n, err := pubsub.PurgeDeadLetters(conn, routing.QueuePerilDLQ)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Purged %d message(s)\n", n)
+		return nil
+	default:
+		return fmt.Errorf("unknown dlq command %q", args[0])
+	}
+}
+
+func listDeadLetters(conn pubsub.Broker, w io.Writer) error {
+	letters, err := pubsub.InspectDeadLetters(conn, routing.QueuePerilDLQ)
+	if err != nil {
+		return err
+	}
+	if len(letters) == 0 {
+		fmt.Fprintln(w, "The dead letter queue is empty")
+		return nil
+	}
+
+	for _, dl := range letters {
+		fmt.Fprintf(w, "#%d %s from %s@%s", dl.Index, dl.Delivery.MessageId, dl.Exchange, dl.RoutingKey)
+		if dl.Queue != "" {
+			fmt.Fprintf(w, " via %s", dl.Queue)
+		}
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "    %s x%d", dl.Reason, dl.Count)
+		if !dl.Time.IsZero() {
+			fmt.Fprintf(w, " at %s", dl.Time.Format("2006-01-02 15:04:05"))
+		}
+		if dl.Error != "" {
+			fmt.Fprintf(w, ": %s", dl.Error)
+		}
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "    %s\n", describeBody(dl))
+	}
+	return nil
+}
+
+// selectDeadLetters parses "all" or a list of message numbers from the
+// listing.
+func selectDeadLetters(args []string) (func(pubsub.DeadLetter) bool, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("usage: dlq replay all|<n>...")
+	}
+	if len(args) == 1 && args[0] == "all" {
+		return nil, nil
+	}
+
+	selected := map[int]bool{}
+	for _, arg := range args {
+		n, err := strconv.Atoi(strings.TrimPrefix(arg, "#"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid message number %q", arg)
+		}
+		selected[n] = true
+	}
+	return func(dl pubsub.DeadLetter) bool {
+		return selected[dl.Index]
+	}, nil
+}
+
+// describeBody decodes the body into the type published with its routing
+// key, falling back to the raw bytes.
+func describeBody(dl pubsub.DeadLetter) string {
+	var val any
+	prefix, _, _ := strings.Cut(dl.RoutingKey, ".")
+	switch prefix {
+	case routing.ArmyMovesPrefix:
+		val = &gamelogic.ArmyMove{}
+	case routing.WarRecognitionsPrefix:
+		val = &gamelogic.RecognitionOfWar{}
+	case routing.GameLogSlug:
+		val = &routing.GameLog{}
+	case routing.PauseKey:
+		val = &routing.PlayingState{}
+	default:
+		return fmt.Sprintf("%q", dl.Delivery.Body)
+	}
+
+	if err := dl.Decode(pubsub.DefaultCodecs, val); err != nil {
+		return fmt.Sprintf("%q (%v)", dl.Delivery.Body, err)
+	}
+	return fmt.Sprintf("%+v", val)
+}
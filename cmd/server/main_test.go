@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// console types into a running REPL.
+type console struct {
+	t    *testing.T
+	w    *io.PipeWriter
+	done chan error
+}
+
+// startServer runs the server on its own connection to server and waits
+// for it to be ready for commands.
+func startServer(t *testing.T, server *pubsub.MemoryServer) *console {
+	t.Helper()
+	broker := dial(t, server)
+	r, w := io.Pipe()
+	c := &console{t: t, w: w, done: make(chan error, 1)}
+	go func() {
+		err := run(context.Background(), broker, r, io.Discard)
+		// Fail anything still typing rather than leave it waiting.
+		r.CloseWithError(fmt.Errorf("run returned %v", err))
+		c.done <- err
+	}()
+	t.Cleanup(func() { w.Close() })
+	c.send("")
+	return c
+}
+
+// send types line and waits for the REPL to finish with it, which it has
+// once it's read the two blank lines that follow.
+func (c *console) send(line string) {
+	c.t.Helper()
+	for _, s := range []string{line, "", ""} {
+		if _, err := io.WriteString(c.w, s+"\n"); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+}
+
+// quit types "quit" and waits for the REPL to return.
+func (c *console) quit() {
+	c.t.Helper()
+	if _, err := io.WriteString(c.w, "quit\n"); err != nil {
+		c.t.Fatal(err)
+	}
+	select {
+	case err := <-c.done:
+		if err != nil {
+			c.t.Errorf("run returned %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		c.t.Fatal("timed out waiting for quit")
+	}
+}
+
+func dial(t *testing.T, server *pubsub.MemoryServer) pubsub.Broker {
+	t.Helper()
+	broker, err := server.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { broker.Close() })
+	return broker
+}
+
+func newRPCClient(t *testing.T, broker pubsub.Broker) *pubsub.RPCClient {
+	t.Helper()
+	rpc, err := pubsub.NewRPCClient(broker, pubsub.WithRequestTimeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { rpc.Close() })
+	return rpc
+}
+
+func join(rpc *pubsub.RPCClient, username string) (routing.ServerStatus, error) {
+	return pubsub.Request[routing.JoinRequest, routing.ServerStatus](
+		context.Background(),
+		rpc,
+		routing.ExchangePerilDirect,
+		routing.RPCJoinKey,
+		routing.JoinRequest{Username: username},
+	)
+}
+
+func receive[T any](t *testing.T, ch <-chan T) T {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for a message")
+		var zero T
+		return zero
+	}
+}
+
+func TestServerPausesAndAnswersQueries(t *testing.T) {
+	server := pubsub.NewMemoryServer()
+	c := startServer(t, server)
+
+	broker := dial(t, server)
+	rpc := newRPCClient(t, broker)
+
+	pauses := make(chan routing.PlayingState, 4)
+	sub, err := pubsub.SubscribeJSON(context.Background(), broker, routing.ExchangePerilDirect, "", routing.PauseKey, pubsub.Transient, func(ps routing.PlayingState) pubsub.AckType {
+		pauses <- ps
+		return pubsub.Ack
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	status, err := join(rpc, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(status.Players, []string{"alice"}) {
+		t.Errorf("players after alice joined = %v, want [alice]", status.Players)
+	}
+
+	_, err = join(rpc, "alice")
+	var rpcErr *pubsub.RPCError
+	if !errors.As(err, &rpcErr) || rpcErr.Code != routing.ErrCodeUsernameTaken {
+		t.Errorf("joining as alice twice returned %v, want %s", err, routing.ErrCodeUsernameTaken)
+	}
+
+	c.send("pause")
+	if ps := receive(t, pauses); !ps.IsPaused {
+		t.Error("pause published IsPaused false")
+	}
+	status, err = join(rpc, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.IsPaused {
+		t.Error("bob joined a game that isn't paused, want paused")
+	}
+
+	c.send("resume")
+	if ps := receive(t, pauses); ps.IsPaused {
+		t.Error("resume published IsPaused true")
+	}
+
+	c.quit()
+}
+
+func TestSecondServerStandsByForQueries(t *testing.T) {
+	server := pubsub.NewMemoryServer()
+	first := startServer(t, server)
+	second := startServer(t, server)
+
+	rpc := newRPCClient(t, dial(t, server))
+
+	if _, err := join(rpc, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	// Only one server answers, so the other can't let alice in twice.
+	for i := 0; i < 3; i++ {
+		_, err := join(rpc, "alice")
+		var rpcErr *pubsub.RPCError
+		if !errors.As(err, &rpcErr) || rpcErr.Code != routing.ErrCodeUsernameTaken {
+			t.Fatalf("joining as alice again returned %v, want %s", err, routing.ErrCodeUsernameTaken)
+		}
+	}
+
+	first.quit()
+
+	status, err := join(rpc, "bob")
+	if err != nil {
+		t.Fatalf("joining after the first server quit: %v", err)
+	}
+	if !slices.Equal(status.Players, []string{"bob"}) {
+		t.Errorf("players on the second server = %v, want [bob]", status.Players)
+	}
+
+	second.quit()
+}
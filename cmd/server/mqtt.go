@@ -0,0 +1,31 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// serveMQTT relays MQTT clients on addr to the broker in the background,
+// opening a connection with dial for each. Topics without an exchange are
+// on peril_topic, so a plain client can watch army_moves/+ and war/#, and
+// one that sets the "exchange" user property to peril_direct can watch
+// pause.
+func serveMQTT(addr string, dial func() (pubsub.Broker, error)) (*pubsub.MQTTServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	server := pubsub.NewMQTTServer(dial)
+	server.SetExchange(routing.ExchangePerilTopic)
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Println("MQTT server stopped:", err)
+		}
+	}()
+	return server, nil
+}
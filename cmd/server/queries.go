@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// maxRecentLogs is how many game logs the server remembers for the HTTP
+// API.
+const maxRecentLogs = 100
+
+// serverState is what the server knows about the game, for answering
+// clients' queries and the HTTP API.
+type serverState struct {
+	mu        sync.Mutex
+	isPaused  bool
+	players   map[string]bool
+	connected bool
+	logs      []routing.GameLog
+	// scheduledResume is the ID of the resume "pause <duration>" scheduled.
+	scheduledResume string
+}
+
+func newServerState() *serverState {
+	return &serverState{players: map[string]bool{}, connected: true}
+}
+
+func (s *serverState) setConnected(connected bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connected = connected
+}
+
+func (s *serverState) isConnected() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connected
+}
+
+// addLog remembers gamelog, forgetting the oldest once there are
+// maxRecentLogs.
+func (s *serverState) addLog(gamelog routing.GameLog) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.logs) == maxRecentLogs {
+		s.logs = slices.Delete(s.logs, 0, 1)
+	}
+	s.logs = append(s.logs, gamelog)
+}
+
+// recentLogs returns up to limit of the most recent game logs, oldest
+// first.
+func (s *serverState) recentLogs(limit int) []routing.GameLog {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	start := max(len(s.logs)-limit, 0)
+	return slices.Clone(s.logs[start:])
+}
+
+func (s *serverState) setPaused(isPaused bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.isPaused = isPaused
+}
+
+func (s *serverState) setScheduledResume(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scheduledResume = id
+}
+
+func (s *serverState) takeScheduledResume() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := s.scheduledResume
+	s.scheduledResume = ""
+	return id
+}
+
+func (s *serverState) handlerPause(ps routing.PlayingState) pubsub.AckType {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.isPaused = ps.IsPaused
+	return pubsub.Ack
+}
+
+// status must be called with s.mu held.
+func (s *serverState) status() routing.ServerStatus {
+	players := make([]string, 0, len(s.players))
+	for username := range s.players {
+		players = append(players, username)
+	}
+	slices.Sort(players)
+	return routing.ServerStatus{
+		IsPaused: s.isPaused,
+		Players:  players,
+	}
+}
+
+func (s *serverState) currentStatus() routing.ServerStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status()
+}
+
+func (s *serverState) handlerJoin(_ context.Context, req routing.JoinRequest) (routing.ServerStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.players[req.Username] {
+		return routing.ServerStatus{}, &pubsub.RPCError{
+			Code:    routing.ErrCodeUsernameTaken,
+			Message: fmt.Sprintf("username %s is already taken", req.Username),
+		}
+	}
+	s.players[req.Username] = true
+	log.Printf("%s joined the game\n", req.Username)
+	return s.status(), nil
+}
+
+func (s *serverState) handlerLeave(_ context.Context, req routing.LeaveRequest) (routing.ServerStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.players, req.Username)
+	log.Printf("%s left the game\n", req.Username)
+	return s.status(), nil
+}
+
+func (s *serverState) handlerStatus(_ context.Context, _ routing.StatusRequest) (routing.ServerStatus, error) {
+	return s.currentStatus(), nil
+}
+
+// serveQueries starts answering the clients' queries. The request queues
+// are shared by every server but only one of them answers at a time, so
+// there's one list of players to check usernames against. The others wait
+// to take over if it goes, knowing only the players who join after.
+func serveQueries(ctx context.Context, conn pubsub.Broker, state *serverState) ([]*pubsub.Subscription, error) {
+	var subs []*pubsub.Subscription
+	closeAll := func() {
+		for _, sub := range subs {
+			sub.Close()
+		}
+	}
+	// An unanswered request expires once its sender has given up, and
+	// isn't worth keeping as a dead letter.
+	shared := pubsub.WithQueueOptions(pubsub.WithSingleActiveConsumer(), pubsub.WithoutDeadLetterExchange())
+
+	sub, err := pubsub.Serve(ctx, conn, routing.ExchangePerilDirect, routing.RPCJoinKey, routing.RPCJoinKey, pubsub.Durable, state.handlerJoin, shared)
+	if err != nil {
+		return nil, err
+	}
+	subs = append(subs, sub)
+
+	sub, err = pubsub.Serve(ctx, conn, routing.ExchangePerilDirect, routing.RPCLeaveKey, routing.RPCLeaveKey, pubsub.Durable, state.handlerLeave, shared)
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	subs = append(subs, sub)
+
+	sub, err = pubsub.Serve(ctx, conn, routing.ExchangePerilDirect, routing.RPCStatusKey, routing.RPCStatusKey, pubsub.Durable, state.handlerStatus, shared)
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	subs = append(subs, sub)
+
+	return subs, nil
+}
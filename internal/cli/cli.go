@@ -0,0 +1,69 @@
+// Package cli sets up what every Peril command has in common: logging,
+// metrics and tracing, configured from the same flags.
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/logging"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+)
+
+// Flags are the flags every command shares.
+type Flags struct {
+	logLevel    *string
+	metricsAddr *string
+	traceTo     *string
+}
+
+// AddFlags registers the shared flags on fs.
+func AddFlags(fs *flag.FlagSet) *Flags {
+	return &Flags{
+		logLevel:    fs.String("log-level", "info", "log pubsub and game events at this level and above: debug, info, warn or error"),
+		metricsAddr: fs.String("metrics-addr", "", "serve Prometheus metrics at /metrics on this address, e.g. localhost:9090"),
+		traceTo:     fs.String("trace", "", "write a JSON line per span to this file, or to stdout if \"stdout\""),
+	}
+}
+
+// Setup configures logging, metrics and tracing the way the flags say. It
+// returns a func that stops serving metrics and flushes the trace, to be
+// called on the way out.
+func (f *Flags) Setup() (func(), error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*f.logLevel)); err != nil {
+		return nil, fmt.Errorf("invalid log level: %w", err)
+	}
+	logging.SetLogger(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	var closers []func() error
+	cleanup := func() {
+		for i := len(closers) - 1; i >= 0; i-- {
+			closers[i]()
+		}
+	}
+
+	if *f.metricsAddr != "" {
+		metrics, err := pubsub.ServeMetrics(*f.metricsAddr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to serve metrics: %w", err)
+		}
+		closers = append(closers, metrics.Close)
+		log.Printf("Serving metrics on http://%s/metrics\n", *f.metricsAddr)
+	}
+
+	if *f.traceTo != "" {
+		exporter, err := pubsub.NewJSONFileExporter(*f.traceTo)
+		if err != nil {
+			cleanup()
+			return nil, fmt.Errorf("failed to open trace file: %w", err)
+		}
+		closers = append(closers, exporter.Close)
+		pubsub.SetSpanExporter(exporter)
+	}
+
+	return cleanup, nil
+}
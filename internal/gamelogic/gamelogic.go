@@ -4,58 +4,70 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
+	"io"
 	"math/rand"
-	"os"
 	"strings"
 )
 
-func PrintClientHelp() {
-	fmt.Println("Possible commands:")
-	fmt.Println("* move <location> <unitID> <unitID> <unitID>...")
-	fmt.Println("    example:")
-	fmt.Println("    move asia 1")
-	fmt.Println("* spawn <location> <rank>")
-	fmt.Println("    example:")
-	fmt.Println("    spawn europe infantry")
-	fmt.Println("* status")
-	fmt.Println("* spam <n>")
-	fmt.Println("    example:")
-	fmt.Println("    spam 5")
-	fmt.Println("* quit")
-	fmt.Println("* help")
+func PrintClientHelp(w io.Writer) {
+	fmt.Fprintln(w, "Possible commands:")
+	fmt.Fprintln(w, "* move <location> <unitID> <unitID> <unitID>...")
+	fmt.Fprintln(w, "    example:")
+	fmt.Fprintln(w, "    move asia 1")
+	fmt.Fprintln(w, "* spawn <location> <rank>")
+	fmt.Fprintln(w, "    example:")
+	fmt.Fprintln(w, "    spawn europe infantry")
+	fmt.Fprintln(w, "* status")
+	fmt.Fprintln(w, "* spam <n>")
+	fmt.Fprintln(w, "    example:")
+	fmt.Fprintln(w, "    spam 5")
+	fmt.Fprintln(w, "* quit")
+	fmt.Fprintln(w, "* help")
 }
 
-func ClientWelcome() (string, error) {
-	fmt.Println("Welcome to the Peril client!")
-	fmt.Println("Please enter your username:")
-	words := GetInput()
+// ClientWelcome asks for a username on w and takes it from the next line
+// of input.
+func ClientWelcome(lines <-chan []string, w io.Writer) (string, error) {
+	fmt.Fprintln(w, "Welcome to the Peril client!")
+	fmt.Fprintln(w, "Please enter your username:")
+	fmt.Fprint(w, "> ")
+	words := <-lines
 	if len(words) == 0 {
 		return "", errors.New("you must enter a username. goodbye")
 	}
 	username := words[0]
-	fmt.Printf("Welcome, %s!\n", username)
-	PrintClientHelp()
+	fmt.Fprintf(w, "Welcome, %s!\n", username)
+	PrintClientHelp(w)
 	return username, nil
 }
 
-func PrintServerHelp() {
-	fmt.Println("Possible commands:")
-	fmt.Println("* pause")
-	fmt.Println("* resume")
-	fmt.Println("* quit")
-	fmt.Println("* help")
+func PrintServerHelp(w io.Writer) {
+	fmt.Fprintln(w, "Possible commands:")
+	fmt.Fprintln(w, "* pause [duration]")
+	fmt.Fprintln(w, "    example:")
+	fmt.Fprintln(w, "    pause 5m")
+	fmt.Fprintln(w, "* resume")
+	fmt.Fprintln(w, "* dlq")
+	fmt.Fprintln(w, "* dlq replay all|<n>...")
+	fmt.Fprintln(w, "    example:")
+	fmt.Fprintln(w, "    dlq replay 1 3")
+	fmt.Fprintln(w, "* dlq purge")
+	fmt.Fprintln(w, "* quit")
+	fmt.Fprintln(w, "* help")
 }
 
-func GetInput() []string {
-	fmt.Print("> ")
-	scanner := bufio.NewScanner(os.Stdin)
-	scanned := scanner.Scan()
-	if !scanned {
-		return nil
-	}
-	line := scanner.Text()
-	line = strings.TrimSpace(line)
-	return strings.Fields(line)
+// ReadInput sends each line of r, split into words, until r ends. It
+// reads in the background so that a REPL can wait for other things too.
+func ReadInput(r io.Reader) <-chan []string {
+	lines := make(chan []string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			lines <- strings.Fields(scanner.Text())
+		}
+	}()
+	return lines
 }
 
 func GetMaliciousLog() string {
@@ -72,21 +84,21 @@ func GetMaliciousLog() string {
 	return msg
 }
 
-func PrintQuit() {
-	fmt.Println("I hate this game! (╯°□°)╯︵ ┻━┻")
+func PrintQuit(w io.Writer) {
+	fmt.Fprintln(w, "I hate this game! (╯°□°)╯︵ ┻━┻")
 }
 
 func (gs *GameState) CommandStatus() {
 	if gs.isPaused() {
-		fmt.Println("The game is paused.")
+		fmt.Fprintln(gs.out, "The game is paused.")
 		return
 	} else {
-		fmt.Println("The game is not paused.")
+		fmt.Fprintln(gs.out, "The game is not paused.")
 	}
 
 	p := gs.GetPlayerSnap()
-	fmt.Printf("You are %s, and you have %d units.\n", p.Username, len(p.Units))
+	fmt.Fprintf(gs.out, "You are %s, and you have %d units.\n", p.Username, len(p.Units))
 	for _, unit := range p.Units {
-		fmt.Printf("* %v: %v, %v\n", unit.ID, unit.Location, unit.Rank)
+		fmt.Fprintf(gs.out, "* %v: %v, %v\n", unit.ID, unit.Location, unit.Rank)
 	}
 }
@@ -1,6 +1,7 @@
 package gamelogic
 
 import (
+	"io"
 	"sync"
 )
 
@@ -8,9 +9,12 @@ type GameState struct {
 	Player Player
 	Paused bool
 	mu     *sync.RWMutex
+	out    io.Writer
 }
 
-func NewGameState(username string) *GameState {
+// NewGameState starts username's game, writing what happens in it, from
+// the moves it sees to the wars it fights, to out.
+func NewGameState(username string, out io.Writer) *GameState {
 	return &GameState{
 		Player: Player{
 			Username: username,
@@ -18,6 +22,7 @@ func NewGameState(username string) *GameState {
 		},
 		Paused: false,
 		mu:     &sync.RWMutex{},
+		out:    out,
 	}
 }
 
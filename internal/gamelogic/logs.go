@@ -2,10 +2,10 @@ package gamelogic
 
 import (
 	"fmt"
-	"log"
 	"os"
 	"time"
 
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/logging"
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
 )
 
@@ -14,7 +14,7 @@ const logsFile = "game.log"
 const writeToDiskSleep = 1 * time.Second
 
 func WriteLog(gamelog routing.GameLog) error {
-	log.Printf("received game log...")
+	logging.Logger().Debug("received game log", "username", gamelog.Username)
 	time.Sleep(writeToDiskSleep)
 
 	f, err := os.OpenFile(logsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
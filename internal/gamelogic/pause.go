@@ -7,13 +7,13 @@ import (
 )
 
 func (gs *GameState) HandlePause(ps routing.PlayingState) {
-	defer fmt.Println("------------------------")
-	fmt.Println()
+	defer fmt.Fprintln(gs.out, "------------------------")
+	fmt.Fprintln(gs.out)
 	if ps.IsPaused {
-		fmt.Println("==== Pause Detected ====")
+		fmt.Fprintln(gs.out, "==== Pause Detected ====")
 		gs.pauseGame()
 	} else {
-		fmt.Println("==== Resume Detected ====")
+		fmt.Fprintln(gs.out, "==== Resume Detected ====")
 		gs.resumeGame()
 	}
 }
@@ -0,0 +1,32 @@
+// Package logging holds the logger the pubsub and gamelogic packages log
+// through, so a command configures both in one place.
+package logging
+
+import (
+	"log/slog"
+	"sync"
+)
+
+var (
+	mu     sync.RWMutex
+	logger *slog.Logger
+)
+
+// SetLogger sets the logger to log through. A nil logger, the default,
+// logs through slog.Default. Every delivery is logged at debug level, so
+// the default info level stays quiet under load.
+func SetLogger(l *slog.Logger) {
+	mu.Lock()
+	defer mu.Unlock()
+	logger = l
+}
+
+// Logger returns the logger set with SetLogger, or slog.Default.
+func Logger() *slog.Logger {
+	mu.RLock()
+	defer mu.RUnlock()
+	if logger == nil {
+		return slog.Default()
+	}
+	return logger
+}
@@ -0,0 +1,123 @@
+package pubsub
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec turns values into message bodies and back. ContentType is stamped
+// on every message the codec encodes and is how subscribers pick it again.
+type Codec interface {
+	ContentType() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// The codecs registered by default.
+var (
+	JSON        Codec = jsonCodec{}
+	Gob         Codec = gobCodec{}
+	MessagePack Codec = msgpackCodec{}
+	CBOR        Codec = cborCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string                { return "application/json" }
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+type gobCodec struct{}
+
+func (gobCodec) ContentType() string { return "application/x-gob" }
+
+func (gobCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string                { return "application/msgpack" }
+func (msgpackCodec) Marshal(v any) ([]byte, error)      { return msgpack.Marshal(v) }
+func (msgpackCodec) Unmarshal(data []byte, v any) error { return msgpack.Unmarshal(data, v) }
+
+type cborCodec struct{}
+
+func (cborCodec) ContentType() string                { return "application/cbor" }
+func (cborCodec) Marshal(v any) ([]byte, error)      { return cbor.Marshal(v) }
+func (cborCodec) Unmarshal(data []byte, v any) error { return cbor.Unmarshal(data, v) }
+
+// CodecRegistry maps content types to codecs.
+type CodecRegistry struct {
+	mu     sync.RWMutex
+	codecs map[string]Codec
+}
+
+// DefaultCodecs is the registry used by Subscribe unless a subscription
+// is given one of its own with WithCodecs.
+var DefaultCodecs = NewCodecRegistry(JSON, Gob, MessagePack, CBOR)
+
+// NewCodecRegistry returns a registry holding codecs.
+func NewCodecRegistry(codecs ...Codec) *CodecRegistry {
+	r := &CodecRegistry{codecs: map[string]Codec{}}
+	for _, c := range codecs {
+		r.Register(c)
+	}
+	return r
+}
+
+// WithCodecs sets the registry Subscribe looks codecs up in.
+func WithCodecs(registry *CodecRegistry) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.codecs = registry
+	}
+}
+
+// RegisterCodec adds c to DefaultCodecs.
+func RegisterCodec(c Codec) {
+	DefaultCodecs.Register(c)
+}
+
+// Register adds c, replacing any codec already registered for its content
+// type.
+func (r *CodecRegistry) Register(c Codec) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.codecs[mediaType(c.ContentType())] = c
+}
+
+// Lookup returns the codec for contentType. Parameters such as charset are
+// ignored.
+func (r *CodecRegistry) Lookup(contentType string) (Codec, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	c, ok := r.codecs[mediaType(contentType)]
+	if !ok {
+		return nil, fmt.Errorf("pubsub: no codec registered for content type %q", contentType)
+	}
+	return c, nil
+}
+
+func mediaType(contentType string) string {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType
+	}
+	return t
+}
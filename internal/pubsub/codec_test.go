@@ -0,0 +1,105 @@
+package pubsub
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type codecMove struct {
+	Player string
+	Units  []int
+}
+
+// subscribeMoves subscribes to moves.* with Subscribe, so the codec is
+// picked from each delivery's content type.
+func subscribeMoves(t *testing.T, broker Broker, opts ...SubscribeOption) (<-chan Message[codecMove], *Subscription) {
+	t.Helper()
+	got := make(chan Message[codecMove], 4)
+	sub, err := SubscribeEnvelope(context.Background(), broker, testTopic, "", "moves.*", Transient, func(msg Message[codecMove]) AckType {
+		got <- msg
+		return Ack
+	}, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sub.Close() })
+	return got, sub
+}
+
+func TestCodecNegotiation(t *testing.T) {
+	_, broker := newTestBroker(t)
+	got, _ := subscribeMoves(t, broker)
+	pub := newTestPublisher(t, broker)
+	want := codecMove{Player: "alice", Units: []int{1, 2}}
+
+	for _, codec := range []Codec{JSON, Gob, MessagePack, CBOR} {
+		if err := Publish(pub, testTopic, "moves.alice", want, WithCodec(codec)); err != nil {
+			t.Fatalf("%s: %v", codec.ContentType(), err)
+		}
+		msg := receive(t, got)
+		if msg.ContentType != codec.ContentType() {
+			t.Errorf("published with content type %q, want %q", msg.ContentType, codec.ContentType())
+		}
+		if !reflect.DeepEqual(msg.Body, want) {
+			t.Errorf("%s: got %+v, want %+v", codec.ContentType(), msg.Body, want)
+		}
+	}
+}
+
+func TestCodecFallbacks(t *testing.T) {
+	_, broker := newTestBroker(t)
+	got, _ := subscribeMoves(t, broker)
+	pub := newTestPublisher(t, broker)
+	body, err := JSON.Marshal(codecMove{Player: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Parameters don't matter, and a message without a content type, as
+	// sent before they were set, is read as JSON.
+	for _, contentType := range []string{"application/json; charset=utf-8", ""} {
+		err := pub.PublishWithContext(context.Background(), testTopic, "moves.bob", false, false, amqp.Publishing{
+			ContentType: contentType,
+			Body:        body,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg := receive(t, got); msg.Body.Player != "bob" {
+			t.Errorf("content type %q: got %+v, want bob's move", contentType, msg.Body)
+		}
+	}
+}
+
+func TestCodecUnknownContentType(t *testing.T) {
+	_, broker := newTestBroker(t)
+	captureLogs(t)
+	pub := newTestPublisher(t, broker)
+
+	// A registry without CBOR treats CBOR like any unknown content type.
+	got, sub := subscribeMoves(t, broker, WithCodecs(NewCodecRegistry(JSON)))
+	if err := Publish(pub, testTopic, "moves.alice", codecMove{Player: "alice"}, WithCodec(CBOR)); err != nil {
+		t.Fatal(err)
+	}
+	err := pub.PublishWithContext(context.Background(), testTopic, "moves.alice", false, false, amqp.Publishing{
+		ContentType: "text/x-unknown",
+		Body:        []byte("?"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dead := waitForDeadLetters(t, broker, 2)
+	for i, want := range []string{CBOR.ContentType(), "text/x-unknown"} {
+		if dead[i].Reason != ReasonPoison || dead[i].Delivery.ContentType != want {
+			t.Errorf("dead letter %d is %s for %q, want %s for %q", i, dead[i].Delivery.ContentType, dead[i].Reason, want, ReasonPoison)
+		}
+	}
+	receiveNothing(t, got)
+	if n := sub.PoisonCount(); n != 2 {
+		t.Errorf("PoisonCount = %d, want 2", n)
+	}
+}
@@ -0,0 +1,163 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// ErrNacked is returned when the broker refuses responsibility for a
+// published message.
+var ErrNacked = errors.New("pubsub: broker nacked message")
+
+// UnroutableError is returned for a mandatory publish that the broker
+// could not route to any queue.
+type UnroutableError struct {
+	Exchange   string
+	RoutingKey string
+	ReplyCode  uint16
+	ReplyText  string
+}
+
+func (e *UnroutableError) Error() string {
+	return fmt.Sprintf("message to %s@%s was not routed to any queue (%d %s)", e.Exchange, e.RoutingKey, e.ReplyCode, e.ReplyText)
+}
+
+// ConfirmPublisher publishes on a channel in confirm mode. Each publish
+// blocks until the broker acks or nacks it, and a mandatory publish that
+// comes back as a basic.return fails with an *UnroutableError. Publishes
+// are serialised, so it is safe to use from any goroutine.
+type ConfirmPublisher struct {
+	broker  Broker
+	timeout time.Duration
+
+	mu       sync.Mutex
+	ch       Channel
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
+}
+
+// NewConfirmPublisher opens a confirm mode channel on broker. If the
+// channel closes it is reopened on the next publish, so a Manager can be
+// passed in to survive reconnects.
+func NewConfirmPublisher(broker Broker) (*ConfirmPublisher, error) {
+	p := &ConfirmPublisher{
+		broker:  broker,
+		timeout: 5 * time.Second,
+	}
+	if err := p.open(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// SetTimeout sets how long a publish waits for its confirm before giving up.
+func (p *ConfirmPublisher) SetTimeout(d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.timeout = d
+}
+
+func (p *ConfirmPublisher) open() error {
+	ch, err := p.broker.Channel()
+	if err != nil {
+		return err
+	}
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return err
+	}
+	p.ch = ch
+	p.confirms = ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+	p.returns = ch.NotifyReturn(make(chan amqp.Return, 1))
+	return nil
+}
+
+// reset drops the current channel. It is used whenever the confirm stream
+// can no longer be trusted to line up with our publishes.
+func (p *ConfirmPublisher) reset() {
+	if p.ch != nil {
+		p.ch.Close()
+	}
+	p.ch = nil
+}
+
+func (p *ConfirmPublisher) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.ch == nil {
+		if err := p.open(); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	err := p.ch.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+	if err != nil {
+		p.reset()
+		return err
+	}
+
+	var returned *amqp.Return
+	for {
+		select {
+		case r, ok := <-p.returns:
+			if !ok {
+				p.reset()
+				return amqp.ErrClosed
+			}
+			returned = &r
+		case c, ok := <-p.confirms:
+			if !ok {
+				p.reset()
+				return amqp.ErrClosed
+			}
+			if !c.Ack {
+				return ErrNacked
+			}
+			// The broker sends basic.return before the ack, so if there
+			// is one it is already waiting.
+			select {
+			case r, ok := <-p.returns:
+				if ok {
+					returned = &r
+				}
+			default:
+			}
+			if returned != nil {
+				return &UnroutableError{
+					Exchange:   returned.Exchange,
+					RoutingKey: returned.RoutingKey,
+					ReplyCode:  returned.ReplyCode,
+					ReplyText:  returned.ReplyText,
+				}
+			}
+			return nil
+		case <-ctx.Done():
+			// The confirm may still arrive and would be mistaken for the
+			// next publish's, so start over on a fresh channel.
+			p.reset()
+			return ctx.Err()
+		}
+	}
+}
+
+// Close closes the underlying channel.
+func (p *ConfirmPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.ch == nil {
+		return nil
+	}
+	err := p.ch.Close()
+	p.ch = nil
+	return err
+}
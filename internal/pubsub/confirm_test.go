@@ -0,0 +1,35 @@
+package pubsub
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMandatoryPublishToNoQueueIsUnroutable(t *testing.T) {
+	_, broker := newTestBroker(t)
+	pub := newTestPublisher(t, broker)
+
+	err := PublishJSON(pub, testTopic, "army_moves.alice", "move", Mandatory())
+	var unroutable *UnroutableError
+	if !errors.As(err, &unroutable) {
+		t.Fatalf("mandatory publish with nothing bound returned %v, want an *UnroutableError", err)
+	}
+	if unroutable.Exchange != testTopic || unroutable.RoutingKey != "army_moves.alice" {
+		t.Errorf("unroutable to %s@%s, want %s@army_moves.alice", unroutable.Exchange, unroutable.RoutingKey, testTopic)
+	}
+
+	// Without Mandatory the broker drops it quietly.
+	if err := PublishJSON(pub, testTopic, "army_moves.alice", "move"); err != nil {
+		t.Errorf("publish with nothing bound returned %v, want nil", err)
+	}
+
+	// Once something is bound, the same publish goes through, and the
+	// publisher is still in step with its confirms.
+	moves := collect(t, broker, testTopic, "", "army_moves.*", Transient)
+	if err := PublishJSON(pub, testTopic, "army_moves.alice", "move", Mandatory()); err != nil {
+		t.Fatalf("mandatory publish with a queue bound returned %v", err)
+	}
+	if got := receive(t, moves); got != "move" {
+		t.Errorf("got %q, want %q", got, "move")
+	}
+}
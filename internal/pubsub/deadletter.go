@@ -0,0 +1,221 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/logging"
+)
+
+// DeadLetter is a message sitting in a dead letter queue, with what its
+// headers say about where it came from and why it ended up there.
+type DeadLetter struct {
+	// Index is the message's position in the queue, counting from 1.
+	Index    int
+	Delivery amqp.Delivery
+	// Exchange and RoutingKey are where the message was first published,
+	// and where ReplayDeadLetters sends it back to.
+	Exchange   string
+	RoutingKey string
+	// Queue is the queue that gave up on the message.
+	Queue string
+	// Reason is why: rejected, expired, maxlen or delivery_limit from the
+	// broker, or poison or retries_exhausted from this package.
+	Reason string
+	// Error is the decode error of a poison message.
+	Error string
+	// Count is how many times the message has died this way.
+	Count int64
+	Time  time.Time
+}
+
+// Dead letter reasons this package records in HeaderDeadLetterReason.
+const (
+	ReasonPoison           = "poison"
+	ReasonRetriesExhausted = "retries_exhausted"
+)
+
+// newDeadLetter works out a dead letter's history. Messages dead-lettered
+// by the broker carry x-death, whose first entry is the most recent death.
+// Poison messages and messages that ran out of retries were republished by
+// this package, which records the reason and where they came from in
+// headers of its own.
+func newDeadLetter(index int, delivery amqp.Delivery) DeadLetter {
+	dl := DeadLetter{
+		Index:      index,
+		Delivery:   delivery,
+		Exchange:   delivery.Exchange,
+		RoutingKey: delivery.RoutingKey,
+		Time:       delivery.Timestamp,
+	}
+
+	deaths, _ := delivery.Headers["x-death"].([]interface{})
+	if len(deaths) > 0 {
+		if death, ok := deaths[0].(amqp.Table); ok {
+			dl.Exchange, _ = death["exchange"].(string)
+			if keys, _ := death["routing-keys"].([]interface{}); len(keys) > 0 {
+				dl.RoutingKey, _ = keys[0].(string)
+			}
+			dl.Queue, _ = death["queue"].(string)
+			dl.Reason, _ = death["reason"].(string)
+			dl.Count, _ = normalizeArg(death["count"]).(int64)
+			dl.Time, _ = death["time"].(time.Time)
+		}
+	}
+
+	// A retried message comes back through the default exchange, so the
+	// broker's record of where it died isn't where it started.
+	if exchange, ok := delivery.Headers[HeaderOriginalExchange].(string); ok {
+		dl.Exchange = exchange
+		dl.RoutingKey, _ = delivery.Headers[HeaderOriginalRoutingKey].(string)
+		dl.Queue, _ = delivery.Headers[HeaderOriginalQueue].(string)
+	}
+	if reason, ok := delivery.Headers[HeaderDeadLetterReason].(string); ok {
+		dl.Reason = reason
+		dl.Count = 1
+		dl.Error, _ = delivery.Headers[HeaderPoisonError].(string)
+	}
+	return dl
+}
+
+// Decode decodes the message body into v with the codec for its content
+// type, or with the codec recorded when it failed to decode.
+func (dl DeadLetter) Decode(codecs *CodecRegistry, v any) error {
+	contentType := dl.Delivery.ContentType
+	if codec, ok := dl.Delivery.Headers[HeaderPoisonCodec].(string); ok && codec != "" {
+		contentType = codec
+	}
+	if contentType == "" {
+		return JSON.Unmarshal(dl.Delivery.Body, v)
+	}
+	codec, err := codecs.Lookup(contentType)
+	if err != nil {
+		return err
+	}
+	return codec.Unmarshal(dl.Delivery.Body, v)
+}
+
+// InspectDeadLetters lists the messages in a dead letter queue without
+// removing them. Messages that arrive while it runs may not be listed.
+func InspectDeadLetters(broker Broker, queue string) ([]DeadLetter, error) {
+	var letters []DeadLetter
+	err := drainDeadLetters(broker, queue, func(dl DeadLetter) (bool, error) {
+		letters = append(letters, dl)
+		return false, nil
+	})
+	return letters, err
+}
+
+// ReplayDeadLetters republishes the messages in a dead letter queue that
+// keep selects, or all of them if keep is nil, to the exchange and routing
+// key they were first published with. The dead-lettering headers are
+// stripped so they start afresh. A message is only removed from the queue
+// once the broker has confirmed its replay. One that can't be routed stays
+// where it is and the replay carries on with the rest; each is reported in
+// the error, as an *UnroutableError, once they've all been tried. It
+// returns how many were replayed.
+func ReplayDeadLetters(broker Broker, queue string, keep func(DeadLetter) bool) (int, error) {
+	pub, err := NewConfirmPublisher(broker)
+	if err != nil {
+		return 0, err
+	}
+	defer pub.Close()
+
+	replayed := 0
+	var unroutable []error
+	err = drainDeadLetters(broker, queue, func(dl DeadLetter) (bool, error) {
+		if keep != nil && !keep(dl) {
+			return false, nil
+		}
+		err := pub.PublishWithContext(
+			context.Background(),
+			dl.Exchange,
+			dl.RoutingKey,
+			true,
+			false,
+			republishing(dl.Delivery, replayHeaders(dl.Delivery.Headers)),
+		)
+		var unroutableErr *UnroutableError
+		if errors.As(err, &unroutableErr) {
+			logging.Logger().Warn("dead letter is unroutable, leaving it in the queue", "queue", queue, "index", dl.Index, "exchange", dl.Exchange, "routing_key", dl.RoutingKey)
+			unroutable = append(unroutable, fmt.Errorf("replay message %d: %w", dl.Index, err))
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("replay message %d to %s@%s: %w", dl.Index, dl.Exchange, dl.RoutingKey, err)
+		}
+		replayed++
+		return true, nil
+	})
+	if err != nil {
+		return replayed, err
+	}
+	return replayed, errors.Join(unroutable...)
+}
+
+// PurgeDeadLetters deletes every message in a dead letter queue and returns
+// how many there were.
+func PurgeDeadLetters(broker Broker, queue string) (int, error) {
+	ch, err := broker.Channel()
+	if err != nil {
+		return 0, err
+	}
+	defer ch.Close()
+	return ch.QueuePurge(queue, false)
+}
+
+// drainDeadLetters gets every message in the queue in turn and passes it to
+// fn, acking the ones fn says are done with. The rest are held unacked
+// until the end so they aren't got again, then all requeued at once to keep
+// their order.
+func drainDeadLetters(broker Broker, queue string, fn func(DeadLetter) (bool, error)) error {
+	ch, err := broker.Channel()
+	if err != nil {
+		return err
+	}
+	// Closing the channel requeues whatever is still unacked.
+	defer ch.Close()
+
+	for index := 1; ; index++ {
+		delivery, ok, err := ch.Get(queue, false)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+
+		done, err := fn(newDeadLetter(index, delivery))
+		if err != nil {
+			return err
+		}
+		if done {
+			if err := delivery.Ack(false); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// replayHeaders drops what dead-lettering added to a message's headers.
+func replayHeaders(headers amqp.Table) amqp.Table {
+	out := amqp.Table{}
+	for k, v := range headers {
+		switch k {
+		case HeaderDeadLetterReason, HeaderPoisonError, HeaderPoisonCodec,
+			HeaderOriginalExchange, HeaderOriginalRoutingKey, HeaderOriginalQueue,
+			HeaderRetryAttempts, HeaderRetryHistory:
+			continue
+		}
+		if k == "x-death" || strings.HasPrefix(k, "x-first-death-") || strings.HasPrefix(k, "x-last-death-") {
+			continue
+		}
+		out[k] = v
+	}
+	return out
+}
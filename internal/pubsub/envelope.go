@@ -0,0 +1,180 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// AppID is stamped on every message this process publishes. It defaults to
+// the name of the executable.
+var AppID = filepath.Base(os.Args[0])
+
+// newMessageID returns a random 128-bit ID in hex.
+func newMessageID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// Message is a decoded delivery together with its metadata.
+type Message[T any] struct {
+	Body T
+
+	Exchange      string
+	RoutingKey    string
+	MessageID     string
+	CorrelationID string
+	ReplyTo       string
+	AppID         string
+	ContentType   string
+	Timestamp     time.Time
+	Headers       amqp.Table
+
+	// Redelivered is set when the broker has delivered the message before
+	// and it was requeued rather than acked.
+	Redelivered bool
+	// DeliveryCount is how many times this message has been handed to a
+	// handler, counting this time, across requeues and RetryLater retries.
+	DeliveryCount int
+
+	ctx context.Context
+}
+
+// Context returns the context the handler runs in. It is cancelled when the
+// subscription closes.
+func (m Message[T]) Context() context.Context {
+	if m.ctx == nil {
+		return context.Background()
+	}
+	return m.ctx
+}
+
+func newMessage[T any](ctx context.Context, delivery amqp.Delivery, val T) Message[T] {
+	// A retried message comes back through its wait queue, so report
+	// where it was first published instead.
+	exchange, key := delivery.Exchange, delivery.RoutingKey
+	if k, ok := delivery.Headers[HeaderOriginalRoutingKey].(string); ok {
+		exchange, _ = delivery.Headers[HeaderOriginalExchange].(string)
+		key = k
+	}
+	return Message[T]{
+		Body:          val,
+		Exchange:      exchange,
+		RoutingKey:    key,
+		MessageID:     delivery.MessageId,
+		CorrelationID: delivery.CorrelationId,
+		ReplyTo:       delivery.ReplyTo,
+		AppID:         delivery.AppId,
+		ContentType:   delivery.ContentType,
+		Timestamp:     delivery.Timestamp,
+		Headers:       delivery.Headers,
+		Redelivered:   delivery.Redelivered,
+		DeliveryCount: deliveryCount(delivery),
+		ctx:           ctx,
+	}
+}
+
+// deliveryCount adds up what the broker and our retries know about earlier
+// deliveries. Quorum queues count requeues in x-delivery-count; classic
+// queues only say whether there was at least one.
+func deliveryCount(delivery amqp.Delivery) int {
+	count := 1
+	if n, ok := normalizeArg(delivery.Headers["x-delivery-count"]).(int64); ok {
+		count += int(n)
+	} else if delivery.Redelivered {
+		count++
+	}
+	if n, ok := normalizeArg(delivery.Headers[HeaderRetryAttempts]).(int64); ok {
+		count += int(n)
+	}
+	return count
+}
+
+func envelopeHandler[T any](handler func(Message[T]) AckType) typedHandler[T] {
+	return func(ctx context.Context, delivery amqp.Delivery, val T) AckType {
+		return handler(newMessage(ctx, delivery, val))
+	}
+}
+
+// SubscribeEnvelope is Subscribe for handlers that want the message's
+// metadata as well as its body.
+func SubscribeEnvelope[T any](
+	ctx context.Context,
+	broker Broker,
+	exchange,
+	queueName,
+	key string,
+	simpleQueueType SimpleQueueType,
+	handler func(Message[T]) AckType,
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	return subscribe(
+		ctx,
+		broker,
+		exchange,
+		queueName,
+		key,
+		simpleQueueType,
+		envelopeHandler(handler),
+		negotiatedCodec,
+		opts,
+	)
+}
+
+// SubscribeJSONEnvelope is SubscribeJSON for handlers that want the
+// message's metadata as well as its body.
+func SubscribeJSONEnvelope[T any](
+	ctx context.Context,
+	broker Broker,
+	exchange,
+	queueName,
+	key string,
+	simpleQueueType SimpleQueueType,
+	handler func(Message[T]) AckType,
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	return subscribe(
+		ctx,
+		broker,
+		exchange,
+		queueName,
+		key,
+		simpleQueueType,
+		envelopeHandler(handler),
+		fixedCodec(JSON),
+		opts,
+	)
+}
+
+// SubscribeGobEnvelope is SubscribeGob for handlers that want the message's
+// metadata as well as its body.
+func SubscribeGobEnvelope[T any](
+	ctx context.Context,
+	broker Broker,
+	exchange,
+	queueName,
+	key string,
+	simpleQueueType SimpleQueueType,
+	handler func(Message[T]) AckType,
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	return subscribe(
+		ctx,
+		broker,
+		exchange,
+		queueName,
+		key,
+		simpleQueueType,
+		envelopeHandler(handler),
+		fixedCodec(Gob),
+		opts,
+	)
+}
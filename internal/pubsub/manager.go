@@ -0,0 +1,426 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"reflect"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/logging"
+)
+
+// ErrManagerClosed is returned by a Manager after Close has been called.
+var ErrManagerClosed = errors.New("pubsub: connection manager closed")
+
+// Dialer opens a new connection to the broker.
+type Dialer func() (Broker, error)
+
+type ReconnectEventKind int
+
+const (
+	// Disconnected is reported when the connection to the broker drops.
+	Disconnected ReconnectEventKind = iota
+	// ReconnectFailed is reported after each failed attempt to reconnect.
+	ReconnectFailed
+	// Reconnected is reported once a new connection is open and the
+	// topology has been redeclared.
+	Reconnected
+)
+
+func (k ReconnectEventKind) String() string {
+	switch k {
+	case Disconnected:
+		return "disconnected"
+	case ReconnectFailed:
+		return "reconnect failed"
+	case Reconnected:
+		return "reconnected"
+	}
+	return "unknown"
+}
+
+// ReconnectEvent describes a change in a Manager's connection.
+type ReconnectEvent struct {
+	Kind    ReconnectEventKind
+	Attempt int
+	Err     error
+}
+
+// ManagerOption configures a Manager.
+type ManagerOption func(*Manager)
+
+// WithBackoff sets the delay before the first reconnect attempt and the
+// ceiling it doubles up to after each failure.
+func WithBackoff(initial, max time.Duration) ManagerOption {
+	return func(m *Manager) {
+		m.initialBackoff = initial
+		m.maxBackoff = max
+	}
+}
+
+// Manager is a Broker that keeps itself connected. When the connection
+// drops it redials with exponential backoff, redeclares every queue bound
+// through DeclareAndBind and lets subscriptions made through it reattach
+// their handlers. Manager is also a Publisher, publishing on a channel it
+// reopens as needed.
+type Manager struct {
+	dial           Dialer
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+
+	mu        sync.Mutex
+	conn      Broker
+	connected chan struct{} // closed while conn is usable
+	closed    bool
+	done      chan struct{}
+	emitMu    sync.Mutex // held while events are sent to listeners
+	listeners []chan ReconnectEvent
+	closeRcvs []chan *amqp.Error
+	topology  map[topologyKey]func(Broker) error
+	// applied are the topologies applied through the Manager, which are
+	// redeclared before topology since its queues bind to their exchanges.
+	applied []Topology
+
+	pubMu     sync.Mutex
+	pubCh     Channel
+	pubClosed chan *amqp.Error
+}
+
+type topologyKey struct {
+	exchange string
+	queue    string
+	key      string
+}
+
+// NewManager dials the broker and starts watching the connection. It fails
+// if the first dial fails.
+func NewManager(dial Dialer, opts ...ManagerOption) (*Manager, error) {
+	m := &Manager{
+		dial:           dial,
+		initialBackoff: 500 * time.Millisecond,
+		maxBackoff:     30 * time.Second,
+		connected:      make(chan struct{}),
+		done:           make(chan struct{}),
+		topology:       map[topologyKey]func(Broker) error{},
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	m.conn = conn
+	close(m.connected)
+	go m.watch(conn)
+	return m, nil
+}
+
+// NotifyReconnect registers a listener for connection events. Events are
+// sent from the reconnect loop, so the channel should be buffered or
+// drained promptly.
+func (m *Manager) NotifyReconnect(receiver chan ReconnectEvent) chan ReconnectEvent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		close(receiver)
+		return receiver
+	}
+	m.listeners = append(m.listeners, receiver)
+	return receiver
+}
+
+// Channel opens a channel on the current connection.
+func (m *Manager) Channel() (Channel, error) {
+	m.mu.Lock()
+	conn := m.conn
+	closed := m.closed
+	m.mu.Unlock()
+
+	if closed {
+		return nil, ErrManagerClosed
+	}
+	if conn == nil {
+		return nil, amqp.ErrClosed
+	}
+	return conn.Channel()
+}
+
+// NotifyClose registers a listener that is closed when the Manager itself
+// is closed. Dropped connections are handled internally and not reported
+// here; use NotifyReconnect for those.
+func (m *Manager) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		close(receiver)
+		return receiver
+	}
+	m.closeRcvs = append(m.closeRcvs, receiver)
+	return receiver
+}
+
+// Close stops reconnecting and closes the current connection.
+func (m *Manager) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return ErrManagerClosed
+	}
+	m.closed = true
+	close(m.done)
+	conn := m.conn
+	m.conn = nil
+	for _, r := range m.closeRcvs {
+		close(r)
+	}
+	m.closeRcvs = nil
+	m.mu.Unlock()
+
+	m.emitMu.Lock()
+	m.mu.Lock()
+	for _, l := range m.listeners {
+		close(l)
+	}
+	m.listeners = nil
+	m.mu.Unlock()
+	m.emitMu.Unlock()
+
+	if conn == nil {
+		return nil
+	}
+	return conn.Close()
+}
+
+// PublishWithContext publishes on a channel owned by the Manager, reopening
+// it first if it was closed. Publishes are serialised, so it is safe to call
+// from any goroutine.
+func (m *Manager) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	m.pubMu.Lock()
+	defer m.pubMu.Unlock()
+
+	if m.pubCh != nil {
+		select {
+		case <-m.pubClosed:
+			m.pubCh = nil
+		default:
+		}
+	}
+	if m.pubCh == nil {
+		ch, err := m.Channel()
+		if err != nil {
+			return err
+		}
+		m.pubCh = ch
+		m.pubClosed = ch.NotifyClose(make(chan *amqp.Error, 1))
+	}
+	return m.pubCh.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+}
+
+// declare runs fn against the current connection now and again after every
+// reconnect. Declaring the same exchange, queue and key twice replaces the
+// earlier declaration.
+func (m *Manager) declare(k topologyKey, fn func(Broker) error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.topology[k] = fn
+}
+
+// declareTopology applies t again after every reconnect, ahead of anything
+// passed to declare. Applying the same topology twice keeps one copy.
+func (m *Manager) declareTopology(t Topology) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, applied := range m.applied {
+		if reflect.DeepEqual(applied, t) {
+			return
+		}
+	}
+	m.applied = append(m.applied, t)
+}
+
+// undeclare stops redeclaring k after reconnects.
+func (m *Manager) undeclare(k topologyKey) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.topology, k)
+}
+
+func (m *Manager) isClosed() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.closed
+}
+
+// awaitConnection blocks until the Manager is connected. It returns false
+// if the Manager is closed or ctx is done first.
+func (m *Manager) awaitConnection(ctx context.Context) bool {
+	m.mu.Lock()
+	connected := m.connected
+	m.mu.Unlock()
+
+	select {
+	case <-connected:
+		return true
+	case <-m.done:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// resubscribe retries consume until it succeeds, backing off between
+// attempts. It returns false if the Manager is closed or ctx is done first.
+func (m *Manager) resubscribe(ctx context.Context, consume func() (<-chan amqp.Delivery, error)) (<-chan amqp.Delivery, bool) {
+	delay := m.initialBackoff
+	for {
+		if !m.awaitConnection(ctx) {
+			return nil, false
+		}
+		deliveries, err := consume()
+		if err == nil {
+			return deliveries, true
+		}
+		logging.Logger().Warn("failed to resubscribe", "retry_in", delay, "error", err)
+		if !m.sleepContext(ctx, delay) {
+			return nil, false
+		}
+		delay = m.nextBackoff(delay)
+	}
+}
+
+func (m *Manager) watch(conn Broker) {
+	err, ok := <-conn.NotifyClose(make(chan *amqp.Error, 1))
+
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return
+	}
+	m.conn = nil
+	m.connected = make(chan struct{})
+	m.mu.Unlock()
+
+	event := ReconnectEvent{Kind: Disconnected}
+	if ok && err != nil {
+		event.Err = err
+	}
+	m.emit(event)
+	m.reconnect()
+}
+
+func (m *Manager) reconnect() {
+	delay := m.initialBackoff
+	for attempt := 1; ; attempt++ {
+		if !m.sleep(jitter(delay)) {
+			return
+		}
+
+		conn, err := m.dial()
+		if err == nil {
+			if err = m.redeclare(conn); err != nil {
+				conn.Close()
+			}
+		}
+		if err != nil {
+			m.emit(ReconnectEvent{Kind: ReconnectFailed, Attempt: attempt, Err: err})
+			delay = m.nextBackoff(delay)
+			continue
+		}
+
+		m.mu.Lock()
+		if m.closed {
+			m.mu.Unlock()
+			conn.Close()
+			return
+		}
+		m.conn = conn
+		close(m.connected)
+		m.mu.Unlock()
+
+		m.emit(ReconnectEvent{Kind: Reconnected, Attempt: attempt})
+		go m.watch(conn)
+		return
+	}
+}
+
+func (m *Manager) redeclare(conn Broker) error {
+	m.mu.Lock()
+	applied := append([]Topology(nil), m.applied...)
+	fns := make([]func(Broker) error, 0, len(m.topology))
+	for _, fn := range m.topology {
+		fns = append(fns, fn)
+	}
+	m.mu.Unlock()
+
+	for _, t := range applied {
+		if err := t.apply(conn); err != nil {
+			return err
+		}
+	}
+	for _, fn := range fns {
+		if err := fn(conn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Manager) emit(event ReconnectEvent) {
+	m.emitMu.Lock()
+	defer m.emitMu.Unlock()
+
+	m.mu.Lock()
+	listeners := append([]chan ReconnectEvent(nil), m.listeners...)
+	m.mu.Unlock()
+
+	for _, l := range listeners {
+		select {
+		case l <- event:
+		case <-m.done:
+			return
+		}
+	}
+}
+
+func (m *Manager) sleep(d time.Duration) bool {
+	return m.sleepContext(context.Background(), d)
+}
+
+func (m *Manager) sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-m.done:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (m *Manager) nextBackoff(d time.Duration) time.Duration {
+	d *= 2
+	if d > m.maxBackoff {
+		d = m.maxBackoff
+	}
+	return d
+}
+
+// jitter spreads d by up to 20% either way so that several processes
+// reconnecting at once don't all hit the broker together.
+func jitter(d time.Duration) time.Duration {
+	spread := int64(d) / 5
+	if spread <= 0 {
+		return d
+	}
+	return d + time.Duration(rand.Int63n(2*spread)-spread)
+}
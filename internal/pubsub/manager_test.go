@@ -0,0 +1,117 @@
+package pubsub
+
+import (
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestManagerReappliesTopologyAfterRestart(t *testing.T) {
+	server := NewMemoryServer()
+	m, err := NewManager(server.Dial, WithBackoff(time.Millisecond, 10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Close() })
+	events := m.NotifyReconnect(make(chan ReconnectEvent, 16))
+
+	// A transient exchange is gone after a restart, like every exchange
+	// on a broker that comes back without its data.
+	topology := Topology{
+		Exchanges: []ExchangeSpec{
+			{Name: testTopic, Kind: amqp.ExchangeTopic},
+			{Name: DeadLetterExchange, Kind: amqp.ExchangeFanout, Durable: true},
+		},
+	}
+	if err := topology.Apply(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := topology.Apply(m); err != nil {
+		t.Fatal(err)
+	}
+	got := collect(t, m, testTopic, "moves", "army_moves.*", Durable)
+
+	server.Restart()
+	for {
+		event := receive(t, events)
+		if event.Kind == Reconnected {
+			break
+		}
+		if event.Kind == ReconnectFailed {
+			t.Fatalf("reconnect attempt %d failed: %v", event.Attempt, event.Err)
+		}
+	}
+
+	pub := newTestPublisher(t, m)
+	if err := PublishJSON(pub, testTopic, "army_moves.alice", "move"); err != nil {
+		t.Fatal(err)
+	}
+	if v := receive(t, got); v != "move" {
+		t.Errorf("got %q after the restart, want %q", v, "move")
+	}
+}
+
+func TestManagerResubscribesAfterConnectionLoss(t *testing.T) {
+	server := NewMemoryServer()
+	conns := make(chan Broker, 4)
+	dial := func() (Broker, error) {
+		conn, err := server.Dial()
+		if err == nil {
+			conns <- conn
+		}
+		return conn, err
+	}
+	m, err := NewManager(dial, WithBackoff(time.Millisecond, 10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Close() })
+	events := m.NotifyReconnect(make(chan ReconnectEvent, 16))
+	if err := testTopology.Apply(m); err != nil {
+		t.Fatal(err)
+	}
+
+	// The transient queue goes with the connection that declared it, so
+	// it has to be declared again as well as consumed.
+	durable := collect(t, m, testTopic, "moves", "army_moves.*", Durable)
+	transient := collect(t, m, testTopic, "", "army_moves.*", Transient)
+	// The Manager publishes on a channel it reopens after a reconnect.
+	if err := PublishJSON(m, testTopic, "army_moves.alice", "before"); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, durable)
+	receive(t, transient)
+
+	if err := receive(t, conns).Close(); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		event := receive(t, events)
+		if event.Kind == Reconnected {
+			break
+		}
+		if event.Kind == ReconnectFailed {
+			t.Fatalf("reconnect attempt %d failed: %v", event.Attempt, event.Err)
+		}
+	}
+
+	// Subscriptions reattach on their own after the reconnect, so keep
+	// publishing until both have.
+	deadline := time.Now().Add(2 * time.Second)
+	for gotDurable, gotTransient := false, false; !gotDurable || !gotTransient; {
+		if time.Now().After(deadline) {
+			t.Fatalf("after the reconnect, durable got a message: %v, transient: %v", gotDurable, gotTransient)
+		}
+		if err := PublishJSON(m, testTopic, "army_moves.alice", "after"); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case v := <-durable:
+			gotDurable = gotDurable || v == "after"
+		case v := <-transient:
+			gotTransient = gotTransient || v == "after"
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,1207 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// MemoryServer is an in-process stand-in for a RabbitMQ server. It supports
+// direct, topic, fanout and headers exchanges, durable and transient queues,
+// acks, nacks, message TTLs, queue expiry, length limits, delivery limits,
+// single active consumers and dead-lettering, which is enough to run Peril end-to-end
+// without a real broker. Quorum queues and streams are declared like
+// RabbitMQ declares them but otherwise behave as classic queues.
+type MemoryServer struct {
+	mu        sync.Mutex
+	exchanges map[string]*memExchange
+	queues    map[string]*memQueue
+	conns     map[*memoryConn]struct{}
+	seq       uint64
+	// skew is how far Advance has moved the server's clock ahead.
+	skew time.Duration
+}
+
+type memExchange struct {
+	name       string
+	kind       string
+	durable    bool
+	autoDelete bool
+	bindings   []memBinding
+}
+
+type memBinding struct {
+	queue *memQueue
+	key   string
+	// args are what a headers exchange matches message headers against.
+	args amqp.Table
+}
+
+type memQueue struct {
+	name       string
+	durable    bool
+	autoDelete bool
+	exclusive  bool
+	owner      *memoryConn
+	args       amqp.Table
+	ready      []*memMessage
+	consumers  []*memConsumer
+	deleted    bool
+	// cond is signalled whenever a message becomes ready or a consumer
+	// gains prefetch capacity.
+	cond *sync.Cond
+	// expiry fires when the message at the head of the queue expires.
+	expiry *time.Timer
+	// lastUsed is when the queue was last declared, consumed from or
+	// fetched from, which its x-expires counts from.
+	lastUsed time.Time
+}
+
+type memMessage struct {
+	exchange    string
+	key         string
+	msg         amqp.Publishing
+	redelivered bool
+	expiresAt   time.Time
+	// returned counts how many times the message went back to the queue,
+	// for x-delivery-limit.
+	returned int
+}
+
+type memConsumer struct {
+	tag        string
+	ch         *memoryChannel
+	queue      *memQueue
+	autoAck    bool
+	exclusive  bool
+	prefetch   int
+	unacked    int
+	cancelled  bool
+	stop       chan struct{}
+	deliveries chan amqp.Delivery
+}
+
+type memUnacked struct {
+	msg   *memMessage
+	queue *memQueue
+	// consumer is nil for a message fetched with Get.
+	consumer *memConsumer
+}
+
+// settle frees the prefetch slot the message was holding.
+func (u *memUnacked) settle() {
+	if u.consumer != nil {
+		u.consumer.unacked--
+	}
+}
+
+// NewMemoryServer returns an empty server with only the default and amq.*
+// exchanges declared.
+func NewMemoryServer() *MemoryServer {
+	s := &MemoryServer{
+		exchanges: map[string]*memExchange{},
+		queues:    map[string]*memQueue{},
+		conns:     map[*memoryConn]struct{}{},
+	}
+	for name, kind := range map[string]string{
+		"":            amqp.ExchangeDirect,
+		"amq.direct":  amqp.ExchangeDirect,
+		"amq.topic":   amqp.ExchangeTopic,
+		"amq.fanout":  amqp.ExchangeFanout,
+		"amq.headers": amqp.ExchangeHeaders,
+		"amq.match":   amqp.ExchangeHeaders,
+	} {
+		s.exchanges[name] = &memExchange{name: name, kind: kind, durable: true}
+	}
+	return s
+}
+
+// Dial opens a new connection to the server.
+func (s *MemoryServer) Dial() (Broker, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := &memoryConn{
+		server:   s,
+		channels: map[*memoryChannel]struct{}{},
+	}
+	s.conns[c] = struct{}{}
+	return c, nil
+}
+
+// Restart simulates a broker restart. Every open connection is dropped with
+// a CONNECTION_FORCED error and only durable exchanges and queues survive,
+// along with the messages in them.
+func (s *MemoryServer) Restart() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := &amqp.Error{
+		Code:   amqp.ConnectionForced,
+		Reason: "CONNECTION_FORCED - broker forced connection closure with reason 'shutdown'",
+		Server: true,
+	}
+	for c := range s.conns {
+		c.shutdownLocked(err)
+	}
+	for _, q := range s.queues {
+		if !q.durable {
+			s.deleteQueueLocked(q)
+		}
+	}
+	for name, ex := range s.exchanges {
+		if !ex.durable {
+			delete(s.exchanges, name)
+		}
+	}
+}
+
+// Advance moves the server's clock forward by d, expiring every message
+// whose TTL runs out in the meantime, so tests of delays and retries don't
+// have to wait for them. Queues left unused for longer than their
+// x-expires are deleted, which only Advance does.
+func (s *MemoryServer) Advance(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.skew += d
+	// Dead-lettering an expired message enqueues it elsewhere, which
+	// expires whatever is due there too.
+	for _, q := range s.queues {
+		s.expireLocked(q)
+	}
+	now := s.now()
+	for _, q := range s.queues {
+		expires, ok := normalizeArg(q.args["x-expires"]).(int64)
+		if ok && len(q.consumers) == 0 && !now.Before(q.lastUsed.Add(time.Duration(expires)*time.Millisecond)) {
+			s.deleteQueueLocked(q)
+		}
+	}
+}
+
+func (s *MemoryServer) now() time.Time {
+	return time.Now().Add(s.skew)
+}
+
+func (s *MemoryServer) nextID(prefix string) string {
+	s.seq++
+	return fmt.Sprintf("%s%d", prefix, s.seq)
+}
+
+func (s *MemoryServer) deleteQueueLocked(q *memQueue) {
+	if q.deleted {
+		return
+	}
+	q.deleted = true
+	delete(s.queues, q.name)
+	for _, ex := range s.exchanges {
+		bindings := ex.bindings[:0]
+		for _, b := range ex.bindings {
+			if b.queue != q {
+				bindings = append(bindings, b)
+			}
+		}
+		ex.bindings = bindings
+	}
+	for _, c := range append([]*memConsumer(nil), q.consumers...) {
+		s.removeConsumerLocked(c)
+	}
+	q.ready = nil
+	if q.expiry != nil {
+		q.expiry.Stop()
+	}
+	q.cond.Broadcast()
+}
+
+func (s *MemoryServer) removeConsumerLocked(c *memConsumer) {
+	if c.cancelled {
+		return
+	}
+	c.cancelled = true
+	close(c.stop)
+	delete(c.ch.consumers, c.tag)
+
+	q := c.queue
+	for i, other := range q.consumers {
+		if other == c {
+			q.consumers = append(q.consumers[:i], q.consumers[i+1:]...)
+			break
+		}
+	}
+	q.cond.Broadcast()
+	q.lastUsed = s.now()
+	if q.autoDelete && len(q.consumers) == 0 {
+		s.deleteQueueLocked(q)
+	}
+}
+
+// routeLocked delivers msg to every queue bound to ex with a matching key.
+func (s *MemoryServer) routeLocked(ex *memExchange, key string, msg amqp.Publishing) int {
+	var targets []*memQueue
+	if ex.name == "" {
+		if q, ok := s.queues[key]; ok {
+			targets = append(targets, q)
+		}
+	} else {
+		seen := map[*memQueue]bool{}
+		for _, b := range ex.bindings {
+			if seen[b.queue] {
+				continue
+			}
+			if ex.kind == amqp.ExchangeHeaders {
+				if !headersMatch(b.args, msg.Headers) {
+					continue
+				}
+			} else if !bindingMatches(ex.kind, b.key, key) {
+				continue
+			}
+			seen[b.queue] = true
+			targets = append(targets, b.queue)
+		}
+	}
+
+	for _, q := range targets {
+		s.enqueueLocked(q, &memMessage{exchange: ex.name, key: key, msg: msg})
+	}
+	return len(targets)
+}
+
+func (s *MemoryServer) enqueueLocked(q *memQueue, m *memMessage) {
+	if q.deleted {
+		return
+	}
+	m.expiresAt = messageExpiry(q, m.msg, s.now())
+	q.ready = append(q.ready, m)
+	s.overflowLocked(q)
+	s.expireLocked(q)
+	q.cond.Broadcast()
+}
+
+// overflowLocked brings a queue that has just gone over its x-max-length
+// back to it, dropping from the head or the tail depending on x-overflow.
+func (s *MemoryServer) overflowLocked(q *memQueue) {
+	max, ok := normalizeArg(q.args["x-max-length"]).(int64)
+	if !ok {
+		return
+	}
+	for int64(len(q.ready)) > max {
+		switch q.args["x-overflow"] {
+		case string(RejectPublish):
+			q.ready = q.ready[:len(q.ready)-1]
+		case string(RejectPublishDLX):
+			m := q.ready[len(q.ready)-1]
+			q.ready = q.ready[:len(q.ready)-1]
+			s.deadLetterLocked(q, m, "maxlen")
+		default:
+			m := q.ready[0]
+			q.ready = q.ready[1:]
+			s.deadLetterLocked(q, m, "maxlen")
+		}
+	}
+}
+
+func (s *MemoryServer) requeueLocked(q *memQueue, m *memMessage) {
+	if q.deleted {
+		return
+	}
+	m.returned++
+	if limit, ok := normalizeArg(q.args["x-delivery-limit"]).(int64); ok && int64(m.returned) > limit {
+		s.deadLetterLocked(q, m, "delivery_limit")
+		q.cond.Broadcast()
+		return
+	}
+	m.redelivered = true
+	q.ready = append([]*memMessage{m}, q.ready...)
+	s.expireLocked(q)
+	q.cond.Broadcast()
+}
+
+// messageExpiry works out when a message enqueued at now expires, taking
+// the shorter of the queue's x-message-ttl and the message's own
+// expiration. It returns the zero time for messages that never expire.
+func messageExpiry(q *memQueue, msg amqp.Publishing, now time.Time) time.Time {
+	ttl := time.Duration(-1)
+	if v, ok := normalizeArg(q.args["x-message-ttl"]).(int64); ok {
+		ttl = time.Duration(v) * time.Millisecond
+	}
+	if msg.Expiration != "" {
+		if ms, err := strconv.ParseInt(msg.Expiration, 10, 64); err == nil {
+			if d := time.Duration(ms) * time.Millisecond; ttl < 0 || d < ttl {
+				ttl = d
+			}
+		}
+	}
+	if ttl < 0 {
+		return time.Time{}
+	}
+	return now.Add(ttl)
+}
+
+// expireLocked dead-letters expired messages from the head of the queue and
+// arms a timer for the next one. Like RabbitMQ, only the head is checked, so
+// a message never expires while one ahead of it is still live.
+func (s *MemoryServer) expireLocked(q *memQueue) {
+	now := s.now()
+	for len(q.ready) > 0 {
+		head := q.ready[0]
+		if head.expiresAt.IsZero() || now.Before(head.expiresAt) {
+			break
+		}
+		q.ready = q.ready[1:]
+		s.deadLetterLocked(q, head, "expired")
+	}
+
+	if q.expiry != nil {
+		q.expiry.Stop()
+		q.expiry = nil
+	}
+	if len(q.ready) == 0 || q.ready[0].expiresAt.IsZero() {
+		return
+	}
+	q.expiry = time.AfterFunc(q.ready[0].expiresAt.Sub(now), func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if !q.deleted {
+			s.expireLocked(q)
+		}
+	})
+}
+
+// deadLetterLocked republishes m to the queue's dead letter exchange, if it
+// has one, recording the death in the x-death header the way RabbitMQ does.
+func (s *MemoryServer) deadLetterLocked(q *memQueue, m *memMessage, reason string) {
+	dlx, ok := q.args["x-dead-letter-exchange"].(string)
+	if !ok {
+		return
+	}
+	ex, ok := s.exchanges[dlx]
+	if !ok {
+		return
+	}
+
+	key := m.key
+	if dlrk, ok := q.args["x-dead-letter-routing-key"].(string); ok {
+		key = dlrk
+	}
+
+	msg := m.msg
+	msg.Headers = recordDeath(msg.Headers, q.name, reason, m.exchange, m.key, s.now())
+	msg.Expiration = ""
+	s.routeLocked(ex, key, msg)
+}
+
+func recordDeath(headers amqp.Table, queue, reason, exchange, key string, at time.Time) amqp.Table {
+	out := amqp.Table{}
+	for k, v := range headers {
+		out[k] = v
+	}
+
+	deaths, _ := out["x-death"].([]interface{})
+	updated := make([]interface{}, 0, len(deaths)+1)
+	death := amqp.Table{
+		"count":        int64(1),
+		"reason":       reason,
+		"queue":        queue,
+		"time":         at,
+		"exchange":     exchange,
+		"routing-keys": []interface{}{key},
+	}
+	for _, d := range deaths {
+		t, ok := d.(amqp.Table)
+		if ok && t["queue"] == queue && t["reason"] == reason {
+			count, _ := t["count"].(int64)
+			death["count"] = count + 1
+			continue
+		}
+		updated = append(updated, d)
+	}
+	out["x-death"] = append([]interface{}{death}, updated...)
+
+	if _, ok := out["x-first-death-queue"]; !ok {
+		out["x-first-death-queue"] = queue
+		out["x-first-death-reason"] = reason
+		out["x-first-death-exchange"] = exchange
+	}
+	return out
+}
+
+func bindingMatches(kind, bindingKey, routingKey string) bool {
+	switch kind {
+	case amqp.ExchangeFanout:
+		return true
+	case amqp.ExchangeTopic:
+		return topicMatches(strings.Split(bindingKey, "."), strings.Split(routingKey, "."))
+	default:
+		return bindingKey == routingKey
+	}
+}
+
+// headersMatch reports whether a message's headers match the arguments
+// of a binding to a headers exchange. x-match is "all" by default or "any",
+// and the binding's other x- arguments aren't matched.
+func headersMatch(args, headers amqp.Table) bool {
+	matchAny := args["x-match"] == "any"
+	for k, want := range args {
+		if strings.HasPrefix(k, "x-") {
+			continue
+		}
+		got, ok := headers[k]
+		ok = ok && (want == nil || reflect.DeepEqual(normalizeArg(got), normalizeArg(want)))
+		if matchAny && ok {
+			return true
+		}
+		if !matchAny && !ok {
+			return false
+		}
+	}
+	return !matchAny
+}
+
+func topicMatches(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if topicMatches(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && topicMatches(pattern[1:], words[1:])
+	}
+	return len(words) > 0 && pattern[0] == words[0] && topicMatches(pattern[1:], words[1:])
+}
+
+func (s *MemoryServer) runConsumer(c *memConsumer) {
+	defer close(c.deliveries)
+	q := c.queue
+	for {
+		s.mu.Lock()
+		s.expireLocked(q)
+		for !c.cancelled && !c.canReceive() {
+			q.cond.Wait()
+			s.expireLocked(q)
+		}
+		if c.cancelled {
+			s.mu.Unlock()
+			return
+		}
+
+		m := q.ready[0]
+		q.ready = q.ready[1:]
+		c.ch.tagSeq++
+		tag := c.ch.tagSeq
+		if !c.autoAck {
+			c.ch.unacked[tag] = &memUnacked{msg: m, queue: q, consumer: c}
+			c.unacked++
+		}
+		delivery := m.delivery(c.ch, tag)
+		delivery.ConsumerTag = c.tag
+		s.mu.Unlock()
+
+		select {
+		case c.deliveries <- delivery:
+		case <-c.stop:
+			// The consumer went away before it saw the message, so hand
+			// it back unless closing the channel already did.
+			s.mu.Lock()
+			if u, ok := c.ch.unacked[tag]; ok {
+				delete(c.ch.unacked, tag)
+				s.requeueLocked(u.queue, u.msg)
+			} else if c.autoAck {
+				s.requeueLocked(q, m)
+			}
+			s.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (c *memConsumer) canReceive() bool {
+	if len(c.queue.ready) == 0 {
+		return false
+	}
+	// With a single active consumer the others wait their turn in the
+	// order they subscribed.
+	if sac, _ := c.queue.args["x-single-active-consumer"].(bool); sac && c.queue.consumers[0] != c {
+		return false
+	}
+	return c.prefetch == 0 || c.unacked < c.prefetch
+}
+
+func (m *memMessage) delivery(ch *memoryChannel, tag uint64) amqp.Delivery {
+	p := m.msg
+	return amqp.Delivery{
+		Acknowledger:    ch,
+		Headers:         p.Headers,
+		ContentType:     p.ContentType,
+		ContentEncoding: p.ContentEncoding,
+		DeliveryMode:    p.DeliveryMode,
+		Priority:        p.Priority,
+		CorrelationId:   p.CorrelationId,
+		ReplyTo:         p.ReplyTo,
+		Expiration:      p.Expiration,
+		MessageId:       p.MessageId,
+		Timestamp:       p.Timestamp,
+		Type:            p.Type,
+		UserId:          p.UserId,
+		AppId:           p.AppId,
+		DeliveryTag:     tag,
+		Redelivered:     m.redelivered,
+		Exchange:        m.exchange,
+		RoutingKey:      m.key,
+		Body:            p.Body,
+	}
+}
+
+type memoryConn struct {
+	server   *MemoryServer
+	channels map[*memoryChannel]struct{}
+	closed   bool
+	notify   []chan *amqp.Error
+}
+
+func (c *memoryConn) Channel() (Channel, error) {
+	s := c.server
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if c.closed {
+		return nil, amqp.ErrClosed
+	}
+	ch := &memoryChannel{
+		conn:      c,
+		unacked:   map[uint64]*memUnacked{},
+		consumers: map[string]*memConsumer{},
+	}
+	c.channels[ch] = struct{}{}
+	return ch, nil
+}
+
+func (c *memoryConn) Close() error {
+	s := c.server
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if c.closed {
+		return amqp.ErrClosed
+	}
+	c.shutdownLocked(nil)
+	return nil
+}
+
+func (c *memoryConn) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	s := c.server
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if c.closed {
+		close(receiver)
+	} else {
+		c.notify = append(c.notify, receiver)
+	}
+	return receiver
+}
+
+// shutdownLocked closes the connection and everything it owns. err is nil
+// for a clean close requested by the client.
+func (c *memoryConn) shutdownLocked(err *amqp.Error) {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	delete(c.server.conns, c)
+	for ch := range c.channels {
+		ch.shutdownLocked(err)
+	}
+	for _, q := range c.server.queues {
+		if q.owner == c {
+			c.server.deleteQueueLocked(q)
+		}
+	}
+	notifyClosed(c.notify, err)
+	c.notify = nil
+}
+
+// notifyClosed sends err, if any, to each receiver and then closes it. It
+// does so on its own goroutine so a slow receiver can't stall the server.
+func notifyClosed(receivers []chan *amqp.Error, err *amqp.Error) {
+	if len(receivers) == 0 {
+		return
+	}
+	go func() {
+		for _, r := range receivers {
+			if err != nil {
+				r <- err
+			}
+			close(r)
+		}
+	}()
+}
+
+type memoryChannel struct {
+	conn      *memoryConn
+	prefetch  int
+	tagSeq    uint64
+	unacked   map[uint64]*memUnacked
+	consumers map[string]*memConsumer
+	closed    bool
+	notify    []chan *amqp.Error
+
+	confirming bool
+	publishSeq uint64
+	// notifyMu is held while confirms and returns are sent so they are
+	// never closed underneath a publish.
+	notifyMu sync.Mutex
+	confirms []chan amqp.Confirmation
+	returns  []chan amqp.Return
+}
+
+func (ch *memoryChannel) server() *MemoryServer {
+	return ch.conn.server
+}
+
+// failLocked closes the channel with a channel exception, as the broker does
+// when a method fails.
+func (ch *memoryChannel) failLocked(code int, format string, args ...interface{}) error {
+	err := &amqp.Error{
+		Code:    code,
+		Reason:  fmt.Sprintf(format, args...),
+		Server:  true,
+		Recover: true,
+	}
+	ch.shutdownLocked(err)
+	return err
+}
+
+func (ch *memoryChannel) shutdownLocked(err *amqp.Error) {
+	if ch.closed {
+		return
+	}
+	ch.closed = true
+	delete(ch.conn.channels, ch)
+
+	tags := make([]uint64, 0, len(ch.unacked))
+	for tag := range ch.unacked {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] > tags[j] })
+	for _, tag := range tags {
+		u := ch.unacked[tag]
+		u.settle()
+		ch.server().requeueLocked(u.queue, u.msg)
+	}
+	ch.unacked = map[uint64]*memUnacked{}
+
+	for _, c := range ch.consumers {
+		ch.server().removeConsumerLocked(c)
+	}
+	notifyClosed(ch.notify, err)
+	ch.notify = nil
+	confirms, returns := ch.confirms, ch.returns
+	ch.confirms, ch.returns = nil, nil
+	go func() {
+		ch.notifyMu.Lock()
+		defer ch.notifyMu.Unlock()
+		for _, c := range confirms {
+			close(c)
+		}
+		for _, r := range returns {
+			close(r)
+		}
+	}()
+}
+
+func (ch *memoryChannel) Close() error {
+	s := ch.server()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.shutdownLocked(nil)
+	return nil
+}
+
+func (ch *memoryChannel) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	s := ch.server()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ch.closed {
+		close(receiver)
+	} else {
+		ch.notify = append(ch.notify, receiver)
+	}
+	return receiver
+}
+
+func (ch *memoryChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	s := ch.server()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	switch kind {
+	case amqp.ExchangeDirect, amqp.ExchangeTopic, amqp.ExchangeFanout, amqp.ExchangeHeaders:
+	default:
+		return ch.failLocked(amqp.CommandInvalid, "COMMAND_INVALID - unknown exchange type '%s'", kind)
+	}
+
+	if ex, ok := s.exchanges[name]; ok {
+		if ex.kind != kind || ex.durable != durable || ex.autoDelete != autoDelete {
+			return ch.failLocked(amqp.PreconditionFailed, "PRECONDITION_FAILED - inequivalent arg for exchange '%s'", name)
+		}
+		return nil
+	}
+	if name == "" || strings.HasPrefix(name, "amq.") {
+		return ch.failLocked(amqp.AccessRefused, "ACCESS_REFUSED - exchange name '%s' contains reserved prefix 'amq.*'", name)
+	}
+
+	s.exchanges[name] = &memExchange{
+		name:       name,
+		kind:       kind,
+		durable:    durable,
+		autoDelete: autoDelete,
+	}
+	return nil
+}
+
+func (ch *memoryChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	s := ch.server()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ch.closed {
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+
+	if q, ok := s.queues[name]; ok {
+		if q.exclusive && q.owner != ch.conn {
+			return amqp.Queue{}, ch.failLocked(amqp.ResourceLocked, "RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s'", name)
+		}
+		if q.durable != durable || q.autoDelete != autoDelete || q.exclusive != exclusive {
+			return amqp.Queue{}, ch.failLocked(amqp.PreconditionFailed, "PRECONDITION_FAILED - inequivalent arg for queue '%s'", name)
+		}
+		if arg, ok := inequivalentArg(q.args, args); !ok {
+			return amqp.Queue{}, ch.failLocked(amqp.PreconditionFailed, "PRECONDITION_FAILED - inequivalent arg '%s' for queue '%s'", arg, name)
+		}
+		q.lastUsed = s.now()
+		return amqp.Queue{Name: q.name, Messages: len(q.ready), Consumers: len(q.consumers)}, nil
+	}
+
+	switch args["x-queue-type"] {
+	case nil, "classic":
+	case "quorum", "stream":
+		if !durable || autoDelete || exclusive {
+			return amqp.Queue{}, ch.failLocked(amqp.PreconditionFailed, "PRECONDITION_FAILED - invalid property for %s queue '%s'", args["x-queue-type"], name)
+		}
+	default:
+		return amqp.Queue{}, ch.failLocked(amqp.PreconditionFailed, "PRECONDITION_FAILED - invalid arg 'x-queue-type' for queue '%s'", name)
+	}
+
+	if name == "" {
+		name = s.nextID("amq.gen-")
+	} else if strings.HasPrefix(name, "amq.") {
+		return amqp.Queue{}, ch.failLocked(amqp.AccessRefused, "ACCESS_REFUSED - queue name '%s' contains reserved prefix 'amq.*'", name)
+	}
+
+	q := &memQueue{
+		name:       name,
+		durable:    durable,
+		autoDelete: autoDelete,
+		exclusive:  exclusive,
+		args:       args,
+		cond:       sync.NewCond(&s.mu),
+		lastUsed:   s.now(),
+	}
+	if exclusive {
+		q.owner = ch.conn
+	}
+	s.queues[name] = q
+	return amqp.Queue{Name: name}, nil
+}
+
+// inequivalentArg reports the first x- argument that differs between a and
+// b, mirroring the checks RabbitMQ makes when a queue is redeclared.
+func inequivalentArg(a, b amqp.Table) (string, bool) {
+	keys := map[string]bool{}
+	for k := range a {
+		keys[k] = true
+	}
+	for k := range b {
+		keys[k] = true
+	}
+	for k := range keys {
+		if !strings.HasPrefix(k, "x-") {
+			continue
+		}
+		if !reflect.DeepEqual(normalizeArg(a[k]), normalizeArg(b[k])) {
+			return k, false
+		}
+	}
+	return "", true
+}
+
+func normalizeArg(v interface{}) interface{} {
+	switch n := v.(type) {
+	case int:
+		return int64(n)
+	case int8:
+		return int64(n)
+	case int16:
+		return int64(n)
+	case int32:
+		return int64(n)
+	case uint8:
+		return int64(n)
+	case uint16:
+		return int64(n)
+	case uint32:
+		return int64(n)
+	}
+	return v
+}
+
+func (ch *memoryChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	s := ch.server()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if exchange == "" {
+		return ch.failLocked(amqp.AccessRefused, "ACCESS_REFUSED - operation not permitted on the default exchange")
+	}
+	q, ok := s.queues[name]
+	if !ok {
+		return ch.failLocked(amqp.NotFound, "NOT_FOUND - no queue '%s' in vhost '/'", name)
+	}
+	if q.exclusive && q.owner != ch.conn {
+		return ch.failLocked(amqp.ResourceLocked, "RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s'", name)
+	}
+	ex, ok := s.exchanges[exchange]
+	if !ok {
+		return ch.failLocked(amqp.NotFound, "NOT_FOUND - no exchange '%s' in vhost '/'", exchange)
+	}
+
+	if v, ok := args["x-match"]; ok && ex.kind == amqp.ExchangeHeaders && v != "all" && v != "any" {
+		return ch.failLocked(amqp.PreconditionFailed, "PRECONDITION_FAILED - Invalid x-match field value %v; expected all or any", v)
+	}
+	for _, b := range ex.bindings {
+		if b.queue == q && b.key == key && reflect.DeepEqual(b.args, args) {
+			return nil
+		}
+	}
+	ex.bindings = append(ex.bindings, memBinding{queue: q, key: key, args: args})
+	return nil
+}
+
+func (ch *memoryChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	s := ch.server()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.prefetch = prefetchCount
+	return nil
+}
+
+func (ch *memoryChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	s := ch.server()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ch.closed {
+		return nil, amqp.ErrClosed
+	}
+	q, ok := s.queues[queue]
+	if !ok {
+		return nil, ch.failLocked(amqp.NotFound, "NOT_FOUND - no queue '%s' in vhost '/'", queue)
+	}
+	if q.exclusive && q.owner != ch.conn {
+		return nil, ch.failLocked(amqp.ResourceLocked, "RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s'", queue)
+	}
+	if len(q.consumers) > 0 && (exclusive || q.consumers[0].exclusive) {
+		return nil, ch.failLocked(amqp.AccessRefused, "ACCESS_REFUSED - queue '%s' in vhost '/' in exclusive use", queue)
+	}
+	if consumer == "" {
+		consumer = s.nextID("ctag-")
+	}
+	if _, ok := ch.consumers[consumer]; ok {
+		return nil, ch.failLocked(amqp.NotAllowed, "NOT_ALLOWED - attempt to reuse consumer tag '%s'", consumer)
+	}
+
+	c := &memConsumer{
+		tag:        consumer,
+		ch:         ch,
+		queue:      q,
+		autoAck:    autoAck,
+		exclusive:  exclusive,
+		prefetch:   ch.prefetch,
+		stop:       make(chan struct{}),
+		deliveries: make(chan amqp.Delivery),
+	}
+	ch.consumers[consumer] = c
+	q.consumers = append(q.consumers, c)
+	go s.runConsumer(c)
+	return c.deliveries, nil
+}
+
+func (ch *memoryChannel) Get(queue string, autoAck bool) (amqp.Delivery, bool, error) {
+	s := ch.server()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ch.closed {
+		return amqp.Delivery{}, false, amqp.ErrClosed
+	}
+	q, ok := s.queues[queue]
+	if !ok {
+		return amqp.Delivery{}, false, ch.failLocked(amqp.NotFound, "NOT_FOUND - no queue '%s' in vhost '/'", queue)
+	}
+	if q.exclusive && q.owner != ch.conn {
+		return amqp.Delivery{}, false, ch.failLocked(amqp.ResourceLocked, "RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s'", queue)
+	}
+
+	q.lastUsed = s.now()
+	s.expireLocked(q)
+	if len(q.ready) == 0 {
+		return amqp.Delivery{}, false, nil
+	}
+	m := q.ready[0]
+	q.ready = q.ready[1:]
+	ch.tagSeq++
+	tag := ch.tagSeq
+	if !autoAck {
+		ch.unacked[tag] = &memUnacked{msg: m, queue: q}
+	}
+	delivery := m.delivery(ch, tag)
+	delivery.MessageCount = uint32(len(q.ready))
+	return delivery, true, nil
+}
+
+func (ch *memoryChannel) QueuePurge(name string, noWait bool) (int, error) {
+	s := ch.server()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ch.closed {
+		return 0, amqp.ErrClosed
+	}
+	q, ok := s.queues[name]
+	if !ok {
+		return 0, ch.failLocked(amqp.NotFound, "NOT_FOUND - no queue '%s' in vhost '/'", name)
+	}
+	if q.exclusive && q.owner != ch.conn {
+		return 0, ch.failLocked(amqp.ResourceLocked, "RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s'", name)
+	}
+
+	n := len(q.ready)
+	q.ready = nil
+	s.expireLocked(q)
+	return n, nil
+}
+
+func (ch *memoryChannel) Confirm(noWait bool) error {
+	s := ch.server()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.confirming = true
+	return nil
+}
+
+func (ch *memoryChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	s := ch.server()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ch.closed {
+		close(confirm)
+	} else {
+		ch.confirms = append(ch.confirms, confirm)
+	}
+	return confirm
+}
+
+func (ch *memoryChannel) NotifyReturn(c chan amqp.Return) chan amqp.Return {
+	s := ch.server()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ch.closed {
+		close(c)
+	} else {
+		ch.returns = append(ch.returns, c)
+	}
+	return c
+}
+
+func (ch *memoryChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s := ch.server()
+	s.mu.Lock()
+
+	if ch.closed {
+		s.mu.Unlock()
+		return amqp.ErrClosed
+	}
+	if immediate {
+		err := ch.failLocked(amqp.NotImplemented, "NOT_IMPLEMENTED - immediate=true")
+		s.mu.Unlock()
+		return err
+	}
+	ex, ok := s.exchanges[exchange]
+	if !ok {
+		err := ch.failLocked(amqp.NotFound, "NOT_FOUND - no exchange '%s' in vhost '/'", exchange)
+		s.mu.Unlock()
+		return err
+	}
+
+	msg.Body = append([]byte(nil), msg.Body...)
+	routed := s.routeLocked(ex, key, msg)
+
+	var returns []chan amqp.Return
+	if mandatory && routed == 0 {
+		returns = append(returns, ch.returns...)
+	}
+	var confirms []chan amqp.Confirmation
+	if ch.confirming {
+		ch.publishSeq++
+		confirms = append(confirms, ch.confirms...)
+	}
+	seq := ch.publishSeq
+	ch.notifyMu.Lock()
+	defer ch.notifyMu.Unlock()
+	s.mu.Unlock()
+
+	// Like RabbitMQ, a returned message is reported before it is confirmed.
+	for _, r := range returns {
+		r <- newReturn(exchange, key, msg)
+	}
+	for _, c := range confirms {
+		c <- amqp.Confirmation{DeliveryTag: seq, Ack: true}
+	}
+	return nil
+}
+
+func newReturn(exchange, key string, msg amqp.Publishing) amqp.Return {
+	return amqp.Return{
+		ReplyCode:       amqp.NoRoute,
+		ReplyText:       "NO_ROUTE",
+		Exchange:        exchange,
+		RoutingKey:      key,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		Headers:         msg.Headers,
+		DeliveryMode:    msg.DeliveryMode,
+		Priority:        msg.Priority,
+		CorrelationId:   msg.CorrelationId,
+		ReplyTo:         msg.ReplyTo,
+		Expiration:      msg.Expiration,
+		MessageId:       msg.MessageId,
+		Timestamp:       msg.Timestamp,
+		Type:            msg.Type,
+		UserId:          msg.UserId,
+		AppId:           msg.AppId,
+		Body:            msg.Body,
+	}
+}
+
+func (ch *memoryChannel) Ack(tag uint64, multiple bool) error {
+	s := ch.server()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	settled, err := ch.settleLocked(tag, multiple)
+	if err != nil {
+		return err
+	}
+	for _, u := range settled {
+		u.settle()
+		u.queue.cond.Broadcast()
+	}
+	return nil
+}
+
+func (ch *memoryChannel) Nack(tag uint64, multiple bool, requeue bool) error {
+	s := ch.server()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	settled, err := ch.settleLocked(tag, multiple)
+	if err != nil {
+		return err
+	}
+	// Requeue in reverse so the messages end up back at the head of the
+	// queue in their original order.
+	for i := len(settled) - 1; i >= 0; i-- {
+		u := settled[i]
+		u.settle()
+		if requeue {
+			s.requeueLocked(u.queue, u.msg)
+		} else {
+			s.deadLetterLocked(u.queue, u.msg, "rejected")
+			u.queue.cond.Broadcast()
+		}
+	}
+	return nil
+}
+
+func (ch *memoryChannel) Reject(tag uint64, requeue bool) error {
+	return ch.Nack(tag, false, requeue)
+}
+
+// settleLocked removes and returns the unacked deliveries covered by tag, in
+// delivery order.
+func (ch *memoryChannel) settleLocked(tag uint64, multiple bool) ([]*memUnacked, error) {
+	if ch.closed {
+		return nil, amqp.ErrClosed
+	}
+
+	if !multiple {
+		u, ok := ch.unacked[tag]
+		if !ok {
+			return nil, ch.failLocked(amqp.PreconditionFailed, "PRECONDITION_FAILED - unknown delivery tag %d", tag)
+		}
+		delete(ch.unacked, tag)
+		return []*memUnacked{u}, nil
+	}
+
+	var tags []uint64
+	for t := range ch.unacked {
+		if t <= tag {
+			tags = append(tags, t)
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	settled := make([]*memUnacked, 0, len(tags))
+	for _, t := range tags {
+		settled = append(settled, ch.unacked[t])
+		delete(ch.unacked, t)
+	}
+	return settled, nil
+}
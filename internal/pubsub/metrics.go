@@ -0,0 +1,218 @@
+package pubsub
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/logging"
+)
+
+// Metrics counts what flows through publish and subscribe, labelled by
+// exchange, routing key and, for deliveries, the subscription's queue.
+type Metrics struct {
+	mu         sync.Mutex
+	counters   map[metricKey]uint64
+	histograms map[metricKey]*histogram
+}
+
+// metricKey identifies one series. Fields that don't apply to a metric are
+// left empty and not written out.
+type metricKey struct {
+	name       string
+	exchange   string
+	routingKey string
+	queue      string
+	outcome    string
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// DefaultMetrics is where this package records everything.
+var DefaultMetrics = NewMetrics()
+
+// LatencyBuckets are the upper bounds, in seconds, of the handler latency
+// histogram's buckets.
+var LatencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+const metricsPrefix = "peril_pubsub_"
+
+// Names of the metrics, and what each one counts, in the order they are
+// written.
+var metricHelp = []struct {
+	name, kind, help string
+}{
+	{"published_total", "counter", "Messages published."},
+	{"publish_errors_total", "counter", "Messages that failed to encode or publish."},
+	{"delivered_total", "counter", "Messages delivered to a subscription."},
+	{"decode_failures_total", "counter", "Delivered messages that failed to decode."},
+	{"handled_total", "counter", "Delivered messages settled by the handler, by outcome."},
+	{"handler_duration_seconds", "histogram", "Time spent in the handler."},
+}
+
+// NewMetrics returns an empty set of metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		counters:   map[metricKey]uint64{},
+		histograms: map[metricKey]*histogram{},
+	}
+}
+
+func (m *Metrics) inc(key metricKey) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters[key]++
+}
+
+func (m *Metrics) observe(key metricKey, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h, ok := m.histograms[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(LatencyBuckets))}
+		m.histograms[key] = h
+	}
+	seconds := d.Seconds()
+	for i, bound := range LatencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+func (m *Metrics) published(exchange, key string, err error) {
+	name := "published_total"
+	if err != nil {
+		name = "publish_errors_total"
+	}
+	m.inc(metricKey{name: name, exchange: exchange, routingKey: key})
+}
+
+func (m *Metrics) delivered(exchange, key, queue string) {
+	m.inc(metricKey{name: "delivered_total", exchange: exchange, routingKey: key, queue: queue})
+}
+
+func (m *Metrics) decodeFailed(exchange, key, queue string) {
+	m.inc(metricKey{name: "decode_failures_total", exchange: exchange, routingKey: key, queue: queue})
+}
+
+func (m *Metrics) handled(exchange, key, queue string, ackType AckType, d time.Duration) {
+	m.inc(metricKey{name: "handled_total", exchange: exchange, routingKey: key, queue: queue, outcome: ackType.String()})
+	m.observe(metricKey{name: "handler_duration_seconds", exchange: exchange, routingKey: key, queue: queue}, d)
+}
+
+// Counter returns the current value of one of the counters, for tests and
+// status displays. Labels that don't apply are passed empty.
+func (m *Metrics) Counter(name, exchange, key, queue, outcome string) uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counters[metricKey{name: name, exchange: exchange, routingKey: key, queue: queue, outcome: outcome}]
+}
+
+// WritePrometheus writes the metrics in the Prometheus text format.
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b strings.Builder
+	for _, metric := range metricHelp {
+		fullName := metricsPrefix + metric.name
+		fmt.Fprintf(&b, "# HELP %s %s\n", fullName, metric.help)
+		fmt.Fprintf(&b, "# TYPE %s %s\n", fullName, metric.kind)
+
+		if metric.kind == "counter" {
+			for _, key := range sortedKeys(m.counters, metric.name) {
+				fmt.Fprintf(&b, "%s%s %d\n", fullName, key.labels(""), m.counters[key])
+			}
+			continue
+		}
+
+		for _, key := range sortedKeys(m.histograms, metric.name) {
+			h := m.histograms[key]
+			for i, bound := range LatencyBuckets {
+				le := strconv.FormatFloat(bound, 'g', -1, 64)
+				fmt.Fprintf(&b, "%s_bucket%s %d\n", fullName, key.labels(le), h.counts[i])
+			}
+			fmt.Fprintf(&b, "%s_bucket%s %d\n", fullName, key.labels("+Inf"), h.count)
+			fmt.Fprintf(&b, "%s_sum%s %g\n", fullName, key.labels(""), h.sum)
+			fmt.Fprintf(&b, "%s_count%s %d\n", fullName, key.labels(""), h.count)
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// sortedKeys returns the series of the named metric in a stable order.
+func sortedKeys[V any](series map[metricKey]V, name string) []metricKey {
+	var keys []metricKey
+	for key := range series {
+		if key.name == name {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].labels("") < keys[j].labels("")
+	})
+	return keys
+}
+
+func (k metricKey) labels(le string) string {
+	var labels []string
+	add := func(name, value string) {
+		labels = append(labels, fmt.Sprintf("%s=%q", name, value))
+	}
+	add("exchange", k.exchange)
+	add("routing_key", k.routingKey)
+	if k.queue != "" {
+		add("queue", k.queue)
+	}
+	if k.outcome != "" {
+		add("outcome", k.outcome)
+	}
+	if le != "" {
+		add("le", le)
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+// ServeHTTP serves the metrics in the Prometheus text format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := m.WritePrometheus(w); err != nil {
+		logging.Logger().Error("failed to write metrics", "error", err)
+	}
+}
+
+// ServeMetrics serves DefaultMetrics at /metrics on addr in the background.
+// An addr like "localhost:9090" keeps them off the network.
+func ServeMetrics(addr string) (*http.Server, error) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", DefaultMetrics)
+	server := &http.Server{Addr: addr, Handler: mux}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			logging.Logger().Error("metrics server stopped", "addr", addr, "error", err)
+		}
+	}()
+	return server, nil
+}
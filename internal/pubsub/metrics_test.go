@@ -0,0 +1,106 @@
+package pubsub
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsCountPublishesAndOutcomes(t *testing.T) {
+	_, broker := newTestBroker(t)
+	captureLogs(t)
+	pub := newTestPublisher(t, broker)
+
+	// DefaultMetrics is shared by every test in the package, and by earlier
+	// runs of this one, so it's the change in each series that's checked.
+	series := []struct {
+		name, exchange, key, queue, outcome string
+		want                                uint64
+	}{
+		{"published_total", testTopic, "metrics.ack", "", "", 2},
+		{"published_total", testTopic, "metrics.nack", "", "", 1},
+		{"publish_errors_total", "no_such_exchange", "metrics.ack", "", "", 1},
+		{"delivered_total", testTopic, "metrics.ack", "metrics", "", 2},
+		{"delivered_total", testTopic, "metrics.nack", "metrics", "", 1},
+		{"handled_total", testTopic, "metrics.ack", "metrics", Ack.String(), 2},
+		{"handled_total", testTopic, "metrics.nack", "metrics", NackDiscard.String(), 1},
+	}
+	before := make([]uint64, len(series))
+	for i, s := range series {
+		before[i] = DefaultMetrics.Counter(s.name, s.exchange, s.key, s.queue, s.outcome)
+	}
+	durationsBefore := handlerDurations(t)
+
+	sub, err := SubscribeJSON(context.Background(), broker, testTopic, "metrics", "metrics.*", Durable, func(s string) AckType {
+		if s == "nack" {
+			return NackDiscard
+		}
+		return Ack
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	for _, s := range []string{"ack", "ack", "nack"} {
+		if err := PublishJSON(pub, testTopic, "metrics."+s, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := PublishJSON(pub, "no_such_exchange", "metrics.ack", "lost"); err == nil {
+		t.Fatal("publish to a missing exchange succeeded")
+	}
+
+	// The outcome is counted once the handler returns, after the publish
+	// has been confirmed.
+	changed := func() bool {
+		for i, s := range series {
+			if DefaultMetrics.Counter(s.name, s.exchange, s.key, s.queue, s.outcome)-before[i] < s.want {
+				return false
+			}
+		}
+		return true
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for !changed() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	for i, s := range series {
+		got := DefaultMetrics.Counter(s.name, s.exchange, s.key, s.queue, s.outcome) - before[i]
+		if got != s.want {
+			t.Errorf("%s{%s@%s %s %s} went up by %d, want %d", s.name, s.exchange, s.key, s.queue, s.outcome, got, s.want)
+		}
+	}
+
+	durations := handlerDurations(t)
+	for key, want := range map[string]uint64{"metrics.ack": 2, "metrics.nack": 1} {
+		if got := durations[key] - durationsBefore[key]; got != want {
+			t.Errorf("handler_duration_seconds for %s observed %d handler runs, want %d", key, got, want)
+		}
+	}
+}
+
+var handlerDurationCount = regexp.MustCompile(`(?m)^peril_pubsub_handler_duration_seconds_count\{exchange="test_topic",routing_key="([^"]*)",queue="metrics"\} (\d+)$`)
+
+// handlerDurations reads how many handler runs the latency histogram has
+// observed for each routing key of the metrics queue from what
+// DefaultMetrics serves.
+func handlerDurations(t *testing.T) map[string]uint64 {
+	t.Helper()
+	var b strings.Builder
+	if err := DefaultMetrics.WritePrometheus(&b); err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]uint64{}
+	for _, m := range handlerDurationCount.FindAllStringSubmatch(b.String(), -1) {
+		n, err := strconv.ParseUint(m[2], 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[m[1]] = n
+	}
+	return counts
+}
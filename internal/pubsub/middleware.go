@@ -0,0 +1,188 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/logging"
+)
+
+// HandlerFunc is a subscription handler with its type erased, so that one
+// middleware can wrap handlers of any message type. val is the decoded
+// body, of the type the subscription was made for.
+type HandlerFunc func(ctx context.Context, delivery amqp.Delivery, val any) AckType
+
+// Middleware wraps a handler with extra behaviour.
+type Middleware func(next HandlerFunc) HandlerFunc
+
+var (
+	globalMu          sync.RWMutex
+	globalMiddlewares []Middleware
+)
+
+// Use adds middlewares that wrap every subscription made afterwards. They
+// run outside any given with WithMiddleware.
+func Use(middlewares ...Middleware) {
+	globalMu.Lock()
+	defer globalMu.Unlock()
+	globalMiddlewares = append(globalMiddlewares, middlewares...)
+}
+
+// WithMiddleware wraps the subscription's handler in middlewares. The
+// first one given is the outermost.
+func WithMiddleware(middlewares ...Middleware) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.middlewares = append(o.middlewares, middlewares...)
+	}
+}
+
+// Chain composes middlewares into one, the first being the outermost.
+func Chain(middlewares ...Middleware) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			next = middlewares[i](next)
+		}
+		return next
+	}
+}
+
+// wrapHandler adapts handler to a HandlerFunc and wraps it in the global
+// middlewares followed by the subscription's own.
+func wrapHandler[T any](handler typedHandler[T], middlewares []Middleware) HandlerFunc {
+	globalMu.RLock()
+	all := append(append([]Middleware(nil), globalMiddlewares...), middlewares...)
+	globalMu.RUnlock()
+
+	return Chain(all...)(func(ctx context.Context, delivery amqp.Delivery, val any) AckType {
+		return handler(ctx, delivery, val.(T))
+	})
+}
+
+// Recover turns a panic in the handler into NackDiscard and logs the stack,
+// so one bad message can't take the process down.
+func Recover() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, delivery amqp.Delivery, val any) (ackType AckType) {
+			defer func() {
+				if r := recover(); r != nil {
+					// A panic passed on by Timeout brings the stack of the
+					// goroutine the handler really ran on.
+					p, ok := r.(handlerPanic)
+					if !ok {
+						p = handlerPanic{value: r, stack: debug.Stack()}
+					}
+					logging.Logger().ErrorContext(ctx, "handler panicked", "exchange", delivery.Exchange, "routing_key", delivery.RoutingKey, "panic", p.value, "stack", string(p.stack))
+					ackType = NackDiscard
+				}
+			}()
+			return next(ctx, delivery, val)
+		}
+	}
+}
+
+// Logging logs every handled message with its outcome and duration. A nil
+// logger uses the one set with logging.SetLogger.
+func Logging(l *slog.Logger) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, delivery amqp.Delivery, val any) AckType {
+			l := l
+			if l == nil {
+				l = logging.Logger()
+			}
+			start := time.Now()
+			ackType := next(ctx, delivery, val)
+			l.InfoContext(ctx, "handled message",
+				"exchange", delivery.Exchange,
+				"routing_key", delivery.RoutingKey,
+				"message_id", delivery.MessageId,
+				"redelivered", delivery.Redelivered,
+				"ack", ackType.String(),
+				"duration", time.Since(start),
+			)
+			return ackType
+		}
+	}
+}
+
+// Timing calls observe with how long each message took to handle.
+func Timing(observe func(delivery amqp.Delivery, ackType AckType, elapsed time.Duration)) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, delivery amqp.Delivery, val any) AckType {
+			start := time.Now()
+			ackType := next(ctx, delivery, val)
+			observe(delivery, ackType, time.Since(start))
+			return ackType
+		}
+	}
+}
+
+// Timeout settles a message with onTimeout if its handler hasn't returned
+// within d. Handlers can't be interrupted, so they must watch the context
+// they're given, which is cancelled at the deadline, and give up when it
+// is. A handler that doesn't keeps running after the message is settled;
+// whatever it returns then is ignored and logged, as is a panic, which
+// would otherwise go unrecovered and crash the process.
+func Timeout(d time.Duration, onTimeout AckType) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, delivery amqp.Delivery, val any) AckType {
+			ctx, cancel := context.WithTimeout(ctx, d)
+			defer cancel()
+
+			result := make(chan AckType, 1)
+			panicked := make(chan handlerPanic, 1)
+			go func() {
+				// Hand a panic back to this goroutine, where an outer
+				// Recover can see it, along with the stack it happened on.
+				defer func() {
+					if r := recover(); r != nil {
+						p, ok := r.(handlerPanic)
+						if !ok {
+							p = handlerPanic{value: r, stack: debug.Stack()}
+						}
+						panicked <- p
+					}
+				}()
+				result <- next(ctx, delivery, val)
+			}()
+
+			select {
+			case ackType := <-result:
+				return ackType
+			case p := <-panicked:
+				panic(p)
+			case <-ctx.Done():
+			}
+
+			l := logging.Logger().With("exchange", delivery.Exchange, "routing_key", delivery.RoutingKey, "message_id", delivery.MessageId, "timeout", d)
+			l.WarnContext(ctx, "handler timed out", "ack", onTimeout.String())
+			start := time.Now()
+			go func() {
+				select {
+				case ackType := <-result:
+					l.WarnContext(ctx, "handler finished after timing out", "ignored_ack", ackType.String(), "overran", time.Since(start))
+				case p := <-panicked:
+					l.ErrorContext(ctx, "handler panicked after timing out", "panic", p.value, "stack", string(p.stack))
+				}
+			}()
+			return onTimeout
+		}
+	}
+}
+
+// handlerPanic is a panic recovered from a handler, with where it happened.
+// Timeout panics with one so that Recover, or the crash if there is no
+// Recover, shows the handler's stack rather than Timeout's.
+type handlerPanic struct {
+	value any
+	stack []byte
+}
+
+func (p handlerPanic) String() string {
+	return fmt.Sprintf("%v\n\nhandler goroutine stack:\n%s", p.value, p.stack)
+}
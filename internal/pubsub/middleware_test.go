@@ -0,0 +1,114 @@
+package pubsub
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/logging"
+)
+
+// logBuffer collects what's logged while a test runs.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// waitFor waits for s to be logged.
+func (b *logBuffer) waitFor(t *testing.T, s string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		b.mu.Lock()
+		logged := strings.Contains(b.buf.String(), s)
+		b.mu.Unlock()
+		if logged {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("%q was never logged", s)
+}
+
+func captureLogs(t *testing.T) *logBuffer {
+	t.Helper()
+	b := &logBuffer{}
+	logging.SetLogger(slog.New(slog.NewTextHandler(b, nil)))
+	t.Cleanup(func() { logging.SetLogger(nil) })
+	return b
+}
+
+func TestTimeoutSettlesBeforeTheHandler(t *testing.T) {
+	logs := captureLogs(t)
+
+	finish := make(chan struct{})
+	handler := Timeout(10*time.Millisecond, NackRequeue)(func(ctx context.Context, _ amqp.Delivery, _ any) AckType {
+		<-ctx.Done()
+		<-finish
+		return Ack
+	})
+
+	if got := handler(context.Background(), amqp.Delivery{}, nil); got != NackRequeue {
+		t.Errorf("timed out handler settled with %v, want %v", got, NackRequeue)
+	}
+	logs.waitFor(t, "handler timed out")
+
+	close(finish)
+	logs.waitFor(t, "handler finished after timing out")
+	logs.waitFor(t, "ignored_ack=ack")
+}
+
+func TestTimeoutLogsLatePanics(t *testing.T) {
+	logs := captureLogs(t)
+
+	handler := Timeout(10*time.Millisecond, NackDiscard)(func(ctx context.Context, _ amqp.Delivery, _ any) AckType {
+		<-ctx.Done()
+		panic("too late")
+	})
+
+	if got := handler(context.Background(), amqp.Delivery{}, nil); got != NackDiscard {
+		t.Errorf("timed out handler settled with %v, want %v", got, NackDiscard)
+	}
+	logs.waitFor(t, "handler panicked after timing out")
+	logs.waitFor(t, "panic=\"too late\"")
+}
+
+func TestTimeoutPassesOnPanicsInTime(t *testing.T) {
+	logs := captureLogs(t)
+
+	handler := Recover()(Timeout(time.Second, Ack)(func(context.Context, amqp.Delivery, any) AckType {
+		panic("in time")
+	}))
+
+	if got := handler(context.Background(), amqp.Delivery{}, nil); got != NackDiscard {
+		t.Errorf("panicking handler settled with %v, want %v from Recover", got, NackDiscard)
+	}
+	logs.waitFor(t, "handler panicked")
+}
+
+func panickingHandler(context.Context, amqp.Delivery, any) AckType {
+	panic("in the handler")
+}
+
+func TestTimeoutKeepsTheHandlersStack(t *testing.T) {
+	logs := captureLogs(t)
+
+	handler := Recover()(Timeout(time.Second, Ack)(Timeout(time.Second, Ack)(panickingHandler)))
+	if got := handler(context.Background(), amqp.Delivery{}, nil); got != NackDiscard {
+		t.Errorf("panicking handler settled with %v, want %v from Recover", got, NackDiscard)
+	}
+	logs.waitFor(t, `panic="in the handler"`)
+	logs.waitFor(t, "pubsub.panickingHandler")
+}
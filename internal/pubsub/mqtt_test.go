@@ -0,0 +1,365 @@
+package pubsub
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+
+	"github.com/eclipse/paho.golang/paho"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// newMQTTServer starts an MQTT server in front of a memory server with
+// testTopology applied, with testTopic as the exchange for clients that
+// don't name one. It returns the server's address and an AMQP connection.
+func newMQTTServer(t *testing.T) (addr string, amqpBroker Broker) {
+	t.Helper()
+	server, amqpBroker := newTestBroker(t)
+
+	mqttServer := NewMQTTServer(server.Dial)
+	mqttServer.SetExchange(testTopic)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go mqttServer.Serve(l)
+	t.Cleanup(func() { mqttServer.Close() })
+	return l.Addr().String(), amqpBroker
+}
+
+// newMochiBroker starts an embedded mochi-mqtt broker, a plain MQTT 5
+// broker that knows nothing of exchanges and queues, and returns its
+// address.
+func newMochiBroker(t *testing.T) string {
+	t.Helper()
+	server := mqtt.New(&mqtt.Options{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if err := server.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.AddListener(listeners.NewNet("test", l)); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return l.Addr().String()
+}
+
+// mqttBrokers are what DialMQTT is tested against: MQTTServer in front of a
+// memory server, and a plain MQTT broker. Each starts its broker and
+// returns the address and a func that waits for a message to reach testDLQ.
+var mqttBrokers = []struct {
+	name  string
+	start func(t *testing.T) (addr string, deadLetter func() DeadLetter)
+}{
+	{"MQTTServer", func(t *testing.T) (string, func() DeadLetter) {
+		addr, amqpBroker := newMQTTServer(t)
+		return addr, func() DeadLetter {
+			return waitForDeadLetters(t, amqpBroker, 1)[0]
+		}
+	}},
+	{"mochi", func(t *testing.T) (string, func() DeadLetter) {
+		addr := newMochiBroker(t)
+		ch, _, err := DeclareAndBind(dialMQTT(t, addr), DeadLetterExchange, testDLQ, DeadLetterExchange, Durable, WithoutDeadLetterExchange())
+		if err != nil {
+			t.Fatal(err)
+		}
+		deliveries, err := ch.Consume(testDLQ, "", true, false, false, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return addr, func() DeadLetter {
+			return newDeadLetter(1, receive(t, deliveries))
+		}
+	}},
+}
+
+func dialMQTT(t *testing.T, addr string) Broker {
+	t.Helper()
+	broker, err := DialMQTT("mqtt://guest:guest@" + addr + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { broker.Close() })
+	return broker
+}
+
+func TestMQTTTopic(t *testing.T) {
+	tests := []struct{ key, topic string }{
+		{"army_moves.alice", "army_moves/alice"},
+		{"army_moves.*", "army_moves/+"},
+		{"war.#", "war/#"},
+		{"pause", "pause"},
+	}
+	for _, tt := range tests {
+		if got := MQTTTopic(tt.key); got != tt.topic {
+			t.Errorf("MQTTTopic(%q) = %q, want %q", tt.key, got, tt.topic)
+		}
+		if got := mqttRoutingKey(tt.topic); got != tt.key {
+			t.Errorf("mqttRoutingKey(%q) = %q, want %q", tt.topic, got, tt.key)
+		}
+	}
+}
+
+func TestMQTTPublishSubscribe(t *testing.T) {
+	addr, amqpBroker := newMQTTServer(t)
+	mqttBroker := dialMQTT(t, addr)
+	overMQTT := collect(t, mqttBroker, testTopic, "", "army_moves.*", Transient)
+	overAMQP := collect(t, amqpBroker, testTopic, "", "army_moves.*", Transient)
+	pauses := collect(t, mqttBroker, testDirect, "", "pause", Transient)
+
+	if err := PublishJSON(newTestPublisher(t, mqttBroker), testTopic, "army_moves.alice", "from mqtt"); err != nil {
+		t.Fatal(err)
+	}
+	if v := receive(t, overMQTT); v != "from mqtt" {
+		t.Errorf("MQTT subscriber got %q, want %q", v, "from mqtt")
+	}
+	if v := receive(t, overAMQP); v != "from mqtt" {
+		t.Errorf("AMQP subscriber got %q, want %q", v, "from mqtt")
+	}
+
+	amqpPub := newTestPublisher(t, amqpBroker)
+	if err := PublishJSON(amqpPub, testTopic, "army_moves.bob", "from amqp"); err != nil {
+		t.Fatal(err)
+	}
+	if v := receive(t, overMQTT); v != "from amqp" {
+		t.Errorf("MQTT subscriber got %q, want %q", v, "from amqp")
+	}
+	receive(t, overAMQP)
+
+	// Subscriptions to other exchanges get only their own messages.
+	if err := PublishJSON(amqpPub, testDirect, "pause", "paused"); err != nil {
+		t.Fatal(err)
+	}
+	if v := receive(t, pauses); v != "paused" {
+		t.Errorf("pause subscriber got %q, want %q", v, "paused")
+	}
+	receiveNothing(t, overMQTT)
+}
+
+func TestMQTTPlainBroker(t *testing.T) {
+	addr := newMochiBroker(t)
+	publisher, alice, bob := dialMQTT(t, addr), dialMQTT(t, addr), dialMQTT(t, addr)
+
+	// Subscribers to one queue share its messages, as they do in RabbitMQ.
+	got := make(chan Message[int], 16)
+	for _, broker := range []Broker{alice, bob} {
+		sub, err := SubscribeJSONEnvelope(context.Background(), broker, testTopic, "moves", "army_moves.*", Durable, func(msg Message[int]) AckType {
+			got <- msg
+			return Ack
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sub.Close()
+	}
+	others := collect(t, bob, testTopic, "", "war.*", Transient)
+
+	pub := newTestPublisher(t, publisher)
+	const n = 10
+	for i := 0; i < n; i++ {
+		if err := PublishJSON(pub, testTopic, "army_moves.alice", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seen := map[int]bool{}
+	for i := 0; i < n; i++ {
+		msg := receive(t, got)
+		if msg.Exchange != testTopic || msg.RoutingKey != "army_moves.alice" || msg.ContentType != JSON.ContentType() {
+			t.Errorf("got %s from %s@%s, want %s from %s@army_moves.alice", msg.ContentType, msg.Exchange, msg.RoutingKey, JSON.ContentType(), testTopic)
+		}
+		if seen[msg.Body] {
+			t.Errorf("%d was delivered twice", msg.Body)
+		}
+		seen[msg.Body] = true
+	}
+	receiveNothing(t, got)
+	receiveNothing(t, others)
+}
+
+func TestMQTTNackRequeueRedelivers(t *testing.T) {
+	for _, mb := range mqttBrokers {
+		t.Run(mb.name, func(t *testing.T) {
+			addr, _ := mb.start(t)
+			mqttBroker := dialMQTT(t, addr)
+
+			got := make(chan Message[string], 4)
+			sub, err := SubscribeJSONEnvelope(context.Background(), mqttBroker, testTopic, "requeue", "requeue.*", Durable, func(msg Message[string]) AckType {
+				got <- msg
+				if !msg.Redelivered {
+					return NackRequeue
+				}
+				return Ack
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sub.Close()
+
+			if err := PublishJSON(newTestPublisher(t, mqttBroker), testTopic, "requeue.alice", "again"); err != nil {
+				t.Fatal(err)
+			}
+			for _, redelivered := range []bool{false, true} {
+				msg := receive(t, got)
+				if msg.Body != "again" || msg.Redelivered != redelivered {
+					t.Errorf("got %q redelivered %v, want %q redelivered %v", msg.Body, msg.Redelivered, "again", redelivered)
+				}
+				// It comes back from where it was first published, not
+				// from the queue it was put back in.
+				if msg.Exchange != testTopic || msg.RoutingKey != "requeue.alice" {
+					t.Errorf("delivered from %s@%s, want %s@requeue.alice", msg.Exchange, msg.RoutingKey, testTopic)
+				}
+				if _, ok := msg.Headers[mqttRedeliveredHeader]; ok {
+					t.Errorf("delivered with the %s header", mqttRedeliveredHeader)
+				}
+			}
+			receiveNothing(t, got)
+		})
+	}
+}
+
+func TestMQTTNackDiscardDeadLetters(t *testing.T) {
+	for _, mb := range mqttBrokers {
+		t.Run(mb.name, func(t *testing.T) {
+			addr, deadLetter := mb.start(t)
+			mqttBroker := dialMQTT(t, addr)
+
+			handled := make(chan string, 2)
+			sub, err := SubscribeJSON(context.Background(), mqttBroker, testTopic, "discard", "discard.*", Durable, func(s string) AckType {
+				handled <- s
+				return NackDiscard
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sub.Close()
+
+			if err := PublishJSON(newTestPublisher(t, mqttBroker), testTopic, "discard.alice", "unwanted"); err != nil {
+				t.Fatal(err)
+			}
+			receive(t, handled)
+
+			dl := deadLetter()
+			if dl.Exchange != testTopic || dl.RoutingKey != "discard.alice" || dl.Queue != "discard" || dl.Reason != "rejected" {
+				t.Errorf("dead letter from %s@%s in %s for %q, want %s@discard.alice in discard for %q",
+					dl.Exchange, dl.RoutingKey, dl.Queue, dl.Reason, testTopic, "rejected")
+			}
+			if string(dl.Delivery.Body) != `"unwanted"` {
+				t.Errorf("dead letter is %s, want %q", dl.Delivery.Body, "unwanted")
+			}
+			receiveNothing(t, handled)
+		})
+	}
+}
+
+// A plain MQTT client, which names no exchange, can use MQTTServer too.
+func TestMQTTPlainClient(t *testing.T) {
+	addr, amqpBroker := newMQTTServer(t)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan *paho.Publish, 4)
+	client := paho.NewClient(paho.ClientConfig{
+		Conn: conn,
+		OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+			func(pr paho.PublishReceived) (bool, error) {
+				received <- pr.Packet
+				return true, nil
+			},
+		},
+	})
+	ctx := context.Background()
+	if _, err := client.Connect(ctx, &paho.Connect{ClientID: "plain", CleanStart: true}); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(&paho.Disconnect{})
+
+	suback, err := client.Subscribe(ctx, &paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{{Topic: "army_moves/+", QoS: 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(suback.Reasons) != 1 || suback.Reasons[0] != 1 {
+		t.Fatalf("SUBACK reasons %v, want QoS 1 granted", suback.Reasons)
+	}
+
+	err = PublishJSON(newTestPublisher(t, amqpBroker), testTopic, "army_moves.alice", "move", WithMessageID("move-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := receive(t, received)
+	if p.Topic != "army_moves/alice" || string(p.Payload) != `"move"` || p.QoS != 1 {
+		t.Errorf("got %s on %q at QoS %d, want %q on %q at QoS 1", p.Payload, p.Topic, p.QoS, `"move"`, "army_moves/alice")
+	}
+	if p.Properties.ContentType != JSON.ContentType() {
+		t.Errorf("content type %q, want %q", p.Properties.ContentType, JSON.ContentType())
+	}
+	if got := p.Properties.User.Get("exchange"); got != testTopic {
+		t.Errorf("exchange user property %q, want %q", got, testTopic)
+	}
+	if got := p.Properties.User.Get("amqp-message-id"); got != "move-1" {
+		t.Errorf("amqp-message-id user property %q, want %q", got, "move-1")
+	}
+	// paho acked it, so it isn't sent again.
+	receiveNothing(t, received)
+
+	// A message published without an exchange goes to the server's.
+	got := collect(t, amqpBroker, testTopic, "", "war.*", Transient)
+	resp, err := client.Publish(ctx, &paho.Publish{
+		Topic:      "war/alice",
+		QoS:        1,
+		Payload:    []byte(`"war"`),
+		Properties: &paho.PublishProperties{ContentType: JSON.ContentType()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ReasonCode != mqttSuccess {
+		t.Errorf("PUBACK reason 0x%02X, want success", resp.ReasonCode)
+	}
+	if v := receive(t, got); v != "war" {
+		t.Errorf("got %q, want %q", v, "war")
+	}
+
+	// One that nothing is bound to is answered with "no matching
+	// subscribers".
+	resp, err = client.Publish(ctx, &paho.Publish{Topic: "nobody/alice", QoS: 1, Payload: []byte(`"lost"`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ReasonCode != mqttNoMatchingSubscribers {
+		t.Errorf("PUBACK reason 0x%02X, want 0x%02X", resp.ReasonCode, mqttNoMatchingSubscribers)
+	}
+
+	// A shared subscription consumes the queue it names, with what the
+	// AMQP side declared.
+	ch, _, err := DeclareAndBind(amqpBroker, testTopic, "shared_moves", "army_moves.*", Durable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	if _, err := client.Subscribe(ctx, &paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{{Topic: "$share/shared_moves/army_moves/+", QoS: 1}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.PublishWithContext(ctx, "", "shared_moves", false, false, amqp.Publishing{Body: []byte(`"direct"`)}); err != nil {
+		t.Fatal(err)
+	}
+	if p := receive(t, received); string(p.Payload) != `"direct"` || p.Topic != "shared_moves" {
+		t.Errorf("got %s on %q, want %q on %q", p.Payload, p.Topic, `"direct"`, "shared_moves")
+	}
+}
@@ -0,0 +1,537 @@
+package pubsub
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MQTT 5 control packet types.
+const (
+	mqttConnect     byte = 1
+	mqttConnAck     byte = 2
+	mqttPublish     byte = 3
+	mqttPubAck      byte = 4
+	mqttSubscribe   byte = 8
+	mqttSubAck      byte = 9
+	mqttUnsubscribe byte = 10
+	mqttUnsubAck    byte = 11
+	mqttPingReq     byte = 12
+	mqttPingResp    byte = 13
+	mqttDisconnect  byte = 14
+)
+
+// MQTT 5 reason codes used here. Codes of 0x80 and above are failures.
+const (
+	mqttSuccess               byte = 0x00
+	mqttNoMatchingSubscribers byte = 0x10
+	mqttNoSubscriptionExisted byte = 0x11
+	mqttUnspecifiedError      byte = 0x80
+	mqttProtocolError         byte = 0x82
+	mqttImplementationError   byte = 0x83
+	mqttUnsupportedVersion    byte = 0x84
+	mqttTopicFilterInvalid    byte = 0x8F
+	mqttTopicNameInvalid      byte = 0x90
+)
+
+// mqttMaxRemaining is the largest packet body the variable length
+// encoding can describe.
+const mqttMaxRemaining = 268435455
+
+var errMQTTMalformed = errors.New("pubsub: malformed MQTT packet")
+
+// mqttProperties holds the MQTT 5 properties this package reads or writes.
+// Others are skipped when read.
+type mqttProperties struct {
+	contentType      string
+	correlationData  []byte
+	subscriptionIDs  []uint32
+	receiveMaximum   uint16
+	reasonString     string
+	assignedClientID string
+	user             [][2]string
+}
+
+// Property identifiers.
+const (
+	mqttPropContentType      = 0x03
+	mqttPropCorrelationData  = 0x09
+	mqttPropSubscriptionID   = 0x0B
+	mqttPropAssignedClientID = 0x12
+	mqttPropReasonString     = 0x1F
+	mqttPropReceiveMaximum   = 0x21
+	mqttPropUser             = 0x26
+)
+
+// mqttPropKinds gives the encoding of every MQTT 5 property, so unknown
+// ones can be skipped.
+var mqttPropKinds = map[byte]string{
+	0x01: "byte", 0x02: "uint32", 0x03: "string", 0x08: "string",
+	0x09: "binary", 0x0B: "varint", 0x11: "uint32", 0x12: "string",
+	0x13: "uint16", 0x15: "string", 0x16: "binary", 0x17: "byte",
+	0x18: "uint32", 0x19: "byte", 0x1A: "string", 0x1C: "string",
+	0x1F: "string", 0x21: "uint16", 0x22: "uint16", 0x23: "uint16",
+	0x24: "byte", 0x25: "byte", 0x26: "pair", 0x27: "uint32",
+	0x28: "byte", 0x29: "byte", 0x2A: "byte",
+}
+
+// mqttReader decodes a packet body. The first error sticks, so a decoder
+// can read every field and check err once.
+type mqttReader struct {
+	b   []byte
+	err error
+}
+
+func (r *mqttReader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.b) {
+		r.err = errMQTTMalformed
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *mqttReader) byte() byte {
+	b := r.take(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *mqttReader) uint16() uint16 {
+	b := r.take(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+func (r *mqttReader) uint32() uint32 {
+	b := r.take(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *mqttReader) varint() uint32 {
+	var n uint32
+	for i := 0; i < 4; i++ {
+		b := r.byte()
+		n |= uint32(b&0x7F) << (7 * i)
+		if b&0x80 == 0 {
+			return n
+		}
+	}
+	if r.err == nil {
+		r.err = errMQTTMalformed
+	}
+	return 0
+}
+
+func (r *mqttReader) binary() []byte {
+	return append([]byte(nil), r.take(int(r.uint16()))...)
+}
+
+func (r *mqttReader) string() string {
+	return string(r.take(int(r.uint16())))
+}
+
+func (r *mqttReader) properties() mqttProperties {
+	var p mqttProperties
+	props := &mqttReader{b: r.take(int(r.varint()))}
+	for r.err == nil && len(props.b) > 0 {
+		id := props.byte()
+		switch id {
+		case mqttPropContentType:
+			p.contentType = props.string()
+		case mqttPropCorrelationData:
+			p.correlationData = props.binary()
+		case mqttPropSubscriptionID:
+			p.subscriptionIDs = append(p.subscriptionIDs, props.varint())
+		case mqttPropAssignedClientID:
+			p.assignedClientID = props.string()
+		case mqttPropReasonString:
+			p.reasonString = props.string()
+		case mqttPropReceiveMaximum:
+			p.receiveMaximum = props.uint16()
+		case mqttPropUser:
+			p.user = append(p.user, [2]string{props.string(), props.string()})
+		default:
+			switch mqttPropKinds[id] {
+			case "byte":
+				props.byte()
+			case "uint16":
+				props.uint16()
+			case "uint32":
+				props.uint32()
+			case "varint":
+				props.varint()
+			case "string", "binary":
+				props.binary()
+			default:
+				props.err = errMQTTMalformed
+			}
+		}
+		if props.err != nil {
+			r.err = props.err
+		}
+	}
+	return p
+}
+
+// mqttWriter encodes a packet body.
+type mqttWriter struct {
+	bytes.Buffer
+}
+
+func (w *mqttWriter) uint16(n uint16) {
+	w.Write(binary.BigEndian.AppendUint16(nil, n))
+}
+
+func (w *mqttWriter) varint(n uint32) {
+	for {
+		b := byte(n & 0x7F)
+		n >>= 7
+		if n > 0 {
+			b |= 0x80
+		}
+		w.WriteByte(b)
+		if n == 0 {
+			return
+		}
+	}
+}
+
+func (w *mqttWriter) string(s string) {
+	w.uint16(uint16(len(s)))
+	w.WriteString(s)
+}
+
+func (w *mqttWriter) properties(p mqttProperties) {
+	var props mqttWriter
+	if p.contentType != "" {
+		props.WriteByte(mqttPropContentType)
+		props.string(p.contentType)
+	}
+	if p.correlationData != nil {
+		props.WriteByte(mqttPropCorrelationData)
+		props.uint16(uint16(len(p.correlationData)))
+		props.Write(p.correlationData)
+	}
+	for _, id := range p.subscriptionIDs {
+		props.WriteByte(mqttPropSubscriptionID)
+		props.varint(id)
+	}
+	if p.assignedClientID != "" {
+		props.WriteByte(mqttPropAssignedClientID)
+		props.string(p.assignedClientID)
+	}
+	if p.reasonString != "" {
+		props.WriteByte(mqttPropReasonString)
+		props.string(p.reasonString)
+	}
+	if p.receiveMaximum != 0 {
+		props.WriteByte(mqttPropReceiveMaximum)
+		props.uint16(p.receiveMaximum)
+	}
+	for _, kv := range p.user {
+		props.WriteByte(mqttPropUser)
+		props.string(kv[0])
+		props.string(kv[1])
+	}
+	w.varint(uint32(props.Len()))
+	w.Write(props.Bytes())
+}
+
+// mqttPacket is a control packet's type, flags and undecoded body.
+type mqttPacket struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+func readMQTTPacket(r *bufio.Reader) (mqttPacket, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return mqttPacket{}, err
+	}
+	var n uint32
+	for i := 0; ; i++ {
+		if i == 4 {
+			return mqttPacket{}, errMQTTMalformed
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return mqttPacket{}, err
+		}
+		n |= uint32(b&0x7F) << (7 * i)
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return mqttPacket{}, err
+	}
+	return mqttPacket{kind: first >> 4, flags: first & 0x0F, body: body}, nil
+}
+
+func writeMQTTPacket(w io.Writer, kind, flags byte, body []byte) error {
+	if len(body) > mqttMaxRemaining {
+		return fmt.Errorf("pubsub: MQTT packet of %d bytes is too large", len(body))
+	}
+	var b mqttWriter
+	b.WriteByte(kind<<4 | flags)
+	b.varint(uint32(len(body)))
+	b.Write(body)
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+type mqttConnectPacket struct {
+	clientID   string
+	username   string
+	password   string
+	hasLogin   bool
+	cleanStart bool
+	keepAlive  uint16
+	props      mqttProperties
+}
+
+func (p mqttConnectPacket) encode() []byte {
+	var w mqttWriter
+	w.string("MQTT")
+	w.WriteByte(5)
+	var flags byte
+	if p.cleanStart {
+		flags |= 0x02
+	}
+	if p.hasLogin {
+		flags |= 0xC0
+	}
+	w.WriteByte(flags)
+	w.uint16(p.keepAlive)
+	w.properties(p.props)
+	w.string(p.clientID)
+	if p.hasLogin {
+		w.string(p.username)
+		w.string(p.password)
+	}
+	return w.Bytes()
+}
+
+// parseMQTTConnect decodes a CONNECT packet. A will is read and ignored.
+func parseMQTTConnect(body []byte) (mqttConnectPacket, byte, error) {
+	r := &mqttReader{b: body}
+	var p mqttConnectPacket
+	name := r.string()
+	version := r.byte()
+	if r.err == nil && (name != "MQTT" || version != 5) {
+		return p, mqttUnsupportedVersion, fmt.Errorf("pubsub: unsupported MQTT protocol %s %d", name, version)
+	}
+	flags := r.byte()
+	p.cleanStart = flags&0x02 != 0
+	p.keepAlive = r.uint16()
+	p.props = r.properties()
+	p.clientID = r.string()
+	if flags&0x04 != 0 {
+		r.properties()
+		r.string()
+		r.binary()
+	}
+	if flags&0x80 != 0 {
+		p.hasLogin = true
+		p.username = r.string()
+	}
+	if flags&0x40 != 0 {
+		p.hasLogin = true
+		p.password = string(r.binary())
+	}
+	if r.err != nil {
+		return p, mqttProtocolError, r.err
+	}
+	return p, mqttSuccess, nil
+}
+
+type mqttConnAckPacket struct {
+	sessionPresent bool
+	reason         byte
+	props          mqttProperties
+}
+
+func (p mqttConnAckPacket) encode() []byte {
+	var w mqttWriter
+	if p.sessionPresent {
+		w.WriteByte(1)
+	} else {
+		w.WriteByte(0)
+	}
+	w.WriteByte(p.reason)
+	w.properties(p.props)
+	return w.Bytes()
+}
+
+func parseMQTTConnAck(body []byte) (mqttConnAckPacket, error) {
+	r := &mqttReader{b: body}
+	p := mqttConnAckPacket{sessionPresent: r.byte()&1 == 1, reason: r.byte()}
+	p.props = r.properties()
+	return p, r.err
+}
+
+type mqttPublishPacket struct {
+	topic    string
+	packetID uint16
+	qos      byte
+	dup      bool
+	retain   bool
+	props    mqttProperties
+	payload  []byte
+}
+
+func (p mqttPublishPacket) flags() byte {
+	flags := p.qos << 1
+	if p.dup {
+		flags |= 0x08
+	}
+	if p.retain {
+		flags |= 0x01
+	}
+	return flags
+}
+
+func (p mqttPublishPacket) encode() []byte {
+	var w mqttWriter
+	w.string(p.topic)
+	if p.qos > 0 {
+		w.uint16(p.packetID)
+	}
+	w.properties(p.props)
+	w.Write(p.payload)
+	return w.Bytes()
+}
+
+func parseMQTTPublish(flags byte, body []byte) (mqttPublishPacket, error) {
+	r := &mqttReader{b: body}
+	p := mqttPublishPacket{
+		qos:    flags >> 1 & 0x03,
+		dup:    flags&0x08 != 0,
+		retain: flags&0x01 != 0,
+	}
+	if p.qos > 1 {
+		return p, fmt.Errorf("pubsub: MQTT QoS %d is not supported", p.qos)
+	}
+	p.topic = r.string()
+	if p.qos > 0 {
+		p.packetID = r.uint16()
+	}
+	p.props = r.properties()
+	p.payload = r.b
+	return p, r.err
+}
+
+// mqttAckPacket is a PUBACK, or a DISCONNECT without a packet ID.
+type mqttAckPacket struct {
+	packetID uint16
+	reason   byte
+	props    mqttProperties
+}
+
+func (p mqttAckPacket) encode(withID bool) []byte {
+	var w mqttWriter
+	if withID {
+		w.uint16(p.packetID)
+	}
+	w.WriteByte(p.reason)
+	w.properties(p.props)
+	return w.Bytes()
+}
+
+// parseMQTTAck decodes a PUBACK or DISCONNECT, either of which may stop
+// early when the reason is success and there are no properties.
+func parseMQTTAck(body []byte, withID bool) (mqttAckPacket, error) {
+	r := &mqttReader{b: body}
+	var p mqttAckPacket
+	if withID {
+		p.packetID = r.uint16()
+	}
+	if r.err == nil && len(r.b) > 0 {
+		p.reason = r.byte()
+	}
+	if r.err == nil && len(r.b) > 0 {
+		p.props = r.properties()
+	}
+	return p, r.err
+}
+
+type mqttFilter struct {
+	filter string
+	qos    byte
+}
+
+// mqttSubscribePacket is a SUBSCRIBE, or an UNSUBSCRIBE whose filters have
+// no options.
+type mqttSubscribePacket struct {
+	packetID uint16
+	props    mqttProperties
+	filters  []mqttFilter
+}
+
+func (p mqttSubscribePacket) encode(withOptions bool) []byte {
+	var w mqttWriter
+	w.uint16(p.packetID)
+	w.properties(p.props)
+	for _, f := range p.filters {
+		w.string(f.filter)
+		if withOptions {
+			w.WriteByte(f.qos)
+		}
+	}
+	return w.Bytes()
+}
+
+func parseMQTTSubscribe(body []byte, withOptions bool) (mqttSubscribePacket, error) {
+	r := &mqttReader{b: body}
+	p := mqttSubscribePacket{packetID: r.uint16(), props: r.properties()}
+	for r.err == nil && len(r.b) > 0 {
+		f := mqttFilter{filter: r.string()}
+		if withOptions {
+			f.qos = r.byte() & 0x03
+		}
+		p.filters = append(p.filters, f)
+	}
+	if r.err == nil && len(p.filters) == 0 {
+		r.err = errMQTTMalformed
+	}
+	return p, r.err
+}
+
+// mqttSubAckPacket is a SUBACK or UNSUBACK.
+type mqttSubAckPacket struct {
+	packetID uint16
+	props    mqttProperties
+	reasons  []byte
+}
+
+func (p mqttSubAckPacket) encode() []byte {
+	var w mqttWriter
+	w.uint16(p.packetID)
+	w.properties(p.props)
+	w.Write(p.reasons)
+	return w.Bytes()
+}
+
+func parseMQTTSubAck(body []byte) (mqttSubAckPacket, error) {
+	r := &mqttReader{b: body}
+	p := mqttSubAckPacket{packetID: r.uint16(), props: r.properties()}
+	p.reasons = append([]byte(nil), r.b...)
+	return p, r.err
+}
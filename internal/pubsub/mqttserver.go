@@ -0,0 +1,546 @@
+package pubsub
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/logging"
+)
+
+// MQTTServer is a small MQTT 5 server that carries each connection's
+// packets to a Broker, such as a connection to a MemoryServer. Topics are
+// routing keys as MQTTTopic lays them out, on the exchange named by the
+// "exchange" user property or else the server's exchange, and a QoS 1
+// delivery is acked by the subscriber's PUBACK, as DialMQTT describes. Any
+// MQTT 5 client can use it, such as one that only watches a few topics,
+// and it is enough to try out and test the MQTT transport without a
+// RabbitMQ server. QoS 2, retained messages, wills and session resumption
+// aren't supported, and logins aren't checked.
+type MQTTServer struct {
+	dial func() (Broker, error)
+
+	mu        sync.Mutex
+	closed    bool
+	exchange  string
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+}
+
+// NewMQTTServer returns a server that opens a connection with dial for
+// each MQTT client.
+func NewMQTTServer(dial func() (Broker, error)) *MQTTServer {
+	return &MQTTServer{
+		dial:      dial,
+		exchange:  "amq.topic",
+		listeners: map[net.Listener]struct{}{},
+		conns:     map[net.Conn]struct{}{},
+	}
+}
+
+// SetExchange sets the exchange for the messages and subscriptions of
+// clients that don't name one, which like RabbitMQ's MQTT plugin is
+// amq.topic by default. It applies to connections accepted afterwards.
+func (s *MQTTServer) SetExchange(exchange string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.exchange = exchange
+}
+
+// Serve accepts MQTT connections on l until it fails or the server is
+// closed.
+func (s *MQTTServer) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return net.ErrClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return net.ErrClosed
+		}
+		s.conns[conn] = struct{}{}
+		exchange := s.exchange
+		s.mu.Unlock()
+
+		go func() {
+			defer func() {
+				s.mu.Lock()
+				delete(s.conns, conn)
+				s.mu.Unlock()
+			}()
+			newMQTTSession(conn, exchange).serve(s.dial)
+		}()
+	}
+}
+
+// Close stops listening and drops every connection.
+func (s *MQTTServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return nil
+}
+
+// mqttSession is one client's connection to an MQTTServer. Messages are
+// published on a single confirm mode channel. Each queue the client
+// subscribes to is consumed on a channel of its own, so that unsubscribing
+// requeues what it hasn't acked.
+type mqttSession struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+	// exchange is where messages and subscriptions that don't name an
+	// exchange go.
+	exchange string
+
+	broker     Broker
+	pub        Channel
+	confirms   chan amqp.Confirmation
+	returns    chan amqp.Return
+	receiveMax int
+
+	mu       sync.Mutex
+	packetID uint16
+	outbound map[uint16]amqp.Delivery
+	queues   map[string]*mqttServerQueue
+	filters  map[string]string
+}
+
+// mqttServerQueue is a queue a session consumes, and the filters that
+// subscribed to it.
+type mqttServerQueue struct {
+	ch      Channel
+	filters map[string]bool
+}
+
+func newMQTTSession(conn net.Conn, exchange string) *mqttSession {
+	return &mqttSession{
+		conn:     conn,
+		exchange: exchange,
+		outbound: map[uint16]amqp.Delivery{},
+		queues:   map[string]*mqttServerQueue{},
+		filters:  map[string]string{},
+	}
+}
+
+func (ms *mqttSession) write(kind, flags byte, body []byte) error {
+	ms.writeMu.Lock()
+	defer ms.writeMu.Unlock()
+	return writeMQTTPacket(ms.conn, kind, flags, body)
+}
+
+// disconnect tells the client why the server is hanging up.
+func (ms *mqttSession) disconnect(reason byte, err error) {
+	ms.write(mqttDisconnect, 0, mqttAckPacket{
+		reason: reason,
+		props:  mqttProperties{reasonString: err.Error()},
+	}.encode(false))
+}
+
+func (ms *mqttSession) serve(dial func() (Broker, error)) {
+	defer ms.conn.Close()
+	r := bufio.NewReader(ms.conn)
+
+	p, err := readMQTTPacket(r)
+	if err != nil || p.kind != mqttConnect {
+		return
+	}
+	connect, reason, err := parseMQTTConnect(p.body)
+	if err != nil {
+		ms.write(mqttConnAck, 0, mqttConnAckPacket{
+			reason: reason,
+			props:  mqttProperties{reasonString: err.Error()},
+		}.encode())
+		return
+	}
+	ms.receiveMax = int(connect.props.receiveMaximum)
+
+	ms.broker, err = dial()
+	if err != nil {
+		ms.write(mqttConnAck, 0, mqttConnAckPacket{
+			reason: mqttUnspecifiedError,
+			props:  mqttProperties{reasonString: err.Error()},
+		}.encode())
+		return
+	}
+	defer ms.close()
+	go func() {
+		if err, ok := <-ms.broker.NotifyClose(make(chan *amqp.Error, 1)); ok {
+			ms.disconnect(mqttUnspecifiedError, err)
+			ms.conn.Close()
+		}
+	}()
+
+	connAck := mqttConnAckPacket{}
+	if connect.clientID == "" {
+		connAck.props.assignedClientID = "mqtt-" + newMessageID()
+	}
+	if err := ms.write(mqttConnAck, 0, connAck.encode()); err != nil {
+		return
+	}
+
+	for {
+		p, err := readMQTTPacket(r)
+		if err != nil {
+			return
+		}
+		switch p.kind {
+		case mqttPublish:
+			err = ms.publish(p)
+		case mqttPubAck:
+			err = ms.settle(p)
+		case mqttSubscribe:
+			err = ms.subscribe(p)
+		case mqttUnsubscribe:
+			err = ms.unsubscribe(p)
+		case mqttPingReq:
+			err = ms.write(mqttPingResp, 0, nil)
+		case mqttDisconnect:
+			return
+		default:
+			err = fmt.Errorf("pubsub: unsupported MQTT packet type %d", p.kind)
+		}
+		if err != nil {
+			ms.disconnect(mqttProtocolError, err)
+			return
+		}
+	}
+}
+
+// close cancels the session's subscriptions, which requeues whatever they
+// hadn't acked, and closes its connection to the broker.
+func (ms *mqttSession) close() {
+	ms.mu.Lock()
+	for name, q := range ms.queues {
+		q.ch.Close()
+		delete(ms.queues, name)
+	}
+	ms.mu.Unlock()
+	ms.broker.Close()
+}
+
+// publish publishes a PUBLISH packet's message and, at QoS 1, answers with
+// whether it was routed. A message to the default exchange declares the
+// queue it names if it carries a declaration.
+func (ms *mqttSession) publish(p mqttPacket) error {
+	publish, err := parseMQTTPublish(p.flags, p.body)
+	if err != nil {
+		return err
+	}
+	reason, err := ms.publishMessage(publish)
+	if publish.qos == 0 {
+		return nil
+	}
+	ack := mqttAckPacket{packetID: publish.packetID, reason: reason}
+	if err != nil {
+		ack.props.reasonString = err.Error()
+	}
+	return ms.write(mqttPubAck, 0, ack.encode(true))
+}
+
+func (ms *mqttSession) publishMessage(publish mqttPublishPacket) (byte, error) {
+	if strings.ContainsAny(publish.topic, "+#") {
+		return mqttTopicNameInvalid, fmt.Errorf("topic %q has wildcards in it", publish.topic)
+	}
+	key := mqttRoutingKey(publish.topic)
+	h := mqttHeaders(publish.props.user)
+	exchange, ok := h["exchange"]
+	if !ok {
+		exchange = ms.exchange
+	}
+
+	if ms.pub == nil {
+		ch, err := ms.broker.Channel()
+		if err != nil {
+			return mqttUnspecifiedError, err
+		}
+		if err := ch.Confirm(false); err != nil {
+			ch.Close()
+			return mqttUnspecifiedError, err
+		}
+		ms.pub = ch
+		ms.confirms = ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+		ms.returns = ch.NotifyReturn(make(chan amqp.Return, 1))
+	}
+	// A failed declare or publish closes the channel, so the next PUBLISH
+	// opens another.
+	fail := func(err error) (byte, error) {
+		ms.pub.Close()
+		ms.pub = nil
+		return mqttUnspecifiedError, err
+	}
+
+	if _, declares := h["durable"]; declares && exchange == "" {
+		q := textQueueArgs(h, declaredQueue{durable: true})
+		if _, err := ms.pub.QueueDeclare(key, q.durable, q.autoDelete, q.exclusive, false, q.args); err != nil {
+			return fail(err)
+		}
+	}
+
+	msg := mqttPublishing(publish)
+	err := ms.pub.PublishWithContext(context.Background(), exchange, key, true, false, msg)
+	if err != nil {
+		return fail(err)
+	}
+	var returned bool
+	for {
+		select {
+		case _, ok := <-ms.returns:
+			if !ok {
+				return fail(amqp.ErrClosed)
+			}
+			returned = true
+		case confirm, ok := <-ms.confirms:
+			if !ok {
+				return fail(amqp.ErrClosed)
+			}
+			if !confirm.Ack {
+				return mqttUnspecifiedError, ErrNacked
+			}
+			select {
+			case <-ms.returns:
+				returned = true
+			default:
+			}
+			if returned {
+				return mqttNoMatchingSubscribers, nil
+			}
+			return mqttSuccess, nil
+		}
+	}
+}
+
+// subscribe consumes the queue behind each filter. A shared subscription's
+// queue is named after it and is declared if the SUBSCRIBE carries a
+// declaration. Any other filter gets a queue of its own, and a filter on
+// the default exchange consumes the queue its key names.
+func (ms *mqttSession) subscribe(p mqttPacket) error {
+	subscribe, err := parseMQTTSubscribe(p.body, true)
+	if err != nil {
+		return err
+	}
+	h := mqttHeaders(subscribe.props.user)
+	_, declares := h["durable"]
+	exchange, ok := h["exchange"]
+	if !ok {
+		exchange = ms.exchange
+	}
+
+	suback := mqttSubAckPacket{packetID: subscribe.packetID}
+	var failures []string
+	for _, f := range subscribe.filters {
+		reason, err := ms.subscribeFilter(f, exchange, subscribe.props.subscriptionIDs, h, declares)
+		if err != nil {
+			failures = append(failures, err.Error())
+		}
+		suback.reasons = append(suback.reasons, reason)
+	}
+	suback.props.reasonString = strings.Join(failures, "; ")
+	return ms.write(mqttSubAck, 0, suback.encode())
+}
+
+func (ms *mqttSession) subscribeFilter(f mqttFilter, exchange string, subIDs []uint32, h map[string]string, declares bool) (byte, error) {
+	filter := f.filter
+	queue := ""
+	if strings.HasPrefix(filter, mqttSharePrefix) {
+		var ok bool
+		queue, filter, ok = strings.Cut(strings.TrimPrefix(filter, mqttSharePrefix), "/")
+		if !ok || queue == "" || strings.ContainsAny(queue, "+#") {
+			return mqttTopicFilterInvalid, fmt.Errorf("invalid shared subscription %q", f.filter)
+		}
+	}
+	if filter == "" {
+		return mqttTopicFilterInvalid, fmt.Errorf("empty filter %q", f.filter)
+	}
+	key := mqttRoutingKey(filter)
+
+	ms.mu.Lock()
+	_, exists := ms.filters[f.filter]
+	ms.mu.Unlock()
+	if exists {
+		return mqttUnspecifiedError, fmt.Errorf("already subscribed to %q", f.filter)
+	}
+
+	ch, err := ms.broker.Channel()
+	if err != nil {
+		return mqttUnspecifiedError, err
+	}
+	fail := func(err error) (byte, error) {
+		ch.Close()
+		return mqttUnspecifiedError, err
+	}
+
+	switch {
+	case queue == "" && exchange == "":
+		queue = key
+	case queue == "":
+		queue = "mqtt-subscription-" + newMessageID()
+		declares = true
+		h = map[string]string{"durable": "false", "auto-delete": "true", "exclusive": "true"}
+	}
+	if declares {
+		q := textQueueArgs(h, declaredQueue{durable: true})
+		if _, err := ch.QueueDeclare(queue, q.durable, q.autoDelete, q.exclusive, false, q.args); err != nil {
+			return fail(err)
+		}
+	}
+	if exchange != "" {
+		if err := ch.QueueBind(queue, key, exchange, false, nil); err != nil {
+			return fail(err)
+		}
+	}
+
+	ms.mu.Lock()
+	if q, ok := ms.queues[queue]; ok {
+		// Already consuming the queue: the binding is all that was needed.
+		q.filters[f.filter] = true
+		ms.filters[f.filter] = queue
+		ms.mu.Unlock()
+		ch.Close()
+		return min(f.qos, 1), nil
+	}
+	ms.mu.Unlock()
+
+	prefetch := ms.receiveMax
+	if n, err := strconv.Atoi(h["prefetch-count"]); err == nil {
+		prefetch = n
+	}
+	if prefetch > 0 {
+		if err := ch.Qos(prefetch, 0, false); err != nil {
+			return fail(err)
+		}
+	}
+	qos := min(f.qos, 1)
+	deliveries, err := ch.Consume(queue, "", qos == 0, false, false, false, nil)
+	if err != nil {
+		return fail(err)
+	}
+
+	ms.mu.Lock()
+	ms.queues[queue] = &mqttServerQueue{ch: ch, filters: map[string]bool{f.filter: true}}
+	ms.filters[f.filter] = queue
+	ms.mu.Unlock()
+
+	go ms.forward(deliveries, qos, subIDs)
+	return qos, nil
+}
+
+// forward sends a queue's deliveries to the client.
+func (ms *mqttSession) forward(deliveries <-chan amqp.Delivery, qos byte, subIDs []uint32) {
+	for delivery := range deliveries {
+		props, h := mqttMessage(republishing(delivery, delivery.Headers))
+		h["exchange"] = delivery.Exchange
+		props.user = mqttUserProperties(h)
+		props.subscriptionIDs = subIDs
+		publish := mqttPublishPacket{
+			topic:   MQTTTopic(delivery.RoutingKey),
+			qos:     qos,
+			dup:     delivery.Redelivered && qos > 0,
+			props:   props,
+			payload: delivery.Body,
+		}
+
+		if qos > 0 {
+			ms.mu.Lock()
+			for {
+				ms.packetID++
+				if _, busy := ms.outbound[ms.packetID]; ms.packetID != 0 && !busy {
+					break
+				}
+			}
+			publish.packetID = ms.packetID
+			ms.outbound[publish.packetID] = delivery
+			ms.mu.Unlock()
+		}
+
+		if err := ms.write(mqttPublish, publish.flags(), publish.encode()); err != nil {
+			return
+		}
+	}
+}
+
+// settle acks the delivery a PUBACK answers. Whatever its reason code, a
+// PUBACK only ever means the subscriber is done with the message.
+func (ms *mqttSession) settle(p mqttPacket) error {
+	ack, err := parseMQTTAck(p.body, true)
+	if err != nil {
+		return err
+	}
+	ms.mu.Lock()
+	delivery, ok := ms.outbound[ack.packetID]
+	delete(ms.outbound, ack.packetID)
+	ms.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	if err := delivery.Ack(false); err != nil {
+		logging.Logger().Warn("failed to settle MQTT delivery", "routing_key", delivery.RoutingKey, "error", err)
+	}
+	return nil
+}
+
+// unsubscribe stops consuming a queue once none of the filters that
+// subscribed to it are left. Bindings stay, as they would on the queue in
+// RabbitMQ.
+func (ms *mqttSession) unsubscribe(p mqttPacket) error {
+	unsubscribe, err := parseMQTTSubscribe(p.body, false)
+	if err != nil {
+		return err
+	}
+
+	unsuback := mqttSubAckPacket{packetID: unsubscribe.packetID}
+	var closing []Channel
+	ms.mu.Lock()
+	for _, f := range unsubscribe.filters {
+		name, ok := ms.filters[f.filter]
+		if !ok {
+			unsuback.reasons = append(unsuback.reasons, mqttNoSubscriptionExisted)
+			continue
+		}
+		delete(ms.filters, f.filter)
+		q := ms.queues[name]
+		delete(q.filters, f.filter)
+		if len(q.filters) == 0 {
+			delete(ms.queues, name)
+			closing = append(closing, q.ch)
+		}
+		unsuback.reasons = append(unsuback.reasons, mqttSuccess)
+	}
+	ms.mu.Unlock()
+
+	for _, ch := range closing {
+		ch.Close()
+	}
+	return ms.write(mqttUnsubAck, 0, unsuback.encode())
+}
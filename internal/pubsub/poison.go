@@ -0,0 +1,134 @@
+package pubsub
+
+import (
+	"context"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/logging"
+)
+
+// DeadLetterExchange is where queues declared by DeclareAndBind send the
+// messages they reject.
+const DeadLetterExchange = "peril_dlx"
+
+// Headers added to the messages this package dead-letters itself, poison
+// messages and those that ran out of retries.
+const (
+	HeaderPoisonError        = "x-poison-error"
+	HeaderPoisonCodec        = "x-poison-codec"
+	HeaderOriginalExchange   = "x-original-exchange"
+	HeaderOriginalRoutingKey = "x-original-routing-key"
+	HeaderOriginalQueue      = "x-original-queue"
+	// HeaderDeadLetterReason is set on the messages this package sends to
+	// DeadLetterExchange itself, rather than leaving to the broker.
+	HeaderDeadLetterReason = "x-dead-letter-reason"
+)
+
+// PoisonPolicy decides what happens to a delivery whose body can't be
+// decoded. Requeueing is deliberately not an option: the body will never
+// decode, so it would just come straight back.
+type PoisonPolicy int
+
+const (
+	// PoisonDeadLetter republishes the message to DeadLetterExchange with
+	// headers recording the decode error, the codec and where it came
+	// from, then acks the original once the broker confirms the copy.
+	PoisonDeadLetter PoisonPolicy = iota
+	// PoisonReject nacks the message without requeueing, leaving it to the
+	// queue's own dead letter exchange.
+	PoisonReject
+	// PoisonDiscard acks the message and drops it.
+	PoisonDiscard
+)
+
+// SubscribeOption configures a subscription.
+type SubscribeOption func(*subscribeOptions)
+
+type subscribeOptions struct {
+	poisonPolicy PoisonPolicy
+	retryPolicy  RetryPolicy
+	codecs       *CodecRegistry
+	prefetch     int
+	concurrency  int
+	key          KeyFunc
+	middlewares  []Middleware
+	queueOptions []QueueOption
+	// closers release whatever the helper wrapping subscribe set up for
+	// the subscription.
+	closers []func()
+}
+
+// WithPoisonPolicy sets how deliveries that fail to decode are handled. The
+// default is PoisonDeadLetter.
+func WithPoisonPolicy(policy PoisonPolicy) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.poisonPolicy = policy
+	}
+}
+
+// handlePoison settles a delivery that failed to decode so it doesn't sit
+// unacked and hold a prefetch slot forever.
+func handlePoison(broker Broker, policy PoisonPolicy, queueName, codec string, delivery amqp.Delivery, decodeErr error) {
+	l := logging.Logger().With(
+		"exchange", delivery.Exchange,
+		"routing_key", delivery.RoutingKey,
+		"queue", queueName,
+		"codec", codec,
+		"decode_error", decodeErr,
+	)
+	var err error
+	switch policy {
+	case PoisonDiscard:
+		err = delivery.Ack(false)
+		l.Warn("discarded poison message")
+	case PoisonReject:
+		err = delivery.Nack(false, false)
+		l.Warn("rejected poison message")
+	default:
+		err = deadLetterPoison(broker, queueName, codec, delivery, decodeErr)
+		if err != nil {
+			l.Error("failed to dead-letter poison message, rejecting it instead", "error", err)
+			err = delivery.Nack(false, false)
+			break
+		}
+		err = delivery.Ack(false)
+		l.Warn("dead-lettered poison message")
+	}
+
+	if err != nil {
+		l.Error("failed to settle poison message", "error", err)
+	}
+}
+
+// deadLetterPoison publishes on a channel of its own, so that a missing
+// dead letter exchange can't take the consuming channel down with it. The
+// channel is in confirm mode, so by the time it returns nil the broker has
+// the copy and the original can safely be acked.
+func deadLetterPoison(broker Broker, queueName, codec string, delivery amqp.Delivery, decodeErr error) error {
+	pub, err := NewConfirmPublisher(broker)
+	if err != nil {
+		return err
+	}
+	defer pub.Close()
+
+	headers := amqp.Table{}
+	for k, v := range delivery.Headers {
+		headers[k] = v
+	}
+	headers[HeaderDeadLetterReason] = ReasonPoison
+	headers[HeaderPoisonError] = decodeErr.Error()
+	headers[HeaderPoisonCodec] = codec
+	headers[HeaderOriginalExchange] = delivery.Exchange
+	headers[HeaderOriginalRoutingKey] = delivery.RoutingKey
+	headers[HeaderOriginalQueue] = queueName
+
+	return pub.PublishWithContext(
+		context.Background(),
+		DeadLetterExchange,
+		delivery.RoutingKey,
+		false,
+		false,
+		republishing(delivery, headers),
+	)
+}
@@ -0,0 +1,63 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// waitForDeadLetters polls testDLQ until it holds n messages.
+func waitForDeadLetters(t *testing.T, broker Broker, n int) []DeadLetter {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		dead, err := InspectDeadLetters(broker, testDLQ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(dead) >= n || time.Now().After(deadline) {
+			if len(dead) != n {
+				t.Fatalf("got %d dead letters, want %d", len(dead), n)
+			}
+			return dead
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPoisonMessageIsDeadLettered(t *testing.T) {
+	_, broker := newTestBroker(t)
+	pub := newTestPublisher(t, broker)
+
+	handled := make(chan string, 1)
+	sub, err := SubscribeJSON(context.Background(), broker, testTopic, "poison", "poison.*", Durable, func(s string) AckType {
+		handled <- s
+		return Ack
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	err = pub.PublishWithContext(context.Background(), testTopic, "poison.alice", false, false, amqp.Publishing{
+		ContentType: "application/json",
+		Body:        []byte("{not json"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dl := waitForDeadLetters(t, broker, 1)[0]
+	if dl.Reason != ReasonPoison || dl.Error == "" {
+		t.Errorf("dead-lettered for %q (%q), want %q with the decode error", dl.Reason, dl.Error, ReasonPoison)
+	}
+	if dl.Exchange != testTopic || dl.RoutingKey != "poison.alice" || dl.Queue != "poison" {
+		t.Errorf("dead letter from %s@%s in %s, want %s@poison.alice in poison", dl.Exchange, dl.RoutingKey, dl.Queue, testTopic)
+	}
+	if n := sub.PoisonCount(); n != 1 {
+		t.Errorf("PoisonCount() = %d, want 1", n)
+	}
+	receiveNothing(t, handled)
+}
@@ -0,0 +1,136 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// ErrPoolClosed is returned by a PublisherPool after Close.
+var ErrPoolClosed = errors.New("pubsub: publisher pool closed")
+
+// PublisherPool publishes on a pool of channels, so that goroutines
+// publishing at the same time don't share a channel or wait on each other.
+// It is safe to use from any goroutine.
+type PublisherPool struct {
+	broker Broker
+	slots  chan struct{}
+
+	mu     sync.Mutex
+	idle   []pooledChannel
+	closed bool
+}
+
+type pooledChannel struct {
+	ch     Channel
+	closed chan *amqp.Error
+}
+
+// NewPublisherPool returns a pool that opens up to size channels on broker
+// as they are needed. Channels that close are replaced on the next
+// publish, so a Manager can be passed in to survive reconnects.
+func NewPublisherPool(broker Broker, size int) *PublisherPool {
+	if size < 1 {
+		size = 1
+	}
+	return &PublisherPool{
+		broker: broker,
+		slots:  make(chan struct{}, size),
+	}
+}
+
+func (p *PublisherPool) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-p.slots }()
+
+	pc, reused, err := p.get()
+	if err != nil {
+		return err
+	}
+
+	err = pc.ch.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+	if reused && errors.Is(err, amqp.ErrClosed) {
+		// The idle channel closed before the pool heard about it, so
+		// nothing was sent. Try again on a fresh one.
+		pc.ch.Close()
+		if pc, err = p.open(); err != nil {
+			return err
+		}
+		err = pc.ch.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+	}
+	if err != nil {
+		// The channel may be unusable now, so don't hand it out again.
+		pc.ch.Close()
+		return err
+	}
+	p.put(pc)
+	return nil
+}
+
+// get takes an open channel from the pool, reporting true, or opens a new
+// one.
+func (p *PublisherPool) get() (pooledChannel, bool, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return pooledChannel{}, false, ErrPoolClosed
+	}
+	for len(p.idle) > 0 {
+		pc := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		select {
+		case <-pc.closed:
+			continue
+		default:
+			p.mu.Unlock()
+			return pc, true, nil
+		}
+	}
+	p.mu.Unlock()
+
+	pc, err := p.open()
+	return pc, false, err
+}
+
+// open opens a new channel for the pool.
+func (p *PublisherPool) open() (pooledChannel, error) {
+	ch, err := p.broker.Channel()
+	if err != nil {
+		return pooledChannel{}, err
+	}
+	return pooledChannel{
+		ch:     ch,
+		closed: ch.NotifyClose(make(chan *amqp.Error, 1)),
+	}, nil
+}
+
+func (p *PublisherPool) put(pc pooledChannel) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		pc.ch.Close()
+		return
+	}
+	p.idle = append(p.idle, pc)
+}
+
+// Close closes the idle channels. Channels in use are closed as their
+// publishes finish.
+func (p *PublisherPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	for _, pc := range p.idle {
+		pc.ch.Close()
+	}
+	p.idle = nil
+	return nil
+}
@@ -0,0 +1,163 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// channelCounter is a Broker that keeps track of the channels opened on
+// it.
+type channelCounter struct {
+	Broker
+
+	mu       sync.Mutex
+	channels []Channel
+	open     int
+	maxOpen  int
+}
+
+type countedChannel struct {
+	Channel
+	counter *channelCounter
+	once    sync.Once
+}
+
+func (c *channelCounter) Channel() (Channel, error) {
+	ch, err := c.Broker.Channel()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.channels = append(c.channels, ch)
+	c.open++
+	c.maxOpen = max(c.maxOpen, c.open)
+	return &countedChannel{Channel: ch, counter: c}, nil
+}
+
+func (ch *countedChannel) Close() error {
+	ch.once.Do(func() {
+		ch.counter.mu.Lock()
+		ch.counter.open--
+		ch.counter.mu.Unlock()
+	})
+	return ch.Channel.Close()
+}
+
+func (c *channelCounter) counts() (opened, open, maxOpen int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.channels), c.open, c.maxOpen
+}
+
+func TestPublisherPoolConcurrentPublishing(t *testing.T) {
+	_, broker := newTestBroker(t)
+	counter := &channelCounter{Broker: broker}
+	pool := NewPublisherPool(counter, 2)
+	defer pool.Close()
+
+	const publishers, each = 20, 50
+	var handled atomic.Int64
+	done := make(chan struct{})
+	sub, err := SubscribeJSON(context.Background(), broker, testTopic, "", "pool.*", Transient, func(int) AckType {
+		if handled.Add(1) == publishers*each {
+			close(done)
+		}
+		return Ack
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, publishers)
+	for i := 0; i < publishers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < each; j++ {
+				if err := PublishJSON(pool, testTopic, "pool.alice", j); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	receive(t, done)
+
+	if opened, _, maxOpen := counter.counts(); opened > 2 || maxOpen > 2 {
+		t.Errorf("opened %d channels, %d at once, want at most 2", opened, maxOpen)
+	}
+}
+
+func TestPublisherPoolReplacesClosedChannels(t *testing.T) {
+	_, broker := newTestBroker(t)
+	captureLogs(t)
+	counter := &channelCounter{Broker: broker}
+	pool := NewPublisherPool(counter, 1)
+	defer pool.Close()
+	got := collect(t, broker, testTopic, "", "pool.*", Transient)
+
+	if err := PublishJSON(pool, testTopic, "pool.alice", "first"); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, got)
+
+	// A publish that fails closes the channel under it.
+	if err := PublishJSON(pool, "no_such_exchange", "pool.alice", "lost"); err == nil {
+		t.Fatal("publish to a missing exchange succeeded")
+	}
+	if err := PublishJSON(pool, testTopic, "pool.alice", "after an error"); err != nil {
+		t.Fatal(err)
+	}
+	if v := receive(t, got); v != "after an error" {
+		t.Errorf("got %q, want %q", v, "after an error")
+	}
+
+	// So does the broker, without the pool seeing it happen.
+	counter.mu.Lock()
+	idle := counter.channels[len(counter.channels)-1]
+	counter.mu.Unlock()
+	idle.Close()
+	if err := PublishJSON(pool, testTopic, "pool.alice", "after a close"); err != nil {
+		t.Fatal(err)
+	}
+	if v := receive(t, got); v != "after a close" {
+		t.Errorf("got %q, want %q", v, "after a close")
+	}
+
+	if opened, _, _ := counter.counts(); opened != 3 {
+		t.Errorf("opened %d channels, want 3", opened)
+	}
+}
+
+func TestPublisherPoolClose(t *testing.T) {
+	_, broker := newTestBroker(t)
+	counter := &channelCounter{Broker: broker}
+	pool := NewPublisherPool(counter, 2)
+
+	if err := PublishJSON(pool, testTopic, "pool.alice", "before"); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, open, _ := counter.counts(); open != 0 {
+		t.Errorf("%d channel(s) left open after Close", open)
+	}
+	err := pool.PublishWithContext(context.Background(), testTopic, "pool.alice", false, false, amqp.Publishing{})
+	if !errors.Is(err, ErrPoolClosed) {
+		t.Errorf("publish after Close = %v, want %v", err, ErrPoolClosed)
+	}
+}
@@ -1,14 +1,13 @@
 package pubsub
 
 import (
-	"bytes"
 	"context"
-	"encoding/gob"
-	"encoding/json"
 	"fmt"
-	"log"
+	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/logging"
 )
 
 type SimpleQueueType int
@@ -17,241 +16,540 @@ type AckType int
 const (
 	Durable SimpleQueueType = iota
 	Transient
+	// Quorum is a durable queue replicated across the nodes of a cluster.
+	Quorum
+	// Stream is a replicated, append-only log. Consumers read it without
+	// removing anything, so it can't dead-letter or cap its length in
+	// messages.
+	Stream
 )
 
+func (t SimpleQueueType) String() string {
+	switch t {
+	case Durable:
+		return "durable"
+	case Transient:
+		return "transient"
+	case Quorum:
+		return "quorum"
+	case Stream:
+		return "stream"
+	default:
+		return fmt.Sprintf("SimpleQueueType(%d)", int(t))
+	}
+}
+
+// queueType is the x-queue-type RabbitMQ gives a queue of type t.
+func (t SimpleQueueType) queueType() string {
+	switch t {
+	case Quorum, Stream:
+		return t.String()
+	default:
+		return "classic"
+	}
+}
+
 const (
 	Ack AckType = iota
 	NackRequeue
 	NackDiscard
+	// RetryLater acks the delivery and redelivers it to the same queue
+	// after a backoff set by the subscription's RetryPolicy.
+	RetryLater
 )
 
+func (a AckType) String() string {
+	switch a {
+	case Ack:
+		return "ack"
+	case NackRequeue:
+		return "nack-requeue"
+	case NackDiscard:
+		return "nack-discard"
+	case RetryLater:
+		return "retry-later"
+	default:
+		return fmt.Sprintf("AckType(%d)", int(a))
+	}
+}
+
+// PublishOption configures a single publish.
+type PublishOption func(*publishOptions)
+
+type publishOptions struct {
+	mandatory bool
+	codec     Codec
+	messageID string
+	ctx       context.Context
+	// via is a queue the message is published to on its way to exchange,
+	// such as the one a scheduled message waits in.
+	via string
+	// correlationID, replyTo and expiration are set on requests.
+	correlationID string
+	replyTo       string
+	expiration    string
+}
+
+// Mandatory asks the broker to return the message if no queue is bound to
+// receive it. Publishing through a ConfirmPublisher turns the return into
+// an *UnroutableError; other publishers drop it.
+func Mandatory() PublishOption {
+	return func(o *publishOptions) {
+		o.mandatory = true
+	}
+}
+
+// WithCodec sets the codec Publish encodes with. The default is JSON.
+func WithCodec(codec Codec) PublishOption {
+	return func(o *publishOptions) {
+		o.codec = codec
+	}
+}
+
+// WithMessageID sets the message ID instead of generating one.
+func WithMessageID(id string) PublishOption {
+	return func(o *publishOptions) {
+		o.messageID = id
+	}
+}
+
+// WithContext publishes in ctx. The message joins the trace of the span
+// ctx carries, such as a handler's, instead of starting a new one.
+func WithContext(ctx context.Context) PublishOption {
+	return func(o *publishOptions) {
+		o.ctx = ctx
+	}
+}
+
 func publish[T any](
-	ch *amqp.Channel,
+	pub Publisher,
 	exchange,
 	key string,
 	val T,
-	marshaller func(T) ([]byte, error),
+	opts []PublishOption,
 ) error {
-	bytes, err := marshaller(val)
+	options := publishOptions{
+		codec: JSON,
+		ctx:   context.Background(),
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.messageID == "" {
+		options.messageID = newMessageID()
+	}
+
+	parent, _ := SpanFromContext(options.ctx)
+	span := startSpan(parent, SpanPublish, fmt.Sprintf("publish %s", key))
+	span.span.Exchange = exchange
+	span.span.RoutingKey = key
+	span.span.MessageID = options.messageID
+
+	bytes, err := options.codec.Marshal(val)
 	if err != nil {
-		log.Println("Failed to marshal data:", err)
+		logging.Logger().Error("failed to marshal message", "exchange", exchange, "routing_key", key, "content_type", options.codec.ContentType(), "error", err)
+		DefaultMetrics.published(exchange, key, err)
+		span.end("", err)
 		return err
 	}
-	err = ch.PublishWithContext(
-		context.Background(),
-		exchange,
-		key,
-		false,
+	sendExchange, sendKey := exchange, key
+	if options.via != "" {
+		sendExchange, sendKey = "", options.via
+	}
+	err = pub.PublishWithContext(
+		options.ctx,
+		sendExchange,
+		sendKey,
+		options.mandatory,
 		false,
 		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        bytes,
+			Headers: amqp.Table{
+				HeaderTraceParent: span.sc.String(),
+			},
+			ContentType:   options.codec.ContentType(),
+			CorrelationId: options.correlationID,
+			ReplyTo:       options.replyTo,
+			Expiration:    options.expiration,
+			MessageId:     options.messageID,
+			Timestamp:     time.Now(),
+			AppId:         AppID,
+			Body:          bytes,
 		},
 	)
+	DefaultMetrics.published(exchange, key, err)
+	span.end("", err)
 	if err != nil {
-		log.Printf("Failed to publish message to %s@%s: %v\n", exchange, key, err)
+		logging.Logger().Error("failed to publish message", "exchange", exchange, "routing_key", key, "error", err)
 		return err
 	}
 
 	return nil
 }
 
+// typedHandler is what subscribe calls with each decoded delivery.
+type typedHandler[T any] func(ctx context.Context, delivery amqp.Delivery, val T) AckType
+
+func plainHandler[T any](handler func(T) AckType) typedHandler[T] {
+	return func(_ context.Context, _ amqp.Delivery, val T) AckType {
+		return handler(val)
+	}
+}
+
+// codecFunc picks the codec for a delivery's content type.
+type codecFunc func(options subscribeOptions, contentType string) (Codec, error)
+
+func negotiatedCodec(options subscribeOptions, contentType string) (Codec, error) {
+	if contentType == "" {
+		return JSON, nil
+	}
+	return options.codecs.Lookup(contentType)
+}
+
+// fixedCodec ignores the content type. Messages published before the
+// content type was set correctly all claim to be JSON.
+func fixedCodec(codec Codec) codecFunc {
+	return func(subscribeOptions, string) (Codec, error) {
+		return codec, nil
+	}
+}
+
 func subscribe[T any](
-	conn *amqp.Connection,
+	ctx context.Context,
+	broker Broker,
 	exchange,
 	queueName,
 	key string,
 	simpleQueueType SimpleQueueType,
-	handler func(T) AckType,
-	unmarshaller func([]byte) (T, error),
-) error {
-	ch, queue, err := DeclareAndBind(
-		conn,
-		exchange,
-		queueName,
-		key,
-		simpleQueueType,
-	)
-	if err != nil {
-		log.Printf(
-			"Failed to declare and bind to %s@%s: %v\n",
+	handler typedHandler[T],
+	codecFor codecFunc,
+	opts []SubscribeOption,
+) (*Subscription, error) {
+	options := subscribeOptions{
+		poisonPolicy: PoisonDeadLetter,
+		retryPolicy:  DefaultRetryPolicy,
+		codecs:       DefaultCodecs,
+		prefetch:     10,
+		concurrency:  1,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	wrapped := wrapHandler(handler, options.middlewares)
+
+	sub := newSubscription(ctx)
+	sub.retrier = newRetrier(broker, options.retryPolicy)
+	sub.closers = options.closers
+
+	consume := func() (<-chan amqp.Delivery, error) {
+		ch, queue, err := DeclareAndBind(
+			broker,
 			exchange,
+			queueName,
 			key,
-			err,
+			simpleQueueType,
+			options.queueOptions...,
 		)
-		return err
+		if err != nil {
+			logging.Logger().Error("failed to declare and bind",
+				"exchange", exchange,
+				"routing_key", key,
+				"queue", queueName,
+				"error", err,
+			)
+			return nil, err
+		}
+		sub.setChannel(ch, queue.Name)
+
+		err = ch.Qos(options.prefetch, 0, false)
+		if err != nil {
+			logging.Logger().Error("failed to set QoS", "queue", queue.Name, "error", err)
+			ch.Close()
+			return nil, err
+		}
+
+		deliveryChan, err := ch.Consume(queue.Name, "", false, false, false, false, nil)
+		if err != nil {
+			logging.Logger().Error("failed to consume messages", "queue", queue.Name, "error", err)
+			ch.Close()
+			return nil, err
+		}
+		return deliveryChan, nil
 	}
 
-	err = ch.Qos(10, 0, false)
-	if err != nil {
-		log.Println("Failed to set QoS:", err)
-		return err
+	handle := func(delivery amqp.Delivery) {
+		queue := sub.queueName()
+		DefaultMetrics.delivered(exchange, delivery.RoutingKey, queue)
+		l := logging.Logger().With(
+			"exchange", exchange,
+			"routing_key", delivery.RoutingKey,
+			"queue", queue,
+		)
+
+		span := deliverySpan(delivery.Headers, fmt.Sprintf("handle %s", queue))
+		span.span.Exchange = exchange
+		span.span.RoutingKey = delivery.RoutingKey
+		span.span.Queue = queue
+		span.span.MessageID = delivery.MessageId
+
+		var val T
+		codecName := delivery.ContentType
+		codec, err := codecFor(options, delivery.ContentType)
+		if err == nil {
+			codecName = codec.ContentType()
+			err = codec.Unmarshal(delivery.Body, &val)
+		}
+		if err != nil {
+			l.Warn("failed to unmarshal message", "content_type", codecName, "error", err)
+			sub.poisoned.Add(1)
+			DefaultMetrics.decodeFailed(exchange, delivery.RoutingKey, queue)
+			span.end("poison", err)
+			handlePoison(broker, options.poisonPolicy, queueName, codecName, delivery, err)
+			return
+		}
+
+		start := time.Now()
+		ackType := wrapped(ContextWithSpan(sub.ctx, span.sc), delivery, val)
+		DefaultMetrics.handled(exchange, delivery.RoutingKey, queue, ackType, time.Since(start))
+		span.end(ackType.String(), nil)
+
+		switch ackType {
+		case Ack:
+			err = delivery.Ack(false)
+		case NackRequeue:
+			err = delivery.Nack(false, true)
+		case NackDiscard:
+			err = delivery.Nack(false, false)
+		case RetryLater:
+			err = sub.retrier.retry(sub.queueName(), delivery)
+			if err != nil {
+				l.Error("failed to schedule retry, requeueing instead", "error", err)
+				err = delivery.Nack(false, true)
+				break
+			}
+			err = delivery.Ack(false)
+		}
+
+		if err != nil {
+			l.Error("failed to settle message", "ack", ackType.String(), "error", err)
+			return
+		}
+		l.Debug("settled message", "ack", ackType.String())
 	}
 
-	deliveryChan, err := ch.Consume(queue.Name, "", false, false, false, false, nil)
+	deliveryChan, err := consume()
 	if err != nil {
-		log.Printf("Failed to consume messages from queue %s: %v\n", queue.Name, err)
-		return err
+		sub.stop()
+		return nil, err
 	}
+	if m, ok := broker.(*Manager); ok && queueName != "" {
+		sub.forget = func() {
+			m.undeclare(topologyKey{exchange: exchange, queue: queueName, key: key})
+		}
+	}
+
+	workers := newDispatcher(options)
 
 	go func() {
-		for delivery := range deliveryChan {
-			val, err := unmarshaller(delivery.Body)
-			if err != nil {
-				log.Printf("Failed to unmarshal body: %v\n", err)
-				continue
+		defer sub.stop()
+		// Let the handlers in flight finish and ack before the channel
+		// is closed.
+		defer workers.wait()
+		for {
+			// Finish the deliveries in hand before noticing a Close, but
+			// don't start another one.
+			if sub.ctx.Err() != nil {
+				return
 			}
 
-			ackType := handler(val)
-
-			switch ackType {
-			case Ack:
-				err = delivery.Ack(false)
-				log.Println("Acked message")
-			case NackRequeue:
-				err = delivery.Nack(false, true)
-				log.Println("Nacked and requeued message")
-			case NackDiscard:
-				err = delivery.Nack(false, false)
-				log.Println("Nacked and discarded message")
+			select {
+			case <-sub.ctx.Done():
+				return
+			case delivery, ok := <-deliveryChan:
+				if ok {
+					if !workers.submit(sub.ctx, delivery, func() { handle(delivery) }) {
+						return
+					}
+					continue
+				}
 			}
 
-			if err != nil {
-				log.Printf("Failed to ack message: %v\n", err)
+			// The channel closed underneath us. A Manager will reconnect,
+			// so wait for it and pick up where we left off.
+			m, ok := broker.(*Manager)
+			if !ok || m.isClosed() {
+				sub.lost()
+				return
+			}
+			logging.Logger().Warn("lost subscription, reattaching", "exchange", exchange, "routing_key", key, "queue", queueName)
+			deliveryChan, ok = m.resubscribe(sub.ctx, consume)
+			if !ok {
+				return
 			}
-			fmt.Print("> ")
 		}
 	}()
 
-	return nil
+	return sub, nil
 }
 
-func PublishJSON[T any](ch *amqp.Channel, exchange, key string, val T) error {
-	return publish(
-		ch,
+// Publish encodes val with the codec chosen by WithCodec, JSON by default,
+// and stamps the codec's content type on the message.
+func Publish[T any](pub Publisher, exchange, key string, val T, opts ...PublishOption) error {
+	return publish(pub, exchange, key, val, opts)
+}
+
+// Subscribe decodes each delivery with the codec registered for its
+// content type, so publishers can change format without the subscriber
+// changing with them. Deliveries with no content type are read as JSON.
+func Subscribe[T any](
+	ctx context.Context,
+	broker Broker,
+	exchange,
+	queueName,
+	key string,
+	simpleQueueType SimpleQueueType,
+	handler func(T) AckType,
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	return subscribe(
+		ctx,
+		broker,
 		exchange,
+		queueName,
 		key,
-		val,
-		func(val T) ([]byte, error) {
-			bytes, err := json.Marshal(val)
-			if err != nil {
-				log.Println("Failed to marshal JSON:", err)
-				return nil, err
-			}
-
-			return bytes, nil
-		},
+		simpleQueueType,
+		plainHandler(handler),
+		negotiatedCodec,
+		opts,
 	)
 }
 
+func PublishJSON[T any](pub Publisher, exchange, key string, val T, opts ...PublishOption) error {
+	return publish(pub, exchange, key, val, append(opts, WithCodec(JSON)))
+}
+
 func SubscribeJSON[T any](
-	conn *amqp.Connection,
+	ctx context.Context,
+	broker Broker,
 	exchange,
 	queueName,
 	key string,
 	simpleQueueType SimpleQueueType,
 	handler func(T) AckType,
-) error {
+	opts ...SubscribeOption,
+) (*Subscription, error) {
 	return subscribe(
-		conn,
+		ctx,
+		broker,
 		exchange,
 		queueName,
 		key,
 		simpleQueueType,
-		handler,
-		func(body []byte) (T, error) {
-			var val T
-			if err := json.Unmarshal(body, &val); err != nil {
-				log.Printf("Failed to unmarshal JSON: %v\n", err)
-				return val, err
-			}
-			return val, nil
-		},
+		plainHandler(handler),
+		fixedCodec(JSON),
+		opts,
 	)
 }
 
-func PublishGob[T any](ch *amqp.Channel, exchange, key string, val T) error {
-	return publish(
-		ch,
-		exchange,
-		key,
-		val,
-		func(val T) ([]byte, error) {
-			var buf bytes.Buffer
-			enc := gob.NewEncoder(&buf)
-			if err := enc.Encode(val); err != nil {
-				log.Println("Failed to encode gob:", err)
-				return nil, err
-			}
-
-			return buf.Bytes(), nil
-		},
-	)
+func PublishGob[T any](pub Publisher, exchange, key string, val T, opts ...PublishOption) error {
+	return publish(pub, exchange, key, val, append(opts, WithCodec(Gob)))
 }
 
 func SubscribeGob[T any](
-	conn *amqp.Connection,
+	ctx context.Context,
+	broker Broker,
 	exchange,
 	queueName,
 	key string,
 	simpleQueueType SimpleQueueType,
 	handler func(T) AckType,
-) error {
+	opts ...SubscribeOption,
+) (*Subscription, error) {
 	return subscribe(
-		conn,
+		ctx,
+		broker,
 		exchange,
 		queueName,
 		key,
 		simpleQueueType,
-		handler,
-		func(body []byte) (T, error) {
-			buf := bytes.NewBuffer(body)
-			dec := gob.NewDecoder(buf)
-			var val T
-			if err := dec.Decode(&val); err != nil {
-				log.Printf("Failed to decode gob: %v\n", err)
-				return val, err
-			}
-			return val, nil
-		},
+		plainHandler(handler),
+		fixedCodec(Gob),
+		opts,
 	)
 }
 
 func DeclareAndBind(
-	conn *amqp.Connection,
+	broker Broker,
 	exchange,
 	queueName,
 	key string,
-	simpleQueueType SimpleQueueType, // an enum to represent "durable" or "transient"
-) (*amqp.Channel, amqp.Queue, error) {
-	ch, err := conn.Channel()
+	simpleQueueType SimpleQueueType, // an enum to represent "durable", "transient", "quorum" or "stream"
+	opts ...QueueOption,
+) (Channel, amqp.Queue, error) {
+	ch, queue, err := declareAndBind(broker, exchange, queueName, key, simpleQueueType, opts)
 	if err != nil {
-		log.Println("Failed to open a channel:", err)
+		return nil, amqp.Queue{}, err
+	}
+
+	// Remember the binding so a Manager can put it back after a reconnect.
+	// Server-named queues get a new name each time, so there is nothing to
+	// restore for them.
+	if m, ok := broker.(*Manager); ok && queueName != "" {
+		m.declare(topologyKey{exchange: exchange, queue: queueName, key: key}, func(b Broker) error {
+			ch, _, err := declareAndBind(b, exchange, queueName, key, simpleQueueType, opts)
+			if err != nil {
+				return err
+			}
+			return ch.Close()
+		})
+	}
+
+	return ch, queue, nil
+}
+
+func declareAndBind(
+	broker Broker,
+	exchange,
+	queueName,
+	key string,
+	simpleQueueType SimpleQueueType,
+	opts []QueueOption,
+) (Channel, amqp.Queue, error) {
+	args, err := queueArgs(simpleQueueType, opts)
+	if err != nil {
+		logging.Logger().Error("invalid queue arguments", "queue", queueName, "error", err)
+		return nil, amqp.Queue{}, err
+	}
+
+	ch, err := broker.Channel()
+	if err != nil {
+		logging.Logger().Error("failed to open a channel", "error", err)
 		return nil, amqp.Queue{}, err
 	}
 
 	var durable, autoDelete, exclusive bool
-	if simpleQueueType == Durable {
-		durable = true
-		autoDelete = false
-		exclusive = false
-	} else if simpleQueueType == Transient {
+	if simpleQueueType == Transient {
 		durable = false
 		autoDelete = true
 		exclusive = true
+	} else {
+		// Quorum queues and streams must be durable too.
+		durable = true
+		autoDelete = false
+		exclusive = false
 	}
 
-	queue, err := ch.QueueDeclare(queueName, durable, autoDelete, exclusive, false, amqp.Table{
-		"x-dead-letter-exchange": "peril_dlx",
-	})
+	queue, err := ch.QueueDeclare(queueName, durable, autoDelete, exclusive, false, args)
 	if err != nil {
-		log.Printf("Failed to declare queue %s: %v\n", queueName, err)
+		logging.Logger().Error("failed to declare queue", "queue", queueName, "error", err)
+		ch.Close()
 		return nil, amqp.Queue{}, err
 	}
 
 	err = ch.QueueBind(queue.Name, key, exchange, false, nil)
 	if err != nil {
-		log.Printf("Failed to bind queue %s to %s@%s: %v\n", queue.Name, exchange, key, err)
+		logging.Logger().Error("failed to bind queue", "queue", queue.Name, "exchange", exchange, "routing_key", key, "error", err)
+		ch.Close()
 		return nil, amqp.Queue{}, err
 	}
 
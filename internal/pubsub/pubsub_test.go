@@ -0,0 +1,295 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	testTopic  = "test_topic"
+	testDirect = "test_direct"
+	testDLQ    = "test_dlq"
+)
+
+// testTopology is a topic and a direct exchange, with the dead letter
+// exchange that durable queues send to feeding testDLQ.
+var testTopology = Topology{
+	Exchanges: []ExchangeSpec{
+		{Name: testTopic, Kind: amqp.ExchangeTopic, Durable: true},
+		{Name: testDirect, Kind: amqp.ExchangeDirect, Durable: true},
+		{Name: DeadLetterExchange, Kind: amqp.ExchangeFanout, Durable: true},
+	},
+	Queues: []QueueSpec{
+		{Name: testDLQ, Durable: true},
+	},
+	Bindings: []BindingSpec{
+		{Queue: testDLQ, Exchange: DeadLetterExchange},
+	},
+}
+
+// newTestBroker starts a memory server with testTopology applied and
+// returns it with a connection to it.
+func newTestBroker(t *testing.T) (*MemoryServer, Broker) {
+	t.Helper()
+	server := NewMemoryServer()
+	broker, err := server.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { broker.Close() })
+	if err := testTopology.Apply(broker); err != nil {
+		t.Fatal(err)
+	}
+	return server, broker
+}
+
+func newTestPublisher(t *testing.T, broker Broker) *ConfirmPublisher {
+	t.Helper()
+	pub, err := NewConfirmPublisher(broker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pub.Close() })
+	return pub
+}
+
+// collect subscribes to key on exchange and sends what arrives on the
+// channel it returns, acking each.
+func collect(t *testing.T, broker Broker, exchange, queue, key string, queueType SimpleQueueType) <-chan string {
+	t.Helper()
+	got := make(chan string, 16)
+	sub, err := SubscribeJSON(context.Background(), broker, exchange, queue, key, queueType, func(s string) AckType {
+		got <- s
+		return Ack
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sub.Close() })
+	return got
+}
+
+func receive[T any](t *testing.T, ch <-chan T) T {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for a message")
+		var zero T
+		return zero
+	}
+}
+
+func receiveNothing[T any](t *testing.T, ch <-chan T) {
+	t.Helper()
+	select {
+	case v := <-ch:
+		t.Fatalf("got %v, want nothing", v)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestTopicRouting(t *testing.T) {
+	_, broker := newTestBroker(t)
+	pub := newTestPublisher(t, broker)
+
+	moves := collect(t, broker, testTopic, "", "army_moves.*", Transient)
+	wars := collect(t, broker, testTopic, "", "war.*", Transient)
+
+	if err := PublishJSON(pub, testTopic, "army_moves.alice", "move"); err != nil {
+		t.Fatal(err)
+	}
+	if got := receive(t, moves); got != "move" {
+		t.Errorf("army_moves.* got %q, want %q", got, "move")
+	}
+	receiveNothing(t, wars)
+}
+
+func TestDirectRouting(t *testing.T) {
+	_, broker := newTestBroker(t)
+	pub := newTestPublisher(t, broker)
+
+	pauses := collect(t, broker, testDirect, "", "pause", Transient)
+	others := collect(t, broker, testDirect, "", "pause.more", Transient)
+
+	if err := PublishJSON(pub, testDirect, "pause", "paused"); err != nil {
+		t.Fatal(err)
+	}
+	if got := receive(t, pauses); got != "paused" {
+		t.Errorf("pause got %q, want %q", got, "paused")
+	}
+	receiveNothing(t, others)
+}
+
+func TestWildcardBindings(t *testing.T) {
+	tests := []struct {
+		binding string
+		matches []string
+		misses  []string
+	}{
+		{"army_moves.*", []string{"army_moves.alice"}, []string{"army_moves", "army_moves.alice.bob", "war.alice"}},
+		{"army_moves.#", []string{"army_moves", "army_moves.alice", "army_moves.alice.bob"}, []string{"war.alice"}},
+		{"*.alice", []string{"army_moves.alice", "war.alice"}, []string{"alice", "war.bob"}},
+		{"#", []string{"army_moves.alice", "war", "a.b.c"}, nil},
+		{"#.alice.#", []string{"alice", "war.alice", "war.alice.x"}, []string{"war.bob"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.binding, func(t *testing.T) {
+			_, broker := newTestBroker(t)
+			pub := newTestPublisher(t, broker)
+			got := collect(t, broker, testTopic, "", tt.binding, Transient)
+
+			for _, key := range tt.matches {
+				if err := PublishJSON(pub, testTopic, key, key); err != nil {
+					t.Fatal(err)
+				}
+				if v := receive(t, got); v != key {
+					t.Errorf("got %q, want %q", v, key)
+				}
+			}
+			for _, key := range tt.misses {
+				if err := PublishJSON(pub, testTopic, key, key); err != nil {
+					t.Fatal(err)
+				}
+			}
+			receiveNothing(t, got)
+		})
+	}
+}
+
+func TestNackRequeueRedelivers(t *testing.T) {
+	_, broker := newTestBroker(t)
+	pub := newTestPublisher(t, broker)
+
+	type delivery struct {
+		body        string
+		redelivered bool
+	}
+	got := make(chan delivery, 4)
+	sub, err := SubscribeJSONEnvelope(context.Background(), broker, testTopic, "requeue", "requeue.*", Durable, func(msg Message[string]) AckType {
+		got <- delivery{msg.Body, msg.Redelivered}
+		if !msg.Redelivered {
+			return NackRequeue
+		}
+		return Ack
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	if err := PublishJSON(pub, testTopic, "requeue.alice", "again"); err != nil {
+		t.Fatal(err)
+	}
+	if d := receive(t, got); d.body != "again" || d.redelivered {
+		t.Errorf("first delivery = %+v, want %q not redelivered", d, "again")
+	}
+	if d := receive(t, got); d.body != "again" || !d.redelivered {
+		t.Errorf("second delivery = %+v, want %q redelivered", d, "again")
+	}
+	receiveNothing(t, got)
+
+	dead, err := InspectDeadLetters(broker, testDLQ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 0 {
+		t.Errorf("%d dead letters after a requeue, want none", len(dead))
+	}
+}
+
+func TestNackDiscardDeadLetters(t *testing.T) {
+	_, broker := newTestBroker(t)
+	pub := newTestPublisher(t, broker)
+
+	handled := make(chan string, 1)
+	sub, err := SubscribeJSON(context.Background(), broker, testTopic, "discard", "discard.*", Durable, func(s string) AckType {
+		handled <- s
+		return NackDiscard
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	if err := PublishJSON(pub, testTopic, "discard.alice", "unwanted"); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, handled)
+	sub.Close()
+
+	dead, err := InspectDeadLetters(broker, testDLQ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 1 {
+		t.Fatalf("got %d dead letters, want 1", len(dead))
+	}
+	dl := dead[0]
+	if dl.Exchange != testTopic || dl.RoutingKey != "discard.alice" || dl.Queue != "discard" || dl.Reason != "rejected" {
+		t.Errorf("dead letter from %s@%s in %s for %q, want %s@discard.alice in discard for %q",
+			dl.Exchange, dl.RoutingKey, dl.Queue, dl.Reason, testTopic, "rejected")
+	}
+
+	// Replaying puts it back where it came from.
+	replayed := collect(t, broker, testTopic, "", "discard.*", Transient)
+	n, err := ReplayDeadLetters(broker, testDLQ, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("replayed %d dead letters, want 1", n)
+	}
+	if got := receive(t, replayed); got != "unwanted" {
+		t.Errorf("replayed %q, want %q", got, "unwanted")
+	}
+}
+
+func TestReplaySkipsUnroutableDeadLetters(t *testing.T) {
+	_, broker := newTestBroker(t)
+	captureLogs(t)
+	pub := newTestPublisher(t, broker)
+	replayed := collect(t, broker, testTopic, "", "replay.*", Transient)
+
+	// Nothing is bound to lost.*, so the second can't be replayed.
+	for _, key := range []string{"replay.alice", "lost.bob", "replay.carol"} {
+		err := pub.PublishWithContext(context.Background(), DeadLetterExchange, "", false, false, amqp.Publishing{
+			Headers: amqp.Table{
+				HeaderDeadLetterReason:   "rejected",
+				HeaderOriginalExchange:   testTopic,
+				HeaderOriginalRoutingKey: key,
+			},
+			Body: []byte(`"` + key + `"`),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := ReplayDeadLetters(broker, testDLQ, nil)
+	var unroutable *UnroutableError
+	if !errors.As(err, &unroutable) || unroutable.RoutingKey != "lost.bob" {
+		t.Errorf("ReplayDeadLetters = %v, want lost.bob to be unroutable", err)
+	}
+	if n != 2 {
+		t.Errorf("replayed %d dead letters, want 2", n)
+	}
+	for _, want := range []string{"replay.alice", "replay.carol"} {
+		if got := receive(t, replayed); got != want {
+			t.Errorf("replayed %q, want %q", got, want)
+		}
+	}
+
+	dead, err := InspectDeadLetters(broker, testDLQ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 1 || dead[0].RoutingKey != "lost.bob" {
+		t.Errorf("left %d dead letters, want only lost.bob", len(dead))
+	}
+}
@@ -0,0 +1,176 @@
+package pubsub
+
+import (
+	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Overflow is what a queue with a maximum length does with a message that
+// arrives when it is full.
+type Overflow string
+
+const (
+	// DropHead dead-letters the oldest message to make room. This is what
+	// RabbitMQ does when no overflow is set.
+	DropHead Overflow = "drop-head"
+	// RejectPublish drops the new message and, in confirm mode, nacks it.
+	RejectPublish Overflow = "reject-publish"
+	// RejectPublishDLX is RejectPublish that also dead-letters the new
+	// message. Quorum queues don't support it.
+	RejectPublishDLX Overflow = "reject-publish-dlx"
+)
+
+// QueueOption sets an argument on the queue declared by DeclareAndBind.
+type QueueOption func(args amqp.Table)
+
+// WithDeliveryLimit dead-letters a message once it has been returned to a
+// Quorum queue n times, so a message that keeps failing can't go round
+// forever.
+func WithDeliveryLimit(n int) QueueOption {
+	return func(args amqp.Table) {
+		args["x-delivery-limit"] = int64(n)
+	}
+}
+
+// WithSingleActiveConsumer lets only one of the queue's consumers receive
+// messages at a time, keeping them in order while the others wait to take
+// over.
+func WithSingleActiveConsumer() QueueOption {
+	return func(args amqp.Table) {
+		args["x-single-active-consumer"] = true
+	}
+}
+
+// WithMaxLength caps how many ready messages the queue holds. What happens
+// to the rest is set by WithOverflow.
+func WithMaxLength(n int) QueueOption {
+	return func(args amqp.Table) {
+		args["x-max-length"] = int64(n)
+	}
+}
+
+// WithOverflow sets what a queue capped by WithMaxLength does when it is
+// full. The default is DropHead.
+func WithOverflow(overflow Overflow) QueueOption {
+	return func(args amqp.Table) {
+		args["x-overflow"] = string(overflow)
+	}
+}
+
+// WithMessageTTL dead-letters messages that have waited in the queue for
+// longer than d.
+func WithMessageTTL(d time.Duration) QueueOption {
+	return func(args amqp.Table) {
+		args["x-message-ttl"] = d.Milliseconds()
+	}
+}
+
+// WithoutDeadLetterExchange declares the queue without the
+// DeadLetterExchange every other queue gets, for messages nobody would want
+// to inspect once they've expired, such as requests.
+func WithoutDeadLetterExchange() QueueOption {
+	return func(args amqp.Table) {
+		args["x-dead-letter-exchange"] = nil
+	}
+}
+
+// WithQueueArg sets any other queue argument. It is checked against the
+// others but not on its own.
+func WithQueueArg(key string, value interface{}) QueueOption {
+	return func(args amqp.Table) {
+		args[key] = value
+	}
+}
+
+// queueArgs builds the arguments for declaring a queue of type t and checks
+// them for combinations RabbitMQ would refuse or quietly ignore.
+func queueArgs(t SimpleQueueType, opts []QueueOption) (amqp.Table, error) {
+	args := amqp.Table{}
+	switch t {
+	case Quorum:
+		args["x-queue-type"] = "quorum"
+	case Stream:
+		args["x-queue-type"] = "stream"
+	}
+	for _, opt := range opts {
+		opt(args)
+	}
+
+	if queueType, ok := args["x-queue-type"]; ok && queueType != t.queueType() {
+		return nil, fmt.Errorf("pubsub: x-queue-type %v conflicts with %s queue", queueType, t)
+	}
+
+	for _, k := range []string{"x-delivery-limit", "x-max-length", "x-message-ttl"} {
+		v, ok := args[k]
+		if !ok {
+			continue
+		}
+		if n, isInt := normalizeArg(v).(int64); !isInt || n < 0 {
+			return nil, fmt.Errorf("pubsub: %s must be a non-negative integer, not %v", k, v)
+		}
+	}
+	if v, ok := args["x-single-active-consumer"]; ok {
+		if _, isBool := v.(bool); !isBool {
+			return nil, fmt.Errorf("pubsub: x-single-active-consumer must be a bool, not %v", v)
+		}
+	}
+
+	if _, ok := args["x-delivery-limit"]; ok && t != Quorum {
+		return nil, fmt.Errorf("pubsub: x-delivery-limit needs a quorum queue, not %s", t)
+	}
+
+	if v, ok := args["x-max-priority"]; ok {
+		if t == Quorum || t == Stream {
+			return nil, fmt.Errorf("pubsub: %s queues don't support x-max-priority", t)
+		}
+		if n, isInt := normalizeArg(v).(int64); !isInt || n < 1 || n > 255 {
+			return nil, fmt.Errorf("pubsub: x-max-priority must be an integer from 1 to 255, not %v", v)
+		}
+	}
+
+	if v, ok := args["x-overflow"]; ok {
+		switch Overflow(fmt.Sprint(v)) {
+		case DropHead, RejectPublish:
+		case RejectPublishDLX:
+			if t == Quorum {
+				return nil, fmt.Errorf("pubsub: quorum queues don't support x-overflow %s", RejectPublishDLX)
+			}
+		default:
+			return nil, fmt.Errorf("pubsub: unknown x-overflow %v", v)
+		}
+		_, maxLength := args["x-max-length"]
+		_, maxLengthBytes := args["x-max-length-bytes"]
+		if !maxLength && !maxLengthBytes {
+			return nil, fmt.Errorf("pubsub: x-overflow has no effect without x-max-length")
+		}
+	}
+
+	if t == Stream {
+		// Streams keep messages until they age or grow out, whoever has
+		// read them, so there is nothing to dead-letter.
+		for _, k := range []string{"x-max-length", "x-overflow", "x-message-ttl", "x-dead-letter-exchange"} {
+			if v, ok := args[k]; ok && v != nil {
+				return nil, fmt.Errorf("pubsub: stream queues don't support %s", k)
+			}
+		}
+		delete(args, "x-dead-letter-exchange")
+		return args, nil
+	}
+
+	switch dlx, ok := args["x-dead-letter-exchange"]; {
+	case !ok:
+		args["x-dead-letter-exchange"] = DeadLetterExchange
+	case dlx == nil:
+		delete(args, "x-dead-letter-exchange")
+	}
+	return args, nil
+}
+
+// WithQueueOptions sets arguments on the queue the subscription declares.
+func WithQueueOptions(opts ...QueueOption) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.queueOptions = append(o.queueOptions, opts...)
+	}
+}
@@ -0,0 +1,181 @@
+package pubsub
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestQueueArgsAccepted(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		queueType SimpleQueueType
+		opts      []QueueOption
+		want      amqp.Table
+	}{
+		{"durable", Durable, nil, amqp.Table{"x-dead-letter-exchange": DeadLetterExchange}},
+		{"transient", Transient, nil, amqp.Table{"x-dead-letter-exchange": DeadLetterExchange}},
+		{"quorum", Quorum, nil, amqp.Table{"x-queue-type": "quorum", "x-dead-letter-exchange": DeadLetterExchange}},
+		{"stream", Stream, nil, amqp.Table{"x-queue-type": "stream"}},
+		{"quorum delivery limit", Quorum, []QueueOption{WithDeliveryLimit(5)}, amqp.Table{
+			"x-queue-type": "quorum", "x-delivery-limit": int64(5), "x-dead-letter-exchange": DeadLetterExchange,
+		}},
+		{"single active consumer", Stream, []QueueOption{WithSingleActiveConsumer()}, amqp.Table{
+			"x-queue-type": "stream", "x-single-active-consumer": true,
+		}},
+		{"max length", Durable, []QueueOption{WithMaxLength(10), WithOverflow(RejectPublishDLX)}, amqp.Table{
+			"x-max-length": int64(10), "x-overflow": "reject-publish-dlx", "x-dead-letter-exchange": DeadLetterExchange,
+		}},
+		{"quorum max length", Quorum, []QueueOption{WithMaxLength(10), WithOverflow(RejectPublish)}, amqp.Table{
+			"x-queue-type": "quorum", "x-max-length": int64(10), "x-overflow": "reject-publish", "x-dead-letter-exchange": DeadLetterExchange,
+		}},
+		{"overflow with max length in bytes", Transient, []QueueOption{WithQueueArg("x-max-length-bytes", 1024), WithOverflow(DropHead)}, amqp.Table{
+			"x-max-length-bytes": 1024, "x-overflow": "drop-head", "x-dead-letter-exchange": DeadLetterExchange,
+		}},
+		{"message ttl", Quorum, []QueueOption{WithMessageTTL(time.Minute)}, amqp.Table{
+			"x-queue-type": "quorum", "x-message-ttl": int64(60000), "x-dead-letter-exchange": DeadLetterExchange,
+		}},
+		{"priority", Durable, []QueueOption{WithQueueArg("x-max-priority", 10)}, amqp.Table{
+			"x-max-priority": 10, "x-dead-letter-exchange": DeadLetterExchange,
+		}},
+		{"without dead letter exchange", Durable, []QueueOption{WithoutDeadLetterExchange()}, amqp.Table{}},
+		{"own dead letter exchange", Quorum, []QueueOption{WithQueueArg("x-dead-letter-exchange", "other_dlx")}, amqp.Table{
+			"x-queue-type": "quorum", "x-dead-letter-exchange": "other_dlx",
+		}},
+		{"stream without dead letter exchange", Stream, []QueueOption{WithoutDeadLetterExchange()}, amqp.Table{"x-queue-type": "stream"}},
+		{"matching queue type", Quorum, []QueueOption{WithQueueArg("x-queue-type", "quorum")}, amqp.Table{
+			"x-queue-type": "quorum", "x-dead-letter-exchange": DeadLetterExchange,
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := queueArgs(tt.queueType, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueueArgsRejected(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		queueType SimpleQueueType
+		opts      []QueueOption
+	}{
+		{"conflicting queue type", Durable, []QueueOption{WithQueueArg("x-queue-type", "quorum")}},
+		{"stream declared as quorum", Quorum, []QueueOption{WithQueueArg("x-queue-type", "stream")}},
+		{"negative delivery limit", Quorum, []QueueOption{WithDeliveryLimit(-1)}},
+		{"negative max length", Durable, []QueueOption{WithMaxLength(-1)}},
+		{"negative message ttl", Durable, []QueueOption{WithMessageTTL(-time.Second)}},
+		{"max length not an integer", Durable, []QueueOption{WithQueueArg("x-max-length", "10")}},
+		{"single active consumer not a bool", Durable, []QueueOption{WithQueueArg("x-single-active-consumer", "yes")}},
+		{"delivery limit on a classic queue", Durable, []QueueOption{WithDeliveryLimit(5)}},
+		{"delivery limit on a stream", Stream, []QueueOption{WithDeliveryLimit(5)}},
+		{"unknown overflow", Durable, []QueueOption{WithMaxLength(10), WithOverflow("drop-tail")}},
+		{"reject-publish-dlx on quorum", Quorum, []QueueOption{WithMaxLength(10), WithOverflow(RejectPublishDLX)}},
+		{"overflow without max length", Durable, []QueueOption{WithOverflow(RejectPublish)}},
+		{"max length on a stream", Stream, []QueueOption{WithMaxLength(10)}},
+		{"overflow on a stream", Stream, []QueueOption{WithQueueArg("x-max-length-bytes", 1024), WithOverflow(DropHead)}},
+		{"message ttl on a stream", Stream, []QueueOption{WithMessageTTL(time.Minute)}},
+		{"dead letter exchange on a stream", Stream, []QueueOption{WithQueueArg("x-dead-letter-exchange", DeadLetterExchange)}},
+		{"priority on quorum", Quorum, []QueueOption{WithQueueArg("x-max-priority", 10)}},
+		{"priority on a stream", Stream, []QueueOption{WithQueueArg("x-max-priority", 10)}},
+		{"priority out of range", Durable, []QueueOption{WithQueueArg("x-max-priority", 256)}},
+		{"zero priority", Transient, []QueueOption{WithQueueArg("x-max-priority", 0)}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if args, err := queueArgs(tt.queueType, tt.opts); err == nil {
+				t.Errorf("accepted %v for a %s queue", args, tt.queueType)
+			}
+		})
+	}
+}
+
+func TestReplicatedQueuesMustBeDurable(t *testing.T) {
+	server := NewMemoryServer()
+	broker, err := server.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	for _, queueType := range []string{"quorum", "stream"} {
+		for _, tt := range []struct {
+			name                           string
+			durable, autoDelete, exclusive bool
+		}{
+			{"transient", false, false, false},
+			{"auto-delete", true, true, false},
+			{"exclusive", true, false, true},
+		} {
+			t.Run(queueType+" "+tt.name, func(t *testing.T) {
+				q := QueueSpec{Name: "replicated", Durable: tt.durable, AutoDelete: tt.autoDelete, Exclusive: tt.exclusive, Args: amqp.Table{"x-queue-type": queueType}}
+				if err := (Topology{Queues: []QueueSpec{q}}).Validate(); err == nil {
+					t.Error("Validate accepted it")
+				}
+
+				// The broker refuses it too, so it's no use skipping Validate.
+				ch, err := broker.Channel()
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer ch.Close()
+				if _, err := ch.QueueDeclare(q.Name, q.Durable, q.AutoDelete, q.Exclusive, false, q.Args); err == nil {
+					t.Error("QueueDeclare accepted it")
+				}
+			})
+		}
+
+		t.Run(queueType+" durable", func(t *testing.T) {
+			q := QueueSpec{Name: queueType, Durable: true, Args: amqp.Table{"x-queue-type": queueType}}
+			if err := (Topology{Queues: []QueueSpec{q}}).Apply(broker); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestDeclareAndBindQuorumQueue(t *testing.T) {
+	_, broker := newTestBroker(t)
+	captureLogs(t)
+
+	ch, q, err := DeclareAndBind(broker, testTopic, "quorum_moves", "moves.*", Quorum, WithDeliveryLimit(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch.Close()
+	if q.Name != "quorum_moves" {
+		t.Errorf("declared %s, want quorum_moves", q.Name)
+	}
+
+	// A queue's type can't change once it's declared.
+	if ch, _, err := DeclareAndBind(broker, testTopic, "quorum_moves", "moves.*", Durable); err == nil {
+		ch.Close()
+		t.Error("redeclared a quorum queue as a classic one")
+	}
+	if _, _, err := DeclareAndBind(broker, testTopic, "bad_quorum", "moves.*", Quorum, WithMaxLength(10), WithOverflow(RejectPublishDLX)); err == nil {
+		t.Error("declared a quorum queue with x-overflow reject-publish-dlx")
+	}
+
+	got := make(chan string, 1)
+	sub, err := SubscribeJSON(context.Background(), broker, testTopic, "quorum_moves", "moves.*", Quorum, func(s string) AckType {
+		got <- s
+		return Ack
+	}, WithQueueOptions(WithDeliveryLimit(3)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	if err := PublishJSON(newTestPublisher(t, broker), testTopic, "moves.alice", "move"); err != nil {
+		t.Fatal(err)
+	}
+	if s := receive(t, got); s != "move" {
+		t.Errorf("got %q, want %q", s, "move")
+	}
+}
@@ -0,0 +1,331 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/logging"
+)
+
+// Record is a message as a recording holds it.
+type Record struct {
+	// Time is when the message was recorded.
+	Time       time.Time
+	Exchange   string
+	RoutingKey string
+	// Headers are the message's properties and headers as text, the way
+	// STOMP and MQTT carry them.
+	Headers map[string]string
+	Body    []byte
+}
+
+// Publishing is the message to publish to replay r.
+func (r Record) Publishing() amqp.Publishing {
+	return textPublishing(r.Headers, r.Body)
+}
+
+// maxRecordSize bounds the records a RecordReader accepts, so a corrupt
+// length doesn't allocate gigabytes.
+const maxRecordSize = 64 << 20
+
+// RecordWriter writes records to a recording. Each record is a 4-byte
+// big-endian length followed by that many bytes of:
+//
+//	8 bytes    Time, in nanoseconds since the Unix epoch
+//	string     Exchange
+//	string     RoutingKey
+//	4 bytes    the number of headers, each a string key and string value
+//	the rest   Body
+//
+// where a string is a 4-byte length followed by its bytes. Every integer
+// is big-endian. It is safe for concurrent use.
+type RecordWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewRecordWriter returns a writer that appends records to w.
+func NewRecordWriter(w io.Writer) *RecordWriter {
+	return &RecordWriter{w: w}
+}
+
+// Write appends r to the recording in a single write to the underlying
+// writer.
+func (rw *RecordWriter) Write(r Record) error {
+	keys := make([]string, 0, len(r.Headers))
+	for k := range r.Headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	buf := make([]byte, 4, 64+len(r.Body))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(r.Time.UnixNano()))
+	buf = appendRecordString(buf, r.Exchange)
+	buf = appendRecordString(buf, r.RoutingKey)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(keys)))
+	for _, k := range keys {
+		buf = appendRecordString(buf, k)
+		buf = appendRecordString(buf, r.Headers[k])
+	}
+	buf = append(buf, r.Body...)
+	if len(buf)-4 > maxRecordSize {
+		return fmt.Errorf("pubsub: record of %d bytes is too big", len(buf)-4)
+	}
+	binary.BigEndian.PutUint32(buf, uint32(len(buf)-4))
+
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	_, err := rw.w.Write(buf)
+	return err
+}
+
+func appendRecordString(buf []byte, s string) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(s)))
+	return append(buf, s...)
+}
+
+// RecordReader reads the records a RecordWriter wrote.
+type RecordReader struct {
+	r io.Reader
+}
+
+// NewRecordReader returns a reader of the recording in r.
+func NewRecordReader(r io.Reader) *RecordReader {
+	return &RecordReader{r: r}
+}
+
+// ErrCorruptRecord is returned for a record that can't be decoded.
+var ErrCorruptRecord = errors.New("pubsub: corrupt record")
+
+// Read returns the next record. At the end of the recording it returns
+// io.EOF, or io.ErrUnexpectedEOF if the last record was cut short.
+func (rr *RecordReader) Read() (Record, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(rr.r, size[:]); err != nil {
+		return Record{}, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxRecordSize {
+		return Record{}, fmt.Errorf("%w: %d bytes long", ErrCorruptRecord, n)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(rr.r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Record{}, err
+	}
+	return parseRecord(buf)
+}
+
+func parseRecord(buf []byte) (Record, error) {
+	corrupt := fmt.Errorf("%w: too short", ErrCorruptRecord)
+	uint32At := func() (uint32, bool) {
+		if len(buf) < 4 {
+			return 0, false
+		}
+		v := binary.BigEndian.Uint32(buf)
+		buf = buf[4:]
+		return v, true
+	}
+	stringAt := func() (string, bool) {
+		n, ok := uint32At()
+		if !ok || uint32(len(buf)) < n {
+			return "", false
+		}
+		s := string(buf[:n])
+		buf = buf[n:]
+		return s, true
+	}
+
+	var r Record
+	if len(buf) < 8 {
+		return Record{}, corrupt
+	}
+	r.Time = time.Unix(0, int64(binary.BigEndian.Uint64(buf)))
+	buf = buf[8:]
+
+	var ok bool
+	if r.Exchange, ok = stringAt(); !ok {
+		return Record{}, corrupt
+	}
+	if r.RoutingKey, ok = stringAt(); !ok {
+		return Record{}, corrupt
+	}
+	count, ok := uint32At()
+	if !ok || count > uint32(len(buf)/8) {
+		return Record{}, corrupt
+	}
+	r.Headers = make(map[string]string, count)
+	for i := uint32(0); i < count; i++ {
+		k, ok := stringAt()
+		if !ok {
+			return Record{}, corrupt
+		}
+		v, ok := stringAt()
+		if !ok {
+			return Record{}, corrupt
+		}
+		r.Headers[k] = v
+	}
+	r.Body = buf
+	return r, nil
+}
+
+// ReadRecords reads a whole recording, such as a test fixture.
+func ReadRecords(r io.Reader) ([]Record, error) {
+	rr := NewRecordReader(r)
+	var records []Record
+	for {
+		record, err := rr.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+		records = append(records, record)
+	}
+}
+
+// rawCodec hands over message bodies undecoded, for subscriptions that
+// take whatever is published.
+type rawCodec struct{}
+
+func (rawCodec) ContentType() string { return "application/octet-stream" }
+
+func (rawCodec) Marshal(v any) ([]byte, error) { return v.([]byte), nil }
+
+func (rawCodec) Unmarshal(data []byte, v any) error {
+	*v.(*[]byte) = data
+	return nil
+}
+
+// RecordMessages records every message published to exchange with a
+// routing key matching key, until the subscription is closed. Messages are
+// copied off through a queue of the subscription's own, so recording
+// doesn't take them from anyone. One that can't be written is logged and
+// dropped, rather than retried while the disk stays full or dead-lettered
+// as if it were the original.
+func RecordMessages(ctx context.Context, broker Broker, exchange, key string, w *RecordWriter, opts ...SubscribeOption) (*Subscription, error) {
+	handler := func(_ context.Context, delivery amqp.Delivery, body []byte) AckType {
+		err := w.Write(Record{
+			Time:       time.Now(),
+			Exchange:   exchange,
+			RoutingKey: delivery.RoutingKey,
+			Headers:    textHeaders(republishing(delivery, delivery.Headers)),
+			Body:       body,
+		})
+		if err != nil {
+			logging.Logger().Error("failed to record message",
+				"exchange", exchange,
+				"routing_key", delivery.RoutingKey,
+				"error", err,
+			)
+			return NackDiscard
+		}
+		return Ack
+	}
+	opts = append([]SubscribeOption{WithQueueOptions(WithoutDeadLetterExchange())}, opts...)
+	return subscribe(ctx, broker, exchange, "", key, Transient, handler, fixedCodec(rawCodec{}), opts)
+}
+
+// ReplayOption configures Replay.
+type ReplayOption func(*replayOptions)
+
+type replayOptions struct {
+	speed    float64
+	filter   string
+	requests bool
+}
+
+// WithReplaySpeed replays at speed times the pace the messages were
+// recorded at, so 2 is twice as fast. 0 replays them as fast as they can
+// be published. The default is 1, the original pace.
+func WithReplaySpeed(speed float64) ReplayOption {
+	return func(o *replayOptions) {
+		o.speed = speed
+	}
+}
+
+// WithReplayFilter replays only the messages whose routing keys match
+// pattern, which is matched like a topic exchange binding key.
+func WithReplayFilter(pattern string) ReplayOption {
+	return func(o *replayOptions) {
+		o.filter = pattern
+	}
+}
+
+// WithReplayRequests replays RPC requests too, with the reply-to and
+// correlation ID they were recorded with. The server acts on each again,
+// such as letting a player join, and its reply goes to a queue that's
+// probably long gone.
+func WithReplayRequests() ReplayOption {
+	return func(o *replayOptions) {
+		o.requests = true
+	}
+}
+
+// Replay publishes the records in r to the exchanges and routing keys they
+// were recorded from, spaced out like they were recorded, until the
+// recording ends or ctx is cancelled. It returns how many it published.
+// RPC requests, the records with a reply-to, are skipped unless
+// WithReplayRequests is given: their callers stopped waiting long ago.
+func Replay(ctx context.Context, pub Publisher, r *RecordReader, opts ...ReplayOption) (int, error) {
+	options := replayOptions{speed: 1}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.speed < 0 || math.IsNaN(options.speed) || math.IsInf(options.speed, 0) {
+		return 0, fmt.Errorf("pubsub: invalid replay speed %v", options.speed)
+	}
+
+	var first time.Time
+	var start time.Time
+	replayed := 0
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return replayed, nil
+		}
+		if err != nil {
+			return replayed, err
+		}
+		if options.filter != "" && !bindingMatches(amqp.ExchangeTopic, options.filter, record.RoutingKey) {
+			continue
+		}
+		if !options.requests && record.Headers["reply-to"] != "" {
+			continue
+		}
+
+		// Each message is due a scaled offset from the first, so delays
+		// don't add up over a long recording.
+		if replayed == 0 {
+			first, start = record.Time, time.Now()
+		} else if options.speed > 0 {
+			offset := time.Duration(float64(record.Time.Sub(first)) / options.speed)
+			timer := time.NewTimer(time.Until(start.Add(offset)))
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return replayed, ctx.Err()
+			}
+		}
+
+		err = pub.PublishWithContext(ctx, record.Exchange, record.RoutingKey, false, false, record.Publishing())
+		if err != nil {
+			return replayed, fmt.Errorf("replay message %d to %s@%s: %w", replayed+1, record.Exchange, record.RoutingKey, err)
+		}
+		replayed++
+	}
+}
@@ -0,0 +1,248 @@
+package pubsub
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// chanWriter sends each write on a channel, so a test can wait for what
+// RecordMessages writes.
+type chanWriter chan []byte
+
+func (w chanWriter) Write(p []byte) (int, error) {
+	w <- bytes.Clone(p)
+	return len(p), nil
+}
+
+// failingWriter fails every write, like a full disk, and counts them.
+type failingWriter chan struct{}
+
+func (w failingWriter) Write(p []byte) (int, error) {
+	w <- struct{}{}
+	return 0, errors.New("no space left on device")
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	_, broker := newTestBroker(t)
+	writes := make(chanWriter, 16)
+	sub, err := RecordMessages(context.Background(), broker, testTopic, "army_moves.*", NewRecordWriter(writes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	pub := newTestPublisher(t, broker)
+	moves := []struct{ key, body string }{
+		{"army_moves.alice", "europe"},
+		{"army_moves.bob", "asia"},
+		{"army_moves.alice", "africa"},
+	}
+	for _, m := range moves {
+		if err := PublishJSON(pub, testTopic, m.key, m.body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := PublishJSON(pub, testTopic, "war.alice", "not recorded"); err != nil {
+		t.Fatal(err)
+	}
+
+	var recording bytes.Buffer
+	for range moves {
+		recording.Write(receive(t, writes))
+	}
+	receiveNothing(t, writes)
+	sub.Close()
+
+	records, err := ReadRecords(bytes.NewReader(recording.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != len(moves) {
+		t.Fatalf("read %d records, want %d", len(records), len(moves))
+	}
+	for i, r := range records {
+		want := `"` + moves[i].body + `"`
+		if r.Exchange != testTopic || r.RoutingKey != moves[i].key || string(r.Body) != want {
+			t.Errorf("record %d is %s on %s@%s, want %s on %s@%s", i, r.Body, r.Exchange, r.RoutingKey, want, testTopic, moves[i].key)
+		}
+		if r.Headers["content-type"] != "application/json" {
+			t.Errorf("record %d has content-type %q, want application/json", i, r.Headers["content-type"])
+		}
+	}
+
+	// The recording replays into the same exchange as a fixture.
+	got := collect(t, broker, testTopic, "", "army_moves.*", Transient)
+	n, err := Replay(context.Background(), pub, NewRecordReader(bytes.NewReader(recording.Bytes())), WithReplaySpeed(0))
+	if err != nil || n != len(moves) {
+		t.Fatalf("Replay = %d, %v, want %d", n, err, len(moves))
+	}
+	for _, m := range moves {
+		if v := receive(t, got); v != m.body {
+			t.Errorf("replayed %q, want %q", v, m.body)
+		}
+	}
+
+	n, err = Replay(context.Background(), pub, NewRecordReader(bytes.NewReader(recording.Bytes())), WithReplaySpeed(0), WithReplayFilter("*.bob"))
+	if err != nil || n != 1 {
+		t.Fatalf("filtered Replay = %d, %v, want 1", n, err)
+	}
+	if v := receive(t, got); v != "asia" {
+		t.Errorf("replayed %q, want %q", v, "asia")
+	}
+	receiveNothing(t, got)
+}
+
+func TestReplaySkipsRequests(t *testing.T) {
+	_, broker := newTestBroker(t)
+	pub := newTestPublisher(t, broker)
+
+	var recording bytes.Buffer
+	w := NewRecordWriter(&recording)
+	for _, r := range []Record{
+		{Exchange: testDirect, RoutingKey: "rpc.join", Headers: map[string]string{
+			"content-type": "application/json", "reply-to": "amq.gen-gone", "correlation-id": "1",
+		}, Body: []byte(`"alice"`)},
+		{Exchange: testDirect, RoutingKey: "pause", Headers: map[string]string{"content-type": "application/json"}, Body: []byte(`"paused"`)},
+	} {
+		if err := w.Write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	type request struct{ body, replyTo, correlationID string }
+	got := make(chan request, 4)
+	for _, key := range []string{"rpc.join", "pause"} {
+		sub, err := SubscribeJSONEnvelope(context.Background(), broker, testDirect, "", key, Transient, func(msg Message[string]) AckType {
+			got <- request{msg.Body, msg.ReplyTo, msg.CorrelationID}
+			return Ack
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sub.Close()
+	}
+
+	// A join's caller stopped waiting long ago, so it isn't made again.
+	n, err := Replay(context.Background(), pub, NewRecordReader(bytes.NewReader(recording.Bytes())), WithReplaySpeed(0))
+	if err != nil || n != 1 {
+		t.Fatalf("Replay = %d, %v, want 1", n, err)
+	}
+	if r := receive(t, got); r != (request{body: "paused"}) {
+		t.Errorf("replayed %+v, want only the pause", r)
+	}
+	receiveNothing(t, got)
+
+	n, err = Replay(context.Background(), pub, NewRecordReader(bytes.NewReader(recording.Bytes())), WithReplaySpeed(0), WithReplayRequests())
+	if err != nil || n != 2 {
+		t.Fatalf("Replay with requests = %d, %v, want 2", n, err)
+	}
+	want := map[request]bool{{"alice", "amq.gen-gone", "1"}: true, {body: "paused"}: true}
+	for range want {
+		if r := receive(t, got); !want[r] {
+			t.Errorf("replayed %+v, want one of %v", r, want)
+		}
+	}
+}
+
+// A message that can't be written is dropped, not redelivered over and
+// over or dead-lettered.
+func TestRecordMessagesDropsWhatItCantWrite(t *testing.T) {
+	logs := captureLogs(t)
+	_, broker := newTestBroker(t)
+	writes := make(failingWriter, 16)
+	sub, err := RecordMessages(context.Background(), broker, testTopic, "army_moves.*", NewRecordWriter(writes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	if err := PublishJSON(newTestPublisher(t, broker), testTopic, "army_moves.alice", "europe"); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, writes)
+	receiveNothing(t, writes)
+	logs.waitFor(t, "failed to record message")
+
+	if dead, err := InspectDeadLetters(broker, testDLQ); err != nil || len(dead) != 0 {
+		t.Errorf("InspectDeadLetters = %d, %v, want none", len(dead), err)
+	}
+}
+
+func TestReadRecordsTruncated(t *testing.T) {
+	var recording bytes.Buffer
+	rw := NewRecordWriter(&recording)
+	for _, body := range []string{"first", "second"} {
+		if err := rw.Write(Record{Time: time.Now(), Exchange: testTopic, RoutingKey: "key", Body: []byte(body)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, cut := range []int{1, 10} {
+		data := recording.Bytes()
+		records, err := ReadRecords(bytes.NewReader(data[:len(data)-cut]))
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("cut by %d bytes: ReadRecords error %v, want %v", cut, err, io.ErrUnexpectedEOF)
+		}
+		if len(records) != 1 || string(records[0].Body) != "first" {
+			t.Errorf("cut by %d bytes: got %d records, want just the first", cut, len(records))
+		}
+	}
+
+	// A length beyond what any record could be is corrupt, without
+	// reading on.
+	oversized := binary.BigEndian.AppendUint32(nil, maxRecordSize+1)
+	if _, err := ReadRecords(bytes.NewReader(oversized)); !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("ReadRecords of an oversized record = %v, want %v", err, ErrCorruptRecord)
+	}
+}
+
+func TestParseRecordCorrupt(t *testing.T) {
+	var recording bytes.Buffer
+	record := Record{
+		Time:       time.Unix(0, 42),
+		Exchange:   testTopic,
+		RoutingKey: "key",
+		Headers:    map[string]string{"content-type": "application/json"},
+		Body:       []byte(`"body"`),
+	}
+	if err := NewRecordWriter(&recording).Write(record); err != nil {
+		t.Fatal(err)
+	}
+	valid := recording.Bytes()[4:]
+	if r, err := parseRecord(valid); err != nil || !r.Time.Equal(record.Time) || r.Headers["content-type"] != "application/json" || string(r.Body) != `"body"` {
+		t.Fatalf("parseRecord of a valid record = %+v, %v", r, err)
+	}
+
+	// Offsets into valid: 8 bytes of time, then the exchange's length.
+	exchangeEnd := 8 + 4 + len(testTopic)
+	keyEnd := exchangeEnd + 4 + len("key")
+	patch := func(offset int, v uint32) []byte {
+		buf := bytes.Clone(valid)
+		binary.BigEndian.PutUint32(buf[offset:], v)
+		return buf
+	}
+	tests := []struct {
+		name string
+		buf  []byte
+	}{
+		{"empty", nil},
+		{"short time", valid[:7]},
+		{"no exchange", valid[:8]},
+		{"exchange cut short", valid[:exchangeEnd-1]},
+		{"exchange length past the end", patch(8, uint32(len(valid)))},
+		{"no routing key", valid[:exchangeEnd]},
+		{"no header count", valid[:keyEnd]},
+		{"header count past the end", patch(keyEnd, 1<<20)},
+		{"header cut short", valid[:keyEnd+4+4+2]},
+	}
+	for _, tt := range tests {
+		if _, err := parseRecord(tt.buf); !errors.Is(err, ErrCorruptRecord) {
+			t.Errorf("%s: parseRecord = %v, want %v", tt.name, err, ErrCorruptRecord)
+		}
+	}
+}
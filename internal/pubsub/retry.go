@@ -0,0 +1,218 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/logging"
+)
+
+// Headers used to track retries. They travel with the message while it
+// waits and are left on it when it is finally dead-lettered.
+const (
+	HeaderRetryAttempts = "x-retry-attempts"
+	HeaderRetryHistory  = "x-retry-history"
+)
+
+// RetryPolicy controls how a delivery whose handler returned RetryLater is
+// redelivered. The n-th retry waits InitialDelay * Multiplier^(n-1), capped
+// at MaxDelay. After MaxAttempts retries the message is dead-lettered.
+type RetryPolicy struct {
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	Multiplier   float64
+	MaxAttempts  int
+}
+
+// DefaultRetryPolicy is used by subscriptions that return RetryLater
+// without configuring a policy of their own.
+var DefaultRetryPolicy = RetryPolicy{
+	InitialDelay: time.Second,
+	MaxDelay:     time.Minute,
+	Multiplier:   2,
+	MaxAttempts:  5,
+}
+
+// WithRetry sets the policy used when the handler returns RetryLater.
+func WithRetry(policy RetryPolicy) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.retryPolicy = policy
+	}
+}
+
+// Delay returns how long to wait before the given retry attempt, counting
+// from 1.
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	d := float64(p.InitialDelay) * math.Pow(p.Multiplier, float64(attempt-1))
+	if p.MaxDelay > 0 && d > float64(p.MaxDelay) {
+		return p.MaxDelay
+	}
+	return time.Duration(d)
+}
+
+// retrier parks deliveries in per-delay wait queues. Each wait queue holds
+// messages for its TTL and then dead-letters them through the default
+// exchange straight back to the queue they came from, so a retry is seen
+// only by that queue and not by everything bound to the original key.
+type retrier struct {
+	broker Broker
+	policy RetryPolicy
+
+	mu       sync.Mutex
+	ch       Channel
+	chClosed chan *amqp.Error
+	// pub publishes the copies, waiting for the broker to confirm each so
+	// the original is only acked once the copy is safe.
+	pub *ConfirmPublisher
+}
+
+func newRetrier(broker Broker, policy RetryPolicy) *retrier {
+	return &retrier{broker: broker, policy: policy}
+}
+
+// channel returns the retrier's own channel, opening it if needed. Wait
+// queues are declared on it so a failed declare can't close the consumer.
+func (r *retrier) channel() (Channel, error) {
+	if r.ch != nil {
+		select {
+		case <-r.chClosed:
+			r.ch = nil
+		default:
+			return r.ch, nil
+		}
+	}
+	ch, err := r.broker.Channel()
+	if err != nil {
+		return nil, err
+	}
+	r.ch = ch
+	r.chClosed = ch.NotifyClose(make(chan *amqp.Error, 1))
+	return ch, nil
+}
+
+// publisher returns the retrier's confirm publisher, opening it if needed.
+func (r *retrier) publisher() (*ConfirmPublisher, error) {
+	if r.pub == nil {
+		pub, err := NewConfirmPublisher(r.broker)
+		if err != nil {
+			return nil, err
+		}
+		r.pub = pub
+	}
+	return r.pub, nil
+}
+
+// retry schedules delivery, which came from queueName, to be redelivered
+// later, or dead-letters it once it has used up its attempts. It returns
+// once the broker has confirmed the copy, after which the caller still has
+// to ack the original.
+func (r *retrier) retry(queueName string, delivery amqp.Delivery) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ch, err := r.channel()
+	if err != nil {
+		return err
+	}
+	pub, err := r.publisher()
+	if err != nil {
+		return err
+	}
+
+	attempt := 1
+	if n, ok := normalizeArg(delivery.Headers[HeaderRetryAttempts]).(int64); ok {
+		attempt = int(n) + 1
+	}
+
+	headers := amqp.Table{}
+	for k, v := range delivery.Headers {
+		headers[k] = v
+	}
+	if _, ok := headers[HeaderOriginalExchange]; !ok {
+		headers[HeaderOriginalExchange] = delivery.Exchange
+		headers[HeaderOriginalRoutingKey] = delivery.RoutingKey
+	}
+	headers[HeaderOriginalQueue] = queueName
+
+	if attempt > r.policy.MaxAttempts {
+		logging.Logger().Warn("giving up on message", "queue", queueName, "routing_key", delivery.RoutingKey, "attempts", attempt-1)
+		headers[HeaderDeadLetterReason] = ReasonRetriesExhausted
+		key, _ := headers[HeaderOriginalRoutingKey].(string)
+		return pub.PublishWithContext(
+			context.Background(),
+			DeadLetterExchange,
+			key,
+			false,
+			false,
+			republishing(delivery, headers),
+		)
+	}
+
+	delay := r.policy.Delay(attempt)
+	history, _ := headers[HeaderRetryHistory].([]interface{})
+	headers[HeaderRetryAttempts] = int64(attempt)
+	headers[HeaderRetryHistory] = append(append([]interface{}(nil), history...), amqp.Table{
+		"attempt":  int64(attempt),
+		"delay-ms": delay.Milliseconds(),
+		"time":     time.Now().UTC().Truncate(time.Second),
+		"queue":    queueName,
+	})
+
+	waitQueue := fmt.Sprintf("%s.retry.%d", queueName, delay.Milliseconds())
+	_, err = ch.QueueDeclare(waitQueue, true, false, false, false, amqp.Table{
+		"x-message-ttl":             delay.Milliseconds(),
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": queueName,
+		"x-expires":                 (delay + time.Minute).Milliseconds(),
+	})
+	if err != nil {
+		return err
+	}
+
+	logging.Logger().Debug("retrying message", "queue", queueName, "routing_key", delivery.RoutingKey, "delay", delay, "attempt", attempt, "max_attempts", r.policy.MaxAttempts)
+	return pub.PublishWithContext(
+		context.Background(),
+		"",
+		waitQueue,
+		false,
+		false,
+		republishing(delivery, headers),
+	)
+}
+
+func (r *retrier) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ch != nil {
+		r.ch.Close()
+		r.ch = nil
+	}
+	if r.pub != nil {
+		r.pub.Close()
+		r.pub = nil
+	}
+}
+
+// republishing copies a delivery's properties and body for publishing
+// again with the given headers.
+func republishing(delivery amqp.Delivery, headers amqp.Table) amqp.Publishing {
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     delivery.ContentType,
+		ContentEncoding: delivery.ContentEncoding,
+		DeliveryMode:    delivery.DeliveryMode,
+		Priority:        delivery.Priority,
+		CorrelationId:   delivery.CorrelationId,
+		ReplyTo:         delivery.ReplyTo,
+		MessageId:       delivery.MessageId,
+		Timestamp:       delivery.Timestamp,
+		Type:            delivery.Type,
+		AppId:           delivery.AppId,
+		Body:            delivery.Body,
+	}
+}
@@ -0,0 +1,54 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRetryLaterRedeliversThenDeadLetters(t *testing.T) {
+	server, broker := newTestBroker(t)
+	pub := newTestPublisher(t, broker)
+
+	policy := RetryPolicy{
+		InitialDelay: time.Minute,
+		MaxDelay:     time.Hour,
+		Multiplier:   2,
+		MaxAttempts:  2,
+	}
+	deliveries := make(chan int, 4)
+	sub, err := SubscribeJSONEnvelope(context.Background(), broker, testTopic, "retry", "retry.*", Durable, func(msg Message[string]) AckType {
+		deliveries <- msg.DeliveryCount
+		return RetryLater
+	}, WithRetry(policy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	if err := PublishJSON(pub, testTopic, "retry.alice", "later"); err != nil {
+		t.Fatal(err)
+	}
+	if n := receive(t, deliveries); n != 1 {
+		t.Errorf("first delivery count = %d, want 1", n)
+	}
+
+	// Each retry waits out its delay in a queue of its own, which the
+	// server's clock has to be moved past.
+	for attempt := 1; attempt <= policy.MaxAttempts; attempt++ {
+		receiveNothing(t, deliveries)
+		server.Advance(policy.Delay(attempt))
+		if n := receive(t, deliveries); n != attempt+1 {
+			t.Errorf("retry %d delivery count = %d, want %d", attempt, n, attempt+1)
+		}
+	}
+
+	dl := waitForDeadLetters(t, broker, 1)[0]
+	if dl.Reason != ReasonRetriesExhausted {
+		t.Errorf("dead-lettered for %q, want %q", dl.Reason, ReasonRetriesExhausted)
+	}
+	if dl.Exchange != testTopic || dl.RoutingKey != "retry.alice" || dl.Queue != "retry" {
+		t.Errorf("dead letter from %s@%s in %s, want %s@retry.alice in retry", dl.Exchange, dl.RoutingKey, dl.Queue, testTopic)
+	}
+	receiveNothing(t, deliveries)
+}
@@ -0,0 +1,430 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/logging"
+)
+
+// DirectReplyTo is RabbitMQ's pseudo-queue for receiving replies without
+// declaring a queue. The MemoryServer doesn't support it.
+const DirectReplyTo = "amq.rabbitmq.reply-to"
+
+// Headers carrying an error reply.
+const (
+	HeaderRPCErrorCode = "x-rpc-error-code"
+	HeaderRPCError     = "x-rpc-error"
+)
+
+// Error codes sent by Serve itself.
+const (
+	RPCCodeInternal   = "internal"
+	RPCCodeBadRequest = "bad_request"
+)
+
+// ErrRequestTimeout is returned by Request when no reply arrives in time.
+var ErrRequestTimeout = errors.New("pubsub: request timed out")
+
+// RPCError is an error sent back by a Serve handler. Handlers return one to
+// give the caller a code it can act on; any other error reaches the caller
+// with the code RPCCodeInternal.
+type RPCError struct {
+	Code    string
+	Message string
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// RPCOption configures an RPCClient.
+type RPCOption func(*RPCClient)
+
+// WithDirectReplyTo receives replies on DirectReplyTo instead of an
+// exclusive reply queue.
+func WithDirectReplyTo() RPCOption {
+	return func(c *RPCClient) {
+		c.direct = true
+	}
+}
+
+// WithRequestTimeout sets how long Request waits for a reply when its
+// context has no earlier deadline. The default is 5 seconds.
+func WithRequestTimeout(d time.Duration) RPCOption {
+	return func(c *RPCClient) {
+		c.timeout = d
+	}
+}
+
+// RPCClient sends requests and matches replies to them by correlation ID.
+// Any number of requests can be in flight at once.
+type RPCClient struct {
+	broker  Broker
+	timeout time.Duration
+	direct  bool
+
+	mu      sync.Mutex
+	current *rpcChannel
+}
+
+// rpcChannel is one channel's worth of requests. If the channel closes,
+// everything waiting on it fails and the next request opens another.
+type rpcChannel struct {
+	ch      Channel
+	replyTo string
+	// sendMu serialises requests, which may be made from any goroutine.
+	sendMu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[string]chan rpcReply
+	closed  bool
+}
+
+type rpcReply struct {
+	delivery amqp.Delivery
+	err      error
+}
+
+// NewRPCClient opens a channel on broker for sending requests and receiving
+// their replies. Passing a Manager lets it carry on after a reconnect.
+func NewRPCClient(broker Broker, opts ...RPCOption) (*RPCClient, error) {
+	c := &RPCClient{
+		broker:  broker,
+		timeout: 5 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.channel(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// channel returns the open rpcChannel, opening one if needed. c.mu must be
+// held.
+func (c *RPCClient) channel() (*rpcChannel, error) {
+	if c.current != nil && !c.current.isClosed() {
+		return c.current, nil
+	}
+
+	ch, err := c.broker.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	replyTo := DirectReplyTo
+	if !c.direct {
+		queue, err := ch.QueueDeclare("", false, true, true, false, nil)
+		if err != nil {
+			logging.Logger().Error("failed to declare reply queue", "error", err)
+			ch.Close()
+			return nil, err
+		}
+		replyTo = queue.Name
+	}
+
+	deliveries, err := ch.Consume(replyTo, "", true, true, false, false, nil)
+	if err != nil {
+		logging.Logger().Error("failed to consume replies", "queue", replyTo, "error", err)
+		ch.Close()
+		return nil, err
+	}
+
+	rc := &rpcChannel{
+		ch:      ch,
+		replyTo: replyTo,
+		pending: map[string]chan rpcReply{},
+	}
+	returns := ch.NotifyReturn(make(chan amqp.Return, 1))
+	go rc.dispatch(deliveries, returns)
+
+	c.current = rc
+	return rc, nil
+}
+
+// dispatch hands each reply to the request waiting for it. Requests are
+// published as mandatory, so one nobody is serving comes straight back.
+func (rc *rpcChannel) dispatch(deliveries <-chan amqp.Delivery, returns <-chan amqp.Return) {
+	for deliveries != nil || returns != nil {
+		select {
+		case d, ok := <-deliveries:
+			if !ok {
+				deliveries = nil
+				rc.close()
+				continue
+			}
+			rc.resolve(d.CorrelationId, rpcReply{delivery: d})
+		case r, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			rc.resolve(r.CorrelationId, rpcReply{err: &UnroutableError{
+				Exchange:   r.Exchange,
+				RoutingKey: r.RoutingKey,
+				ReplyCode:  r.ReplyCode,
+				ReplyText:  r.ReplyText,
+			}})
+		}
+	}
+}
+
+func (rc *rpcChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	rc.sendMu.Lock()
+	defer rc.sendMu.Unlock()
+	return rc.ch.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+}
+
+func (rc *rpcChannel) expect(id string) (chan rpcReply, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.closed {
+		return nil, false
+	}
+	reply := make(chan rpcReply, 1)
+	rc.pending[id] = reply
+	return reply, true
+}
+
+func (rc *rpcChannel) forget(id string) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	delete(rc.pending, id)
+}
+
+func (rc *rpcChannel) resolve(id string, reply rpcReply) {
+	rc.mu.Lock()
+	waiting, ok := rc.pending[id]
+	delete(rc.pending, id)
+	rc.mu.Unlock()
+
+	if !ok {
+		// The caller has already given up on it.
+		logging.Logger().Debug("dropping reply to unknown request", "correlation_id", id)
+		return
+	}
+	waiting <- reply
+}
+
+func (rc *rpcChannel) isClosed() bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.closed
+}
+
+// close fails every request still waiting on the channel.
+func (rc *rpcChannel) close() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.closed {
+		return
+	}
+	rc.closed = true
+	rc.ch.Close()
+	for id, reply := range rc.pending {
+		reply <- rpcReply{err: amqp.ErrClosed}
+		delete(rc.pending, id)
+	}
+}
+
+// Close closes the client's channel. Requests still waiting fail with
+// amqp.ErrClosed.
+func (c *RPCClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.current != nil {
+		c.current.close()
+		c.current = nil
+	}
+	return nil
+}
+
+// Request publishes req to exchange with key and waits for the reply. It
+// fails with ErrRequestTimeout if none comes before ctx's deadline or the
+// client's timeout, with an *UnroutableError if nothing is serving key, and
+// with an *RPCError if the handler returned an error. req is encoded with
+// the codec chosen by WithCodec, JSON by default.
+func Request[Req, Resp any](ctx context.Context, client *RPCClient, exchange, key string, req Req, opts ...PublishOption) (Resp, error) {
+	var resp Resp
+
+	client.mu.Lock()
+	rc, err := client.channel()
+	client.mu.Unlock()
+	if err != nil {
+		return resp, err
+	}
+
+	correlationID := newMessageID()
+	reply, ok := rc.expect(correlationID)
+	if !ok {
+		return resp, amqp.ErrClosed
+	}
+	defer rc.forget(correlationID)
+
+	ctx, cancel := context.WithTimeout(ctx, client.timeout)
+	defer cancel()
+
+	// Don't leave the request for a server that starts after we've given up.
+	expiration := client.timeout
+	if deadline, ok := ctx.Deadline(); ok {
+		expiration = time.Until(deadline)
+	}
+
+	err = publish(rc, exchange, key, req, append(opts, WithContext(ctx), Mandatory(), func(o *publishOptions) {
+		o.correlationID = correlationID
+		o.replyTo = rc.replyTo
+		o.expiration = strconv.FormatInt(max(expiration.Milliseconds(), 1), 10)
+	}))
+	if err != nil {
+		return resp, err
+	}
+
+	select {
+	case r := <-reply:
+		if r.err != nil {
+			return resp, r.err
+		}
+		if code, ok := r.delivery.Headers[HeaderRPCErrorCode].(string); ok {
+			message, _ := r.delivery.Headers[HeaderRPCError].(string)
+			return resp, &RPCError{Code: code, Message: message}
+		}
+		codec, err := DefaultCodecs.Lookup(r.delivery.ContentType)
+		if err != nil {
+			return resp, err
+		}
+		if err := codec.Unmarshal(r.delivery.Body, &resp); err != nil {
+			return resp, err
+		}
+		return resp, nil
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return resp, ErrRequestTimeout
+		}
+		return resp, ctx.Err()
+	}
+}
+
+// Serve answers requests sent with Request. Each request is decoded with
+// the codec for its content type and the reply is encoded with the same
+// one. Handlers run concurrently if WithConcurrency is given.
+func Serve[Req, Resp any](
+	ctx context.Context,
+	broker Broker,
+	exchange,
+	queueName,
+	key string,
+	simpleQueueType SimpleQueueType,
+	handler func(context.Context, Req) (Resp, error),
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	r := &replier{broker: broker}
+	opts = append(opts, func(o *subscribeOptions) {
+		o.closers = append(o.closers, r.close)
+	})
+
+	return subscribe(
+		ctx,
+		broker,
+		exchange,
+		queueName,
+		key,
+		simpleQueueType,
+		func(ctx context.Context, delivery amqp.Delivery, req Req) AckType {
+			if delivery.ReplyTo == "" {
+				logging.Logger().Warn("discarding request with nowhere to reply", "exchange", delivery.Exchange, "routing_key", delivery.RoutingKey)
+				return NackDiscard
+			}
+
+			resp, err := handler(ctx, req)
+			if err := r.reply(delivery, resp, err); err != nil {
+				logging.Logger().Error("failed to reply", "reply_to", delivery.ReplyTo, "error", err)
+			}
+			return Ack
+		},
+		negotiatedCodec,
+		opts,
+	)
+}
+
+// replier publishes replies on a channel of its own.
+type replier struct {
+	broker Broker
+
+	mu       sync.Mutex
+	ch       Channel
+	chClosed chan *amqp.Error
+}
+
+func (r *replier) reply(request amqp.Delivery, resp any, handlerErr error) error {
+	codec, err := negotiatedCodec(subscribeOptions{codecs: DefaultCodecs}, request.ContentType)
+	if err != nil {
+		codec = JSON
+	}
+
+	msg := amqp.Publishing{
+		ContentType:   codec.ContentType(),
+		CorrelationId: request.CorrelationId,
+		MessageId:     newMessageID(),
+		Timestamp:     time.Now(),
+		AppId:         AppID,
+	}
+	if handlerErr != nil {
+		var rpcErr *RPCError
+		if !errors.As(handlerErr, &rpcErr) {
+			rpcErr = &RPCError{Code: RPCCodeInternal, Message: handlerErr.Error()}
+		}
+		msg.Headers = amqp.Table{
+			HeaderRPCErrorCode: rpcErr.Code,
+			HeaderRPCError:     rpcErr.Message,
+		}
+	} else {
+		msg.Body, err = codec.Marshal(resp)
+		if err != nil {
+			msg.Headers = amqp.Table{
+				HeaderRPCErrorCode: RPCCodeInternal,
+				HeaderRPCError:     err.Error(),
+			}
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.ch != nil {
+		select {
+		case <-r.chClosed:
+			r.ch = nil
+		default:
+		}
+	}
+	if r.ch == nil {
+		ch, err := r.broker.Channel()
+		if err != nil {
+			return err
+		}
+		r.ch = ch
+		r.chClosed = ch.NotifyClose(make(chan *amqp.Error, 1))
+	}
+
+	return r.ch.PublishWithContext(context.Background(), "", request.ReplyTo, false, false, msg)
+}
+
+func (r *replier) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ch != nil {
+		r.ch.Close()
+		r.ch = nil
+	}
+}
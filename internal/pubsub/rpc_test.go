@@ -0,0 +1,67 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentRequestsAreTracedAndCounted(t *testing.T) {
+	_, broker := newTestBroker(t)
+
+	sub, err := Serve(context.Background(), broker, testDirect, "echo", "echo", Transient, func(_ context.Context, s string) (string, error) {
+		return s, nil
+	}, WithConcurrency(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	// A second queue on the key sees the requests as they were sent.
+	traced := make(chan bool, 32)
+	seen, err := SubscribeJSONEnvelope(context.Background(), broker, testDirect, "", "echo", Transient, func(msg Message[string]) AckType {
+		_, ok := msg.Headers[HeaderTraceParent].(string)
+		traced <- ok
+		return Ack
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seen.Close()
+
+	client, err := NewRPCClient(broker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	before := DefaultMetrics.Counter("published_total", testDirect, "echo", "", "")
+	const requests = 16
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			want := fmt.Sprint(i)
+			got, err := Request[string, string](context.Background(), client, testDirect, "echo", want)
+			if err != nil {
+				t.Errorf("request %d: %v", i, err)
+				return
+			}
+			if got != want {
+				t.Errorf("request %d got %q back", i, got)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := 0; i < requests; i++ {
+		if !receive(t, traced) {
+			t.Error("request sent without a traceparent")
+		}
+	}
+	if n := DefaultMetrics.Counter("published_total", testDirect, "echo", "", "") - before; n != requests {
+		t.Errorf("published_total went up by %d, want %d", n, requests)
+	}
+}
@@ -0,0 +1,109 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/logging"
+)
+
+// ScheduledQueuePrefix starts the name of the queue each scheduled message
+// waits in.
+const ScheduledQueuePrefix = "pubsub.scheduled."
+
+// ScheduledMessage is a message that PublishDelayed or PublishAt has handed
+// to the broker to deliver later.
+type ScheduledMessage struct {
+	// ID identifies the message to CancelScheduled, from this process or
+	// any other.
+	ID         string
+	Exchange   string
+	RoutingKey string
+	At         time.Time
+}
+
+// PublishDelayed publishes val to exchange with key once delay has passed.
+//
+// No broker plugin is needed: the message waits in a queue of its own whose
+// TTL is the delay and whose dead letter exchange and routing key are where
+// it is going. When the TTL runs out the broker dead-letters it there, even
+// if this process has gone away. The queue deletes itself a minute later.
+func PublishDelayed[T any](broker Broker, exchange, key string, val T, delay time.Duration, opts ...PublishOption) (ScheduledMessage, error) {
+	if delay < 0 {
+		delay = 0
+	}
+	scheduled := ScheduledMessage{
+		ID:         newMessageID(),
+		Exchange:   exchange,
+		RoutingKey: key,
+		At:         time.Now().Add(delay),
+	}
+
+	ch, err := broker.Channel()
+	if err != nil {
+		logging.Logger().Error("failed to open a channel", "error", err)
+		return ScheduledMessage{}, err
+	}
+	defer ch.Close()
+
+	queueName := ScheduledQueuePrefix + scheduled.ID
+	_, err = ch.QueueDeclare(queueName, true, false, false, false, amqp.Table{
+		"x-message-ttl":             delay.Milliseconds(),
+		"x-dead-letter-exchange":    exchange,
+		"x-dead-letter-routing-key": key,
+		"x-expires":                 (delay + time.Minute).Milliseconds(),
+	})
+	if err != nil {
+		logging.Logger().Error("failed to declare scheduled queue", "queue", queueName, "error", err)
+		return ScheduledMessage{}, err
+	}
+
+	opts = append(opts, func(o *publishOptions) {
+		o.via = queueName
+	})
+	err = publish(ch, exchange, key, val, opts)
+	if err != nil {
+		return ScheduledMessage{}, err
+	}
+	logging.Logger().Debug("scheduled message", "exchange", exchange, "routing_key", key, "id", scheduled.ID, "at", scheduled.At)
+	return scheduled, nil
+}
+
+// PublishAt publishes val to exchange with key at the given time, or
+// straight away if it has passed. It is PublishDelayed with the delay
+// worked out from the local clock.
+func PublishAt[T any](broker Broker, exchange, key string, val T, at time.Time, opts ...PublishOption) (ScheduledMessage, error) {
+	return PublishDelayed(broker, exchange, key, val, time.Until(at), opts...)
+}
+
+// CancelScheduled stops a scheduled message from being delivered. It
+// returns false if the message has already gone or there never was one
+// with that ID.
+func CancelScheduled(broker Broker, id string) (bool, error) {
+	if id == "" || strings.ContainsAny(id, " .") {
+		return false, fmt.Errorf("pubsub: invalid scheduled message ID %q", id)
+	}
+
+	ch, err := broker.Channel()
+	if err != nil {
+		logging.Logger().Error("failed to open a channel", "error", err)
+		return false, err
+	}
+	defer ch.Close()
+
+	n, err := ch.QueuePurge(ScheduledQueuePrefix+id, false)
+	var amqpErr *amqp.Error
+	if errors.As(err, &amqpErr) && amqpErr.Code == amqp.NotFound {
+		// The queue expired after delivering the message.
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	logging.Logger().Debug("cancelled scheduled message", "id", id, "cancelled", n > 0)
+	return n > 0, nil
+}
@@ -0,0 +1,106 @@
+package pubsub
+
+import (
+	"testing"
+	"time"
+)
+
+// hasQueue reports whether the server still has the named queue.
+func hasQueue(server *MemoryServer, name string) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	_, ok := server.queues[name]
+	return ok
+}
+
+func TestPublishDelayedWaitsForTheDelay(t *testing.T) {
+	server, broker := newTestBroker(t)
+	got := collect(t, broker, testTopic, "", "scheduled.*", Transient)
+
+	scheduled, err := PublishDelayed(broker, testTopic, "scheduled.alice", "later", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scheduled.Exchange != testTopic || scheduled.RoutingKey != "scheduled.alice" {
+		t.Errorf("scheduled for %s@%s, want %s@scheduled.alice", scheduled.Exchange, scheduled.RoutingKey, testTopic)
+	}
+
+	receiveNothing(t, got)
+	server.Advance(59 * time.Minute)
+	receiveNothing(t, got)
+	server.Advance(time.Minute)
+	if v := receive(t, got); v != "later" {
+		t.Errorf("got %q, want %q", v, "later")
+	}
+
+	// Its queue goes away once it's done with.
+	queue := ScheduledQueuePrefix + scheduled.ID
+	if !hasQueue(server, queue) {
+		t.Fatalf("%s was deleted as soon as it delivered", queue)
+	}
+	server.Advance(time.Minute)
+	if hasQueue(server, queue) {
+		t.Errorf("%s still exists a minute after delivering", queue)
+	}
+}
+
+func TestPublishAt(t *testing.T) {
+	server, broker := newTestBroker(t)
+	got := collect(t, broker, testTopic, "", "scheduled.*", Transient)
+
+	if _, err := PublishAt(broker, testTopic, "scheduled.alice", "overdue", time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if v := receive(t, got); v != "overdue" {
+		t.Errorf("got %q, want %q straight away", v, "overdue")
+	}
+
+	if _, err := PublishAt(broker, testTopic, "scheduled.alice", "on time", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	receiveNothing(t, got)
+	server.Advance(time.Hour)
+	if v := receive(t, got); v != "on time" {
+		t.Errorf("got %q, want %q", v, "on time")
+	}
+}
+
+func TestCancelScheduled(t *testing.T) {
+	server, broker := newTestBroker(t)
+	got := collect(t, broker, testTopic, "", "scheduled.*", Transient)
+
+	cancelled, err := PublishDelayed(broker, testTopic, "scheduled.alice", "cancelled", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, err := PublishDelayed(broker, testTopic, "scheduled.bob", "kept", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err := CancelScheduled(broker, cancelled.ID)
+	if err != nil || !ok {
+		t.Fatalf("CancelScheduled = %v, %v, want true", ok, err)
+	}
+	ok, err = CancelScheduled(broker, cancelled.ID)
+	if err != nil || ok {
+		t.Errorf("second CancelScheduled = %v, %v, want false", ok, err)
+	}
+
+	server.Advance(time.Hour)
+	if v := receive(t, got); v != "kept" {
+		t.Errorf("got %q, want %q", v, "kept")
+	}
+	receiveNothing(t, got)
+
+	// Too late once it's been delivered and its queue has expired.
+	server.Advance(time.Minute)
+	ok, err = CancelScheduled(broker, kept.ID)
+	if err != nil || ok {
+		t.Errorf("CancelScheduled after delivery = %v, %v, want false", ok, err)
+	}
+
+	if _, err := CancelScheduled(broker, "not.an.id"); err == nil {
+		t.Error("CancelScheduled accepted an ID with dots in it")
+	}
+}
@@ -0,0 +1,226 @@
+package pubsub
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// newSTOMPBroker starts a STOMP server in front of a memory server with
+// testTopology applied, and returns a connection to each.
+func newSTOMPBroker(t *testing.T) (amqpBroker, stompBroker Broker) {
+	t.Helper()
+	server, amqpBroker := newTestBroker(t)
+
+	stompServer := NewSTOMPServer(server.Dial)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go stompServer.Serve(l)
+	t.Cleanup(func() { stompServer.Close() })
+
+	stompBroker, err = DialSTOMP("stomp://guest:guest@" + l.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { stompBroker.Close() })
+	return amqpBroker, stompBroker
+}
+
+func TestSTOMPPublishSubscribe(t *testing.T) {
+	amqpBroker, stompBroker := newSTOMPBroker(t)
+	overSTOMP := collect(t, stompBroker, testTopic, "", "army_moves.*", Transient)
+	overAMQP := collect(t, amqpBroker, testTopic, "", "army_moves.*", Transient)
+
+	pub := newTestPublisher(t, stompBroker)
+	if err := PublishJSON(pub, testTopic, "army_moves.alice", "from stomp"); err != nil {
+		t.Fatal(err)
+	}
+	if v := receive(t, overSTOMP); v != "from stomp" {
+		t.Errorf("STOMP subscriber got %q, want %q", v, "from stomp")
+	}
+	if v := receive(t, overAMQP); v != "from stomp" {
+		t.Errorf("AMQP subscriber got %q, want %q", v, "from stomp")
+	}
+
+	if err := PublishJSON(newTestPublisher(t, amqpBroker), testTopic, "army_moves.bob", "from amqp"); err != nil {
+		t.Fatal(err)
+	}
+	if v := receive(t, overSTOMP); v != "from amqp" {
+		t.Errorf("STOMP subscriber got %q, want %q", v, "from amqp")
+	}
+	receive(t, overAMQP)
+	receiveNothing(t, overSTOMP)
+}
+
+func TestSTOMPNackRequeueRedelivers(t *testing.T) {
+	amqpBroker, stompBroker := newSTOMPBroker(t)
+
+	type delivery struct {
+		body        string
+		redelivered bool
+	}
+	got := make(chan delivery, 4)
+	sub, err := SubscribeJSONEnvelope(context.Background(), stompBroker, testTopic, "requeue", "requeue.*", Durable, func(msg Message[string]) AckType {
+		got <- delivery{msg.Body, msg.Redelivered}
+		if !msg.Redelivered {
+			return NackRequeue
+		}
+		return Ack
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	if err := PublishJSON(newTestPublisher(t, stompBroker), testTopic, "requeue.alice", "again"); err != nil {
+		t.Fatal(err)
+	}
+	if d := receive(t, got); d.body != "again" || d.redelivered {
+		t.Errorf("first delivery = %+v, want %q not redelivered", d, "again")
+	}
+	if d := receive(t, got); d.body != "again" || !d.redelivered {
+		t.Errorf("second delivery = %+v, want %q redelivered", d, "again")
+	}
+	receiveNothing(t, got)
+
+	// Acked, it's gone from the queue. The DISCONNECT is receipted once
+	// the server has seen the ACK.
+	sub.Close()
+	if err := stompBroker.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ch, err := amqpBroker.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	if _, ok, err := ch.Get("requeue", true); err != nil || ok {
+		t.Errorf("Get after the ack = %v, %v, want an empty queue", ok, err)
+	}
+}
+
+func TestSTOMPNackDiscardDeadLetters(t *testing.T) {
+	amqpBroker, stompBroker := newSTOMPBroker(t)
+
+	handled := make(chan string, 1)
+	sub, err := SubscribeJSON(context.Background(), stompBroker, testTopic, "discard", "discard.*", Durable, func(s string) AckType {
+		handled <- s
+		return NackDiscard
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	if err := PublishJSON(newTestPublisher(t, stompBroker), testTopic, "discard.alice", "unwanted"); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, handled)
+	sub.Close()
+
+	dead := waitForDeadLetters(t, amqpBroker, 1)
+	if dead[0].Queue != "discard" || dead[0].Reason != "rejected" {
+		t.Errorf("dead letter from %s for %q, want from discard for %q", dead[0].Queue, dead[0].Reason, "rejected")
+	}
+}
+
+func TestSTOMPReceiptsConfirmPublishes(t *testing.T) {
+	amqpBroker, stompBroker := newSTOMPBroker(t)
+
+	ch, err := amqpBroker.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	if _, err := ch.QueueDeclare("confirmed", false, true, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.QueueBind("confirmed", "confirmed.*", testTopic, false, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	stompCh, err := stompBroker.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stompCh.Close()
+	if err := stompCh.Confirm(false); err != nil {
+		t.Fatal(err)
+	}
+	confirms := stompCh.NotifyPublish(make(chan amqp.Confirmation, 2))
+
+	for _, body := range []string{"first", "second"} {
+		err := stompCh.PublishWithContext(context.Background(), testTopic, "confirmed.alice", false, false, amqp.Publishing{Body: []byte(body)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for tag := uint64(1); tag <= 2; tag++ {
+		if c := receive(t, confirms); c.DeliveryTag != tag || !c.Ack {
+			t.Fatalf("confirmation %+v, want an ack of %d", c, tag)
+		}
+	}
+
+	// A receipt means the server has routed the message.
+	for _, want := range []string{"first", "second"} {
+		d, ok, err := ch.Get("confirmed", true)
+		if err != nil || !ok {
+			t.Fatalf("Get after the confirm = %v, %v", ok, err)
+		}
+		if string(d.Body) != want {
+			t.Errorf("got %q, want %q", d.Body, want)
+		}
+	}
+}
+
+func TestSTOMPGivesUpWithoutAReceipt(t *testing.T) {
+	defer func(d time.Duration) { stompReceiptTimeout = d }(stompReceiptTimeout)
+	stompReceiptTimeout = 50 * time.Millisecond
+
+	// This server accepts the connection and then ignores everything.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		if _, err := readStompFrame(r); err != nil {
+			return
+		}
+		writeStompFrame(conn, newStompFrame("CONNECTED", "version", "1.2"))
+		for {
+			if _, err := readStompFrame(r); err != nil {
+				return
+			}
+		}
+	}()
+
+	broker, err := DialSTOMP("stomp://" + l.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := broker.NotifyClose(make(chan *amqp.Error, 1))
+	ch, err := broker.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ch.Consume("queue", "", false, false, false, false, nil); err == nil {
+		t.Fatal("Consume succeeded without a receipt")
+	}
+	if err := receive(t, closed); err == nil {
+		t.Error("connection closed cleanly, want an error")
+	}
+}
@@ -0,0 +1,131 @@
+package pubsub
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// stompFrame is a STOMP 1.2 frame.
+type stompFrame struct {
+	command string
+	headers map[string]string
+	body    []byte
+}
+
+func newStompFrame(command string, headers ...string) *stompFrame {
+	f := &stompFrame{command: command, headers: map[string]string{}}
+	for i := 0; i+1 < len(headers); i += 2 {
+		f.headers[headers[i]] = headers[i+1]
+	}
+	return f
+}
+
+var (
+	stompEscaper   = strings.NewReplacer("\\", "\\\\", "\r", "\\r", "\n", "\\n", ":", "\\c")
+	stompUnescaper = strings.NewReplacer("\\\\", "\\", "\\r", "\r", "\\n", "\n", "\\c", ":")
+)
+
+// escapes reports whether the frame's headers are escaped. CONNECT and
+// CONNECTED frames predate escaping and are left alone.
+func (f *stompFrame) escapes() bool {
+	return f.command != "CONNECT" && f.command != "CONNECTED"
+}
+
+// writeStompFrame writes f to w. Headers are written in order so frames are
+// easy to compare, and content-length is always set so bodies may hold
+// NULs.
+func writeStompFrame(w io.Writer, f *stompFrame) error {
+	var b bytes.Buffer
+	b.WriteString(f.command)
+	b.WriteByte('\n')
+
+	keys := make([]string, 0, len(f.headers))
+	for k := range f.headers {
+		if k != "content-length" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := f.headers[k]
+		if f.escapes() {
+			k, v = stompEscaper.Replace(k), stompEscaper.Replace(v)
+		}
+		fmt.Fprintf(&b, "%s:%s\n", k, v)
+	}
+	if len(f.body) > 0 || f.command == "SEND" || f.command == "MESSAGE" {
+		fmt.Fprintf(&b, "content-length:%d\n", len(f.body))
+	}
+	b.WriteByte('\n')
+	b.Write(f.body)
+	b.WriteByte(0)
+
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// readStompFrame reads the next frame from r, skipping heart-beats.
+func readStompFrame(r *bufio.Reader) (*stompFrame, error) {
+	var command string
+	for command == "" {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		command = strings.TrimRight(line, "\r\n")
+	}
+
+	f := newStompFrame(command)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		k, v, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("pubsub: malformed STOMP header %q", line)
+		}
+		if f.escapes() {
+			k, v = stompUnescaper.Replace(k), stompUnescaper.Replace(v)
+		}
+		// The first of a repeated header wins.
+		if _, seen := f.headers[k]; !seen {
+			f.headers[k] = v
+		}
+	}
+
+	if cl, ok := f.headers["content-length"]; ok {
+		n, err := strconv.Atoi(cl)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("pubsub: bad STOMP content-length %q", cl)
+		}
+		f.body = make([]byte, n)
+		if _, err := io.ReadFull(r, f.body); err != nil {
+			return nil, err
+		}
+		nul, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if nul != 0 {
+			return nil, fmt.Errorf("pubsub: STOMP frame body longer than its content-length")
+		}
+		return f, nil
+	}
+
+	body, err := r.ReadBytes(0)
+	if err != nil {
+		return nil, err
+	}
+	f.body = body[:len(body)-1]
+	return f, nil
+}
@@ -0,0 +1,57 @@
+package pubsub
+
+import (
+	"fmt"
+	"strings"
+)
+
+// STOMP destinations follow RabbitMQ's STOMP plugin: /exchange/<name>/<key>
+// for an exchange and routing key or binding pattern, /queue/<name> for a
+// queue declared on first use, /amq/queue/<name> for a queue that must
+// already exist and /topic/<key> for amq.topic.
+const (
+	stompExchangePrefix = "/exchange/"
+	stompQueuePrefix    = "/queue/"
+	stompAMQQueuePrefix = "/amq/queue/"
+	stompTopicPrefix    = "/topic/"
+)
+
+var (
+	stompNameEscaper   = strings.NewReplacer("%", "%25", "/", "%2F")
+	stompNameUnescaper = strings.NewReplacer("%2F", "/", "%2f", "/", "%25", "%")
+)
+
+// stompExchangeDestination names exchange and key as a STOMP destination.
+func stompExchangeDestination(exchange, key string) string {
+	if exchange == "" {
+		return stompAMQQueuePrefix + stompNameEscaper.Replace(key)
+	}
+	return stompExchangePrefix + stompNameEscaper.Replace(exchange) + "/" + stompNameEscaper.Replace(key)
+}
+
+// stompQueueDestination names a queue that SEND or SUBSCRIBE declares with
+// the headers from textQueueHeaders.
+func stompQueueDestination(queue string) string {
+	return stompQueuePrefix + stompNameEscaper.Replace(queue)
+}
+
+// parseStompDestination splits a destination into the exchange and routing
+// key it stands for. Queue destinations go through the default exchange,
+// so their key is the queue name.
+func parseStompDestination(dest string) (exchange, key string, err error) {
+	switch {
+	case strings.HasPrefix(dest, stompExchangePrefix):
+		exchange, key, _ = strings.Cut(strings.TrimPrefix(dest, stompExchangePrefix), "/")
+		if exchange == "" {
+			break
+		}
+		return stompNameUnescaper.Replace(exchange), stompNameUnescaper.Replace(key), nil
+	case strings.HasPrefix(dest, stompAMQQueuePrefix):
+		return "", stompNameUnescaper.Replace(strings.TrimPrefix(dest, stompAMQQueuePrefix)), nil
+	case strings.HasPrefix(dest, stompQueuePrefix):
+		return "", stompNameUnescaper.Replace(strings.TrimPrefix(dest, stompQueuePrefix)), nil
+	case strings.HasPrefix(dest, stompTopicPrefix):
+		return "amq.topic", strings.TrimPrefix(dest, stompTopicPrefix), nil
+	}
+	return "", "", fmt.Errorf("pubsub: unsupported STOMP destination %q", dest)
+}
@@ -0,0 +1,448 @@
+package pubsub
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// STOMPServer is a small STOMP 1.2 server that carries each connection's
+// frames to a Broker, such as a connection to a MemoryServer. It accepts
+// the frames a DialSTOMP connection sends and the destinations described
+// there, which is enough to try out and test the STOMP transport without
+// a RabbitMQ server. Transactions aren't supported.
+type STOMPServer struct {
+	dial func() (Broker, error)
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+}
+
+// NewSTOMPServer returns a server that opens a connection with dial for
+// each STOMP client.
+func NewSTOMPServer(dial func() (Broker, error)) *STOMPServer {
+	return &STOMPServer{
+		dial:      dial,
+		listeners: map[net.Listener]struct{}{},
+		conns:     map[net.Conn]struct{}{},
+	}
+}
+
+// Serve accepts STOMP connections on l until it fails or the server is
+// closed.
+func (s *STOMPServer) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return net.ErrClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return net.ErrClosed
+		}
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		go func() {
+			defer func() {
+				s.mu.Lock()
+				delete(s.conns, conn)
+				s.mu.Unlock()
+			}()
+			newStompSession(conn).serve(s.dial)
+		}()
+	}
+}
+
+// Close stops listening and drops every connection.
+func (s *STOMPServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return nil
+}
+
+// stompSession is one client's connection to a STOMPServer. Messages are
+// published on a single confirm mode channel, and each subscription has a
+// channel of its own so that UNSUBSCRIBE requeues what it hasn't acked.
+type stompSession struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+
+	broker   Broker
+	pub      Channel
+	confirms chan amqp.Confirmation
+
+	mu   sync.Mutex
+	subs map[string]*stompServerSub
+}
+
+type stompServerSub struct {
+	ch   Channel
+	ack  string
+	acks map[string]amqp.Delivery
+}
+
+// stompFrameError is a client error, which the server reports with an
+// ERROR frame before hanging up.
+type stompFrameError struct {
+	message string
+}
+
+func (e *stompFrameError) Error() string {
+	return e.message
+}
+
+func stompFrameErrorf(format string, args ...interface{}) error {
+	return &stompFrameError{message: fmt.Sprintf(format, args...)}
+}
+
+func newStompSession(conn net.Conn) *stompSession {
+	return &stompSession{
+		conn: conn,
+		subs: map[string]*stompServerSub{},
+	}
+}
+
+func (ss *stompSession) write(f *stompFrame) error {
+	ss.writeMu.Lock()
+	defer ss.writeMu.Unlock()
+	return writeStompFrame(ss.conn, f)
+}
+
+// fail sends an ERROR frame about the frame that caused err.
+func (ss *stompSession) fail(f *stompFrame, err error) {
+	e := newStompFrame("ERROR", "message", err.Error())
+	if f != nil && f.headers["receipt"] != "" {
+		e.headers["receipt-id"] = f.headers["receipt"]
+	}
+	ss.write(e)
+}
+
+func (ss *stompSession) serve(dial func() (Broker, error)) {
+	defer ss.conn.Close()
+	r := bufio.NewReader(ss.conn)
+
+	f, err := readStompFrame(r)
+	if err != nil {
+		return
+	}
+	if f.command != "CONNECT" && f.command != "STOMP" {
+		ss.fail(f, stompFrameErrorf("expected CONNECT, got %s", f.command))
+		return
+	}
+	if !strings.Contains(","+f.headers["accept-version"]+",", ",1.2,") {
+		ss.fail(f, stompFrameErrorf("only STOMP 1.2 is supported"))
+		return
+	}
+
+	ss.broker, err = dial()
+	if err != nil {
+		ss.fail(f, err)
+		return
+	}
+	defer ss.close()
+	go func() {
+		if err, ok := <-ss.broker.NotifyClose(make(chan *amqp.Error, 1)); ok {
+			ss.fail(nil, err)
+			ss.conn.Close()
+		}
+	}()
+
+	err = ss.write(newStompFrame("CONNECTED",
+		"version", "1.2",
+		"heart-beat", "0,0",
+		"server", "peril-stomp",
+	))
+	if err != nil {
+		return
+	}
+
+	for {
+		f, err := readStompFrame(r)
+		if err != nil {
+			return
+		}
+		if err := ss.handle(f); err != nil {
+			ss.fail(f, err)
+			return
+		}
+		if receipt := f.headers["receipt"]; receipt != "" {
+			if err := ss.write(newStompFrame("RECEIPT", "receipt-id", receipt)); err != nil {
+				return
+			}
+		}
+		if f.command == "DISCONNECT" {
+			return
+		}
+	}
+}
+
+// close cancels the session's subscriptions, which requeues whatever they
+// hadn't acked, and closes its connection to the broker.
+func (ss *stompSession) close() {
+	ss.mu.Lock()
+	for id, sub := range ss.subs {
+		sub.ch.Close()
+		delete(ss.subs, id)
+	}
+	ss.mu.Unlock()
+	ss.broker.Close()
+}
+
+func (ss *stompSession) handle(f *stompFrame) error {
+	switch f.command {
+	case "SEND":
+		return ss.send(f)
+	case "SUBSCRIBE":
+		return ss.subscribe(f)
+	case "UNSUBSCRIBE":
+		return ss.unsubscribe(f)
+	case "ACK", "NACK":
+		return ss.settle(f)
+	case "DISCONNECT":
+		return nil
+	}
+	return stompFrameErrorf("unsupported frame %s", f.command)
+}
+
+// declare declares the queue a /queue/ destination names. Like RabbitMQ,
+// such queues are durable unless the headers say otherwise.
+func (ss *stompSession) declare(ch Channel, name string, h map[string]string, defaults declaredQueue) error {
+	q := textQueueArgs(h, defaults)
+	_, err := ch.QueueDeclare(name, q.durable, q.autoDelete, q.exclusive, false, q.args)
+	return err
+}
+
+func (ss *stompSession) send(f *stompFrame) error {
+	dest := f.headers["destination"]
+	exchange, key, err := parseStompDestination(dest)
+	if err != nil {
+		return err
+	}
+
+	if ss.pub == nil {
+		ch, err := ss.broker.Channel()
+		if err != nil {
+			return err
+		}
+		if err := ch.Confirm(false); err != nil {
+			ch.Close()
+			return err
+		}
+		ss.pub = ch
+		ss.confirms = ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+	}
+	// A failed declare or publish closes the channel, so the next SEND
+	// opens another.
+	fail := func(err error) error {
+		ss.pub.Close()
+		ss.pub = nil
+		return err
+	}
+
+	if strings.HasPrefix(dest, stompQueuePrefix) {
+		if err := ss.declare(ss.pub, key, f.headers, declaredQueue{durable: true}); err != nil {
+			return fail(err)
+		}
+	}
+
+	msg := textPublishing(f.headers, f.body)
+	err = ss.pub.PublishWithContext(context.Background(), exchange, key, false, false, msg)
+	if err != nil {
+		return fail(err)
+	}
+	confirm, ok := <-ss.confirms
+	if !ok {
+		return fail(amqp.ErrClosed)
+	}
+	if !confirm.Ack {
+		return fail(ErrNacked)
+	}
+	return nil
+}
+
+func (ss *stompSession) subscribe(f *stompFrame) error {
+	id := f.headers["id"]
+	if id == "" {
+		return stompFrameErrorf("SUBSCRIBE without an id")
+	}
+	ss.mu.Lock()
+	_, exists := ss.subs[id]
+	ss.mu.Unlock()
+	if exists {
+		return stompFrameErrorf("subscription %s already exists", id)
+	}
+
+	ackMode := f.headers["ack"]
+	switch ackMode {
+	case "":
+		ackMode = "auto"
+	case "auto", "client", "client-individual":
+	default:
+		return stompFrameErrorf("unknown ack mode %q", ackMode)
+	}
+
+	dest := f.headers["destination"]
+	exchange, key, err := parseStompDestination(dest)
+	if err != nil {
+		return err
+	}
+
+	ch, err := ss.broker.Channel()
+	if err != nil {
+		return err
+	}
+	queue := key
+	switch {
+	case strings.HasPrefix(dest, stompQueuePrefix):
+		err = ss.declare(ch, queue, f.headers, declaredQueue{durable: true})
+	case exchange != "":
+		// Without a name the queue is the subscription's alone.
+		queue = f.headers["x-queue-name"]
+		defaults := declaredQueue{durable: true}
+		if queue == "" {
+			queue = "stomp-subscription-" + newMessageID()
+			defaults = declaredQueue{autoDelete: true, exclusive: true}
+		}
+		err = ss.declare(ch, queue, f.headers, defaults)
+		if err == nil {
+			err = ch.QueueBind(queue, key, exchange, false, nil)
+		}
+	}
+	if err == nil && f.headers["prefetch-count"] != "" {
+		var prefetch int
+		prefetch, err = strconv.Atoi(f.headers["prefetch-count"])
+		if err == nil {
+			err = ch.Qos(prefetch, 0, false)
+		}
+	}
+	var deliveries <-chan amqp.Delivery
+	if err == nil {
+		deliveries, err = ch.Consume(queue, id, ackMode == "auto", false, false, false, nil)
+	}
+	if err != nil {
+		ch.Close()
+		return err
+	}
+
+	sub := &stompServerSub{ch: ch, ack: ackMode, acks: map[string]amqp.Delivery{}}
+	ss.mu.Lock()
+	ss.subs[id] = sub
+	ss.mu.Unlock()
+
+	go func() {
+		for delivery := range deliveries {
+			msg := textHeaders(republishing(delivery, delivery.Headers))
+			msg["subscription"] = id
+			msg["destination"] = stompExchangeDestination(delivery.Exchange, delivery.RoutingKey)
+			msg["message-id"] = fmt.Sprintf("%s-%d", id, delivery.DeliveryTag)
+			if delivery.Redelivered {
+				msg["redelivered"] = "true"
+			}
+			if ackMode != "auto" {
+				msg["ack"] = msg["message-id"]
+				ss.mu.Lock()
+				sub.acks[msg["ack"]] = delivery
+				ss.mu.Unlock()
+			}
+
+			err := ss.write(&stompFrame{command: "MESSAGE", headers: msg, body: delivery.Body})
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (ss *stompSession) unsubscribe(f *stompFrame) error {
+	id := f.headers["id"]
+	ss.mu.Lock()
+	sub, ok := ss.subs[id]
+	delete(ss.subs, id)
+	ss.mu.Unlock()
+	if !ok {
+		return stompFrameErrorf("no subscription %s", id)
+	}
+	if err := sub.ch.Close(); err != nil && !errors.Is(err, amqp.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+// settle acks or nacks the message an ACK or NACK frame names. In client
+// ack mode that settles every earlier message of the subscription too.
+func (ss *stompSession) settle(f *stompFrame) error {
+	id := f.headers["id"]
+	subID, _, _ := cutLast(id, "-")
+
+	ss.mu.Lock()
+	sub, ok := ss.subs[subID]
+	var delivery amqp.Delivery
+	if ok {
+		delivery, ok = sub.acks[id]
+	}
+	multiple := false
+	if ok {
+		delete(sub.acks, id)
+		if sub.ack == "client" {
+			multiple = true
+			for ackID, d := range sub.acks {
+				if d.DeliveryTag < delivery.DeliveryTag {
+					delete(sub.acks, ackID)
+				}
+			}
+		}
+	}
+	ss.mu.Unlock()
+	if !ok {
+		return stompFrameErrorf("no message to %s with id %q", strings.ToLower(f.command), id)
+	}
+
+	if f.command == "ACK" {
+		return delivery.Ack(multiple)
+	}
+	return delivery.Nack(multiple, f.headers["requeue"] != "false")
+}
+
+// cutLast is strings.Cut around the last instance of sep.
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
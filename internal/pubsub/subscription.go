@@ -0,0 +1,127 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// ErrSubscriptionLost is returned by Subscription.Wait when deliveries
+// stopped for a reason the broker didn't explain, such as the queue being
+// deleted.
+var ErrSubscriptionLost = errors.New("pubsub: subscription lost")
+
+// Subscription is a handle on a running consumer started by Subscribe,
+// SubscribeJSON or SubscribeGob.
+type Subscription struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+	forget  func()
+	retrier *retrier
+	closers []func()
+
+	mu      sync.Mutex
+	ch      Channel
+	chClose chan *amqp.Error
+	queue   string
+	err     error
+
+	poisoned atomic.Uint64
+}
+
+func newSubscription(ctx context.Context) *Subscription {
+	ctx, cancel := context.WithCancel(ctx)
+	return &Subscription{
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+}
+
+// Close stops taking new deliveries, waits for the handlers to finish the
+// ones they are working on and closes the subscription's channel. Deliveries
+// that were prefetched but not handled go back to the queue.
+func (s *Subscription) Close() error {
+	s.cancel()
+	<-s.done
+	return nil
+}
+
+// Wait blocks until the subscription stops and returns the error that
+// stopped it, or nil if it was closed or its context was cancelled.
+func (s *Subscription) Wait() error {
+	<-s.done
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Done is closed once the subscription has stopped.
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// PoisonCount returns how many deliveries failed to decode.
+func (s *Subscription) PoisonCount() uint64 {
+	return s.poisoned.Load()
+}
+
+func (s *Subscription) setChannel(ch Channel, queue string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ch = ch
+	s.chClose = ch.NotifyClose(make(chan *amqp.Error, 1))
+	s.queue = queue
+}
+
+func (s *Subscription) queueName() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queue
+}
+
+// lost records why the current channel stopped delivering.
+func (s *Subscription) lost() {
+	s.mu.Lock()
+	chClose := s.chClose
+	s.mu.Unlock()
+
+	err := ErrSubscriptionLost
+	select {
+	case amqpErr, ok := <-chClose:
+		if ok && amqpErr != nil {
+			err = amqpErr
+		}
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+}
+
+func (s *Subscription) stop() {
+	s.mu.Lock()
+	ch := s.ch
+	s.mu.Unlock()
+
+	if ch != nil {
+		ch.Close()
+	}
+	if s.retrier != nil {
+		s.retrier.close()
+	}
+	for _, c := range s.closers {
+		c()
+	}
+	if s.forget != nil {
+		s.forget()
+	}
+	s.cancel()
+	close(s.done)
+}
@@ -0,0 +1,69 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCloseWaitsForHandlers(t *testing.T) {
+	_, broker := newTestBroker(t)
+
+	started := make(chan string, 4)
+	release := make(chan struct{})
+	sub, err := SubscribeJSON(context.Background(), broker, testTopic, "drain", "drain.*", Durable, func(s string) AckType {
+		started <- s
+		<-release
+		return Ack
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub := newTestPublisher(t, broker)
+	if err := PublishJSON(pub, testTopic, "drain.alice", "in flight"); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, started)
+
+	closed := make(chan error, 1)
+	go func() { closed <- sub.Close() }()
+	waited := make(chan error, 1)
+	go func() { waited <- sub.Wait() }()
+	receiveNothing(t, closed)
+	receiveNothing(t, waited)
+	select {
+	case <-sub.Done():
+		t.Fatal("Done closed while a handler was still running")
+	default:
+	}
+
+	close(release)
+	if err := receive(t, closed); err != nil {
+		t.Errorf("Close = %v", err)
+	}
+	if err := receive(t, waited); err != nil {
+		t.Errorf("Wait = %v, want nil after Close", err)
+	}
+
+	// Nothing is delivered once it's closed, so a later message stays in
+	// the queue.
+	if err := PublishJSON(pub, testTopic, "drain.alice", "after close"); err != nil {
+		t.Fatal(err)
+	}
+	receiveNothing(t, started)
+	ch, err := broker.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	d, ok, err := ch.Get("drain", true)
+	if err != nil || !ok {
+		t.Fatalf("Get after Close = %v, %v, want the later message", ok, err)
+	}
+	if string(d.Body) != `"after close"` {
+		t.Errorf("got %s, want %q", d.Body, "after close")
+	}
+	if _, ok, _ := ch.Get("drain", true); ok {
+		t.Error("the handled message was left in the queue")
+	}
+}
@@ -0,0 +1,207 @@
+package pubsub
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// declaredQueue is a queue declared on a STOMP or MQTT channel. Neither
+// protocol can declare or bind a queue by itself, so the declaration is
+// remembered and sent as headers with the message or subscription that
+// first uses the queue.
+type declaredQueue struct {
+	durable    bool
+	autoDelete bool
+	exclusive  bool
+	args       amqp.Table
+	bindings   []declaredBinding
+}
+
+type declaredBinding struct {
+	exchange string
+	key      string
+}
+
+// textPropertyHeaders are the text headers that carry AMQP message
+// properties, rather than application headers.
+var textPropertyHeaders = map[string]bool{
+	"content-type":     true,
+	"content-encoding": true,
+	"correlation-id":   true,
+	"reply-to":         true,
+	"expiration":       true,
+	"amqp-message-id":  true,
+	"priority":         true,
+	"timestamp":        true,
+	"type":             true,
+	"user-id":          true,
+	"app-id":           true,
+	"persistent":       true,
+}
+
+// textHeaders turns a message's properties and headers into string
+// headers, for STOMP headers and MQTT user properties. Other header values
+// are formatted, so tables and arrays don't survive the trip intact.
+func textHeaders(msg amqp.Publishing) map[string]string {
+	h := map[string]string{}
+	for k, v := range msg.Headers {
+		if textPropertyHeaders[k] || isTransportHeader(k) || textQueueArgNames[k] {
+			continue
+		}
+		switch v := v.(type) {
+		case string:
+			h[k] = v
+		case time.Time:
+			h[k] = v.UTC().Format(time.RFC3339)
+		default:
+			h[k] = fmt.Sprint(v)
+		}
+	}
+
+	set := func(k, v string) {
+		if v != "" {
+			h[k] = v
+		}
+	}
+	set("content-type", msg.ContentType)
+	set("content-encoding", msg.ContentEncoding)
+	set("correlation-id", msg.CorrelationId)
+	set("reply-to", msg.ReplyTo)
+	set("expiration", msg.Expiration)
+	set("amqp-message-id", msg.MessageId)
+	set("type", msg.Type)
+	set("user-id", msg.UserId)
+	set("app-id", msg.AppId)
+	if msg.Priority != 0 {
+		h["priority"] = strconv.Itoa(int(msg.Priority))
+	}
+	if !msg.Timestamp.IsZero() {
+		h["timestamp"] = strconv.FormatInt(msg.Timestamp.Unix(), 10)
+	}
+	if msg.DeliveryMode == amqp.Persistent {
+		h["persistent"] = "true"
+	}
+	return h
+}
+
+// textPublishing is the inverse of textHeaders. Application headers that
+// look like integers and start with x- come back as int64, which is what
+// this package stores its own counts as.
+func textPublishing(h map[string]string, body []byte) amqp.Publishing {
+	msg := amqp.Publishing{
+		ContentType:     h["content-type"],
+		ContentEncoding: h["content-encoding"],
+		CorrelationId:   h["correlation-id"],
+		ReplyTo:         h["reply-to"],
+		Expiration:      h["expiration"],
+		MessageId:       h["amqp-message-id"],
+		Type:            h["type"],
+		UserId:          h["user-id"],
+		AppId:           h["app-id"],
+		Body:            body,
+	}
+	if p, err := strconv.Atoi(h["priority"]); err == nil {
+		msg.Priority = uint8(p)
+	}
+	if ts, err := strconv.ParseInt(h["timestamp"], 10, 64); err == nil {
+		msg.Timestamp = time.Unix(ts, 0)
+	}
+	if h["persistent"] == "true" {
+		msg.DeliveryMode = amqp.Persistent
+	}
+
+	for k, v := range h {
+		if textPropertyHeaders[k] || isTransportHeader(k) || textQueueArgNames[k] {
+			continue
+		}
+		if msg.Headers == nil {
+			msg.Headers = amqp.Table{}
+		}
+		if strings.HasPrefix(k, "x-") {
+			if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+				msg.Headers[k] = n
+				continue
+			}
+		}
+		msg.Headers[k] = v
+	}
+	return msg
+}
+
+// isTransportHeader reports whether k is a header STOMP itself uses, the
+// exchange of an MQTT message or subscription, or one of the flags of a
+// queue declared along with a message or subscription.
+func isTransportHeader(k string) bool {
+	switch k {
+	case "destination", "subscription", "message-id", "ack", "receipt",
+		"receipt-id", "content-length", "redelivered", "id", "exchange",
+		"durable", "auto-delete", "exclusive", "prefetch-count", "x-queue-name":
+		return true
+	}
+	return false
+}
+
+// textQueueArgNames are the queue arguments that may be given as headers
+// on a message or subscription that declares a queue. They share the x- prefix
+// with message headers, so only these are taken as arguments.
+var textQueueArgNames = map[string]bool{
+	"x-queue-type":              true,
+	"x-message-ttl":             true,
+	"x-expires":                 true,
+	"x-max-length":              true,
+	"x-max-length-bytes":        true,
+	"x-overflow":                true,
+	"x-dead-letter-exchange":    true,
+	"x-dead-letter-routing-key": true,
+	"x-delivery-limit":          true,
+	"x-single-active-consumer":  true,
+	"x-max-priority":            true,
+}
+
+// textQueueHeaders adds the headers that declare a queue the way
+// QueueDeclare would.
+func textQueueHeaders(h map[string]string, q *declaredQueue) {
+	h["durable"] = strconv.FormatBool(q.durable)
+	h["auto-delete"] = strconv.FormatBool(q.autoDelete)
+	h["exclusive"] = strconv.FormatBool(q.exclusive)
+	for k, v := range q.args {
+		h[k] = fmt.Sprint(v)
+	}
+}
+
+// textQueueArgs reads back the queue textQueueHeaders described. Flags
+// that are missing take the given defaults.
+func textQueueArgs(h map[string]string, defaults declaredQueue) declaredQueue {
+	q := defaults
+	if v, err := strconv.ParseBool(h["durable"]); err == nil {
+		q.durable = v
+	}
+	if v, err := strconv.ParseBool(h["auto-delete"]); err == nil {
+		q.autoDelete = v
+	}
+	if v, err := strconv.ParseBool(h["exclusive"]); err == nil {
+		q.exclusive = v
+	}
+	var args amqp.Table
+	for k, v := range h {
+		if !textQueueArgNames[k] {
+			continue
+		}
+		if args == nil {
+			args = amqp.Table{}
+		}
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			args[k] = n
+		} else if b, err := strconv.ParseBool(v); err == nil {
+			args[k] = b
+		} else {
+			args[k] = v
+		}
+	}
+	q.args = args
+	return q
+}
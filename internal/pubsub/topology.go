@@ -0,0 +1,179 @@
+package pubsub
+
+import (
+	"fmt"
+	"strings"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/logging"
+)
+
+// Topology describes exchanges, queues and the bindings between them, so an
+// environment can be set up from nothing with one call to Apply.
+type Topology struct {
+	Exchanges []ExchangeSpec
+	Queues    []QueueSpec
+	Bindings  []BindingSpec
+}
+
+// ExchangeSpec describes an exchange. Kind is one of amqp.ExchangeDirect,
+// amqp.ExchangeTopic, amqp.ExchangeFanout or amqp.ExchangeHeaders.
+type ExchangeSpec struct {
+	Name       string
+	Kind       string
+	Durable    bool
+	AutoDelete bool
+	Internal   bool
+	Args       amqp.Table
+}
+
+// QueueSpec describes a queue. DeadLetterExchange, if set, is added to Args
+// as x-dead-letter-exchange.
+type QueueSpec struct {
+	Name               string
+	Durable            bool
+	AutoDelete         bool
+	Exclusive          bool
+	DeadLetterExchange string
+	Args               amqp.Table
+}
+
+// BindingSpec binds Queue to Exchange with Key.
+type BindingSpec struct {
+	Queue    string
+	Exchange string
+	Key      string
+	Args     amqp.Table
+}
+
+// DurableQueue describes a queue the way DeclareAndBind declares a Durable
+// one, so that the two agree and neither fails with PRECONDITION_FAILED.
+func DurableQueue(name string) QueueSpec {
+	return QueueSpec{
+		Name:               name,
+		Durable:            true,
+		DeadLetterExchange: DeadLetterExchange,
+	}
+}
+
+func (q QueueSpec) args() amqp.Table {
+	args := amqp.Table{}
+	for k, v := range q.Args {
+		args[k] = v
+	}
+	if q.DeadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = q.DeadLetterExchange
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	return args
+}
+
+// Validate checks the topology for mistakes that can be caught without a
+// broker: missing names, unknown exchange kinds, quorum and stream queues
+// that aren't durable, and bindings or dead letter exchanges that refer to
+// something it doesn't declare. Exchanges whose
+// names start with "amq." are assumed to exist.
+func (t Topology) Validate() error {
+	exchanges := map[string]bool{"": true}
+	for _, e := range t.Exchanges {
+		if e.Name == "" {
+			return fmt.Errorf("pubsub: exchange with no name")
+		}
+		switch e.Kind {
+		case amqp.ExchangeDirect, amqp.ExchangeTopic, amqp.ExchangeFanout, amqp.ExchangeHeaders:
+		default:
+			return fmt.Errorf("pubsub: exchange %s has unknown kind %q", e.Name, e.Kind)
+		}
+		exchanges[e.Name] = true
+	}
+	known := func(exchange string) bool {
+		return exchanges[exchange] || strings.HasPrefix(exchange, "amq.")
+	}
+
+	queues := map[string]bool{}
+	for _, q := range t.Queues {
+		if q.Name == "" {
+			return fmt.Errorf("pubsub: queue with no name")
+		}
+		switch queueType := q.Args["x-queue-type"]; queueType {
+		case "quorum", "stream":
+			if !q.Durable || q.AutoDelete || q.Exclusive {
+				return fmt.Errorf("pubsub: %s queue %s must be durable and neither exclusive nor auto-delete", queueType, q.Name)
+			}
+		}
+		if q.DeadLetterExchange != "" && !known(q.DeadLetterExchange) {
+			return fmt.Errorf("pubsub: queue %s dead-letters to undeclared exchange %s", q.Name, q.DeadLetterExchange)
+		}
+		queues[q.Name] = true
+	}
+
+	for _, b := range t.Bindings {
+		if !queues[b.Queue] {
+			return fmt.Errorf("pubsub: binding to undeclared queue %s", b.Queue)
+		}
+		if b.Exchange == "" || !known(b.Exchange) {
+			return fmt.Errorf("pubsub: binding of %s to undeclared exchange %q", b.Queue, b.Exchange)
+		}
+	}
+	return nil
+}
+
+// Apply declares everything in the topology: exchanges, then queues, then
+// bindings. Declaring something that already exists with the same settings
+// does nothing, so Apply is safe to run on every startup. Something that
+// exists with different settings makes it fail.
+//
+// Applied through a Manager, the topology is declared again after every
+// reconnect, before the queues bound through DeclareAndBind, so that a
+// broker that comes back empty gets the exchanges they're bound to.
+func (t Topology) Apply(broker Broker) error {
+	if err := t.apply(broker); err != nil {
+		return err
+	}
+	if m, ok := broker.(*Manager); ok {
+		m.declareTopology(t)
+	}
+	return nil
+}
+
+func (t Topology) apply(broker Broker) error {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+
+	ch, err := broker.Channel()
+	if err != nil {
+		logging.Logger().Error("failed to open a channel", "error", err)
+		return err
+	}
+	defer ch.Close()
+
+	for _, e := range t.Exchanges {
+		err := ch.ExchangeDeclare(e.Name, e.Kind, e.Durable, e.AutoDelete, e.Internal, false, e.Args)
+		if err != nil {
+			logging.Logger().Error("failed to declare exchange", "exchange", e.Name, "error", err)
+			return fmt.Errorf("declare exchange %s: %w", e.Name, err)
+		}
+	}
+
+	for _, q := range t.Queues {
+		_, err := ch.QueueDeclare(q.Name, q.Durable, q.AutoDelete, q.Exclusive, false, q.args())
+		if err != nil {
+			logging.Logger().Error("failed to declare queue", "queue", q.Name, "error", err)
+			return fmt.Errorf("declare queue %s: %w", q.Name, err)
+		}
+	}
+
+	for _, b := range t.Bindings {
+		err := ch.QueueBind(b.Queue, b.Key, b.Exchange, false, b.Args)
+		if err != nil {
+			logging.Logger().Error("failed to bind queue", "queue", b.Queue, "exchange", b.Exchange, "routing_key", b.Key, "error", err)
+			return fmt.Errorf("bind queue %s to %s@%s: %w", b.Queue, b.Exchange, b.Key, err)
+		}
+	}
+
+	return nil
+}
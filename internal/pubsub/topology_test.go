@@ -0,0 +1,128 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestTopologyValidate(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		topology Topology
+		ok       bool
+	}{
+		{"empty", Topology{}, true},
+		{"test topology", testTopology, true},
+		{"every exchange kind", Topology{Exchanges: []ExchangeSpec{
+			{Name: "d", Kind: amqp.ExchangeDirect},
+			{Name: "t", Kind: amqp.ExchangeTopic},
+			{Name: "f", Kind: amqp.ExchangeFanout},
+			{Name: "h", Kind: amqp.ExchangeHeaders},
+		}}, true},
+		{"unknown exchange kind", Topology{Exchanges: []ExchangeSpec{{Name: "x", Kind: "x-delayed-message"}}}, false},
+		{"exchange with no name", Topology{Exchanges: []ExchangeSpec{{Kind: amqp.ExchangeTopic}}}, false},
+		{"queue with no name", Topology{Queues: []QueueSpec{{Durable: true}}}, false},
+		{"undeclared dead letter exchange", Topology{Queues: []QueueSpec{{Name: "q", DeadLetterExchange: "nowhere"}}}, false},
+		{"binding to an undeclared queue", Topology{Bindings: []BindingSpec{{Queue: "q", Exchange: "amq.topic"}}}, false},
+		{"binding to an undeclared exchange", Topology{
+			Queues:   []QueueSpec{{Name: "q"}},
+			Bindings: []BindingSpec{{Queue: "q", Exchange: "nowhere"}},
+		}, false},
+		{"binding to the default exchange", Topology{
+			Queues:   []QueueSpec{{Name: "q"}},
+			Bindings: []BindingSpec{{Queue: "q", Exchange: ""}},
+		}, false},
+		{"binding to amq.headers", Topology{
+			Queues:   []QueueSpec{{Name: "q"}},
+			Bindings: []BindingSpec{{Queue: "q", Exchange: "amq.headers"}},
+		}, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.topology.Validate(); (err == nil) != tt.ok {
+				t.Errorf("Validate = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestTopologyHeadersExchange(t *testing.T) {
+	_, broker := newTestBroker(t)
+	topology := Topology{
+		Exchanges: []ExchangeSpec{{Name: "test_headers", Kind: amqp.ExchangeHeaders, Durable: true}},
+		Queues: []QueueSpec{
+			{Name: "all_alice_moves", Durable: true},
+			{Name: "any_alice_or_move", Durable: true},
+		},
+		Bindings: []BindingSpec{
+			{Queue: "all_alice_moves", Exchange: "test_headers", Args: amqp.Table{"x-match": "all", "player": "alice", "kind": "move"}},
+			{Queue: "any_alice_or_move", Exchange: "test_headers", Args: amqp.Table{"x-match": "any", "player": "alice", "kind": "move"}},
+		},
+	}
+	if err := topology.Apply(broker); err != nil {
+		t.Fatal(err)
+	}
+	// Applying it again changes nothing.
+	if err := topology.Apply(broker); err != nil {
+		t.Fatal(err)
+	}
+
+	pub := newTestPublisher(t, broker)
+	for _, headers := range []amqp.Table{
+		{"player": "alice", "kind": "move"},
+		{"player": "alice", "kind": "war"},
+		{"player": "bob", "kind": "move"},
+		{"player": "bob", "kind": "war"},
+	} {
+		err := pub.PublishWithContext(context.Background(), "test_headers", "ignored", false, false, amqp.Publishing{
+			Headers: headers,
+			Body:    []byte(headers["player"].(string) + " " + headers["kind"].(string)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ch, err := broker.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	for queue, want := range map[string][]string{
+		"all_alice_moves":   {"alice move"},
+		"any_alice_or_move": {"alice move", "alice war", "bob move"},
+	} {
+		var got []string
+		for {
+			d, ok, err := ch.Get(queue, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				break
+			}
+			got = append(got, string(d.Body))
+		}
+		if len(got) != len(want) {
+			t.Errorf("%s got %q, want %q", queue, got, want)
+			continue
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("%s got %q, want %q", queue, got, want)
+				break
+			}
+		}
+	}
+
+	// Only all and any are allowed.
+	captureLogs(t)
+	err = Topology{
+		Queues:   []QueueSpec{{Name: "bad_match", Durable: true}},
+		Bindings: []BindingSpec{{Queue: "bad_match", Exchange: "amq.headers", Args: amqp.Table{"x-match": "most"}}},
+	}.Apply(broker)
+	if err == nil {
+		t.Error("bound with x-match most")
+	}
+}
@@ -0,0 +1,228 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/logging"
+)
+
+// HeaderTraceParent carries a W3C traceparent from a publisher to the
+// handlers of its message, so that the messages a handler publishes in turn
+// belong to the same trace.
+const HeaderTraceParent = "traceparent"
+
+// SpanContext identifies a span within a trace.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// String formats the span context as a version 00 traceparent.
+func (sc SpanContext) String() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]), flags)
+}
+
+// IsValid reports whether the trace and span IDs are both set, as the
+// traceparent spec requires.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// ParseTraceParent parses a traceparent header. Versions after 00 are read
+// as far as 00 goes, as the spec asks.
+func ParseTraceParent(s string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, fmt.Errorf("pubsub: invalid traceparent %q", s)
+	}
+	traceID, err1 := hex.DecodeString(parts[1])
+	spanID, err2 := hex.DecodeString(parts[2])
+	flags, err3 := hex.DecodeString(parts[3])
+	if err1 != nil || err2 != nil || err3 != nil || len(traceID) != 16 || len(spanID) != 8 || len(flags) != 1 {
+		return sc, fmt.Errorf("pubsub: invalid traceparent %q", s)
+	}
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	sc.Sampled = flags[0]&1 == 1
+	if !sc.IsValid() {
+		return sc, fmt.Errorf("pubsub: invalid traceparent %q", s)
+	}
+	return sc, nil
+}
+
+type spanContextKey struct{}
+
+// ContextWithSpan returns a copy of ctx carrying sc, which publishes made
+// with WithContext(ctx) continue.
+func ContextWithSpan(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// SpanFromContext returns the span ctx carries, if any. A handler's
+// context carries the span of its delivery.
+func SpanFromContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(spanContextKey{}).(SpanContext)
+	return sc, ok
+}
+
+// Span is a finished publish or handler run.
+type Span struct {
+	TraceID    string        `json:"trace_id"`
+	SpanID     string        `json:"span_id"`
+	ParentID   string        `json:"parent_id,omitempty"`
+	Name       string        `json:"name"`
+	Kind       string        `json:"kind"`
+	Exchange   string        `json:"exchange"`
+	RoutingKey string        `json:"routing_key"`
+	Queue      string        `json:"queue,omitempty"`
+	MessageID  string        `json:"message_id,omitempty"`
+	AppID      string        `json:"app_id"`
+	Start      time.Time     `json:"start"`
+	Duration   time.Duration `json:"duration_ns"`
+	Outcome    string        `json:"outcome,omitempty"`
+	Error      string        `json:"error,omitempty"`
+}
+
+// Span kinds.
+const (
+	SpanPublish = "publish"
+	SpanHandle  = "handle"
+)
+
+// SpanExporter receives every span this process finishes.
+type SpanExporter interface {
+	ExportSpan(span Span) error
+}
+
+var (
+	exporterMu sync.RWMutex
+	exporter   SpanExporter
+)
+
+// SetSpanExporter sends finished spans to e. With no exporter, trace
+// context is still passed along but spans aren't recorded.
+func SetSpanExporter(e SpanExporter) {
+	exporterMu.Lock()
+	defer exporterMu.Unlock()
+	exporter = e
+}
+
+// JSONExporter writes each span as a line of JSON.
+type JSONExporter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	c   io.Closer
+}
+
+// NewJSONExporter writes spans to w.
+func NewJSONExporter(w io.Writer) *JSONExporter {
+	return &JSONExporter{enc: json.NewEncoder(w)}
+}
+
+// NewJSONFileExporter appends spans to the file at path, or writes them to
+// standard output if path is "stdout".
+func NewJSONFileExporter(path string) (*JSONExporter, error) {
+	if path == "stdout" {
+		return NewJSONExporter(os.Stdout), nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	e := NewJSONExporter(f)
+	e.c = f
+	return e, nil
+}
+
+func (e *JSONExporter) ExportSpan(span Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.enc.Encode(span)
+}
+
+// Close closes the file the exporter writes to, if it opened one.
+func (e *JSONExporter) Close() error {
+	if e.c == nil {
+		return nil
+	}
+	return e.c.Close()
+}
+
+// activeSpan is a span that has started but not finished.
+type activeSpan struct {
+	sc   SpanContext
+	span Span
+}
+
+// startSpan starts a span that is a child of parent, or the root of a new
+// trace if parent isn't valid.
+func startSpan(parent SpanContext, kind, name string) *activeSpan {
+	sc := SpanContext{TraceID: parent.TraceID, Sampled: true}
+	var parentID string
+	if parent.IsValid() {
+		sc.Sampled = parent.Sampled
+		parentID = hex.EncodeToString(parent.SpanID[:])
+	} else {
+		rand.Read(sc.TraceID[:])
+	}
+	rand.Read(sc.SpanID[:])
+
+	return &activeSpan{
+		sc: sc,
+		span: Span{
+			TraceID:  hex.EncodeToString(sc.TraceID[:]),
+			SpanID:   hex.EncodeToString(sc.SpanID[:]),
+			ParentID: parentID,
+			Name:     name,
+			Kind:     kind,
+			AppID:    AppID,
+			Start:    time.Now(),
+		},
+	}
+}
+
+// end finishes the span and exports it.
+func (s *activeSpan) end(outcome string, err error) {
+	s.span.Duration = time.Since(s.span.Start)
+	s.span.Outcome = outcome
+	if err != nil {
+		s.span.Error = err.Error()
+	}
+
+	exporterMu.RLock()
+	e := exporter
+	exporterMu.RUnlock()
+	if e == nil || !s.sc.Sampled {
+		return
+	}
+	if err := e.ExportSpan(s.span); err != nil {
+		logging.Logger().Error("failed to export span", "error", err)
+	}
+}
+
+// deliverySpan starts the span for handling a delivery, continuing the
+// trace it was published in.
+func deliverySpan(headers amqp.Table, name string) *activeSpan {
+	var parent SpanContext
+	if tp, ok := headers[HeaderTraceParent].(string); ok {
+		parent, _ = ParseTraceParent(tp)
+	}
+	return startSpan(parent, SpanHandle, name)
+}
@@ -0,0 +1,85 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/hex"
+	"sync"
+	"testing"
+)
+
+// spanRecorder is a SpanExporter that keeps the spans it's given.
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []Span
+}
+
+func (r *spanRecorder) ExportSpan(span Span) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, span)
+	return nil
+}
+
+func (r *spanRecorder) find(kind, name string) (Span, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, span := range r.spans {
+		if span.Kind == kind && span.Name == name {
+			return span, true
+		}
+	}
+	return Span{}, false
+}
+
+func TestTraceParentPropagates(t *testing.T) {
+	_, broker := newTestBroker(t)
+	spans := &spanRecorder{}
+	SetSpanExporter(spans)
+	t.Cleanup(func() { SetSpanExporter(nil) })
+
+	handled := make(chan SpanContext, 1)
+	sub, err := SubscribeJSONEnvelope(context.Background(), broker, testTopic, "traced", "traced.*", Transient, func(msg Message[string]) AckType {
+		sc, _ := SpanFromContext(msg.Context())
+		handled <- sc
+		return Ack
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	root := SpanContext{Sampled: true}
+	copy(root.TraceID[:], "0123456789abcdef")
+	copy(root.SpanID[:], "rootspan")
+	ctx := ContextWithSpan(context.Background(), root)
+	if err := PublishJSON(newTestPublisher(t, broker), testTopic, "traced.alice", "move", WithContext(ctx)); err != nil {
+		t.Fatal(err)
+	}
+	inHandler := receive(t, handled)
+	if err := sub.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	publishSpan, ok := spans.find(SpanPublish, "publish traced.alice")
+	if !ok {
+		t.Fatal("no publish span was exported")
+	}
+	handleSpan, ok := spans.find(SpanHandle, "handle traced")
+	if !ok {
+		t.Fatal("no handle span was exported")
+	}
+
+	traceID := hex.EncodeToString(root.TraceID[:])
+	if publishSpan.TraceID != traceID || handleSpan.TraceID != traceID {
+		t.Errorf("spans are in traces %s and %s, want both in %s", publishSpan.TraceID, handleSpan.TraceID, traceID)
+	}
+	if want := hex.EncodeToString(root.SpanID[:]); publishSpan.ParentID != want {
+		t.Errorf("publish span's parent is %q, want the context's span %q", publishSpan.ParentID, want)
+	}
+	if handleSpan.ParentID != publishSpan.SpanID {
+		t.Errorf("handle span's parent is %q, want the publish span %q", handleSpan.ParentID, publishSpan.SpanID)
+	}
+	if got := hex.EncodeToString(inHandler.SpanID[:]); got != handleSpan.SpanID || inHandler.TraceID != root.TraceID {
+		t.Errorf("handler's context carries span %s, want %s", inHandler, handleSpan.SpanID)
+	}
+}
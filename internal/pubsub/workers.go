@@ -0,0 +1,161 @@
+package pubsub
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// WithPrefetch sets how many unacked deliveries the broker will push to the
+// subscription at once. The default is 10. Prefetch below the concurrency
+// leaves workers idle.
+func WithPrefetch(n int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.prefetch = n
+	}
+}
+
+// WithConcurrency sets how many deliveries the subscription handles at the
+// same time. The default is 1, which handles them in order.
+func WithConcurrency(n int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.concurrency = n
+	}
+}
+
+// KeyFunc picks the ordering key of a delivery for WithKeyedConcurrency.
+type KeyFunc func(amqp.Delivery) string
+
+// ByRoutingKey orders deliveries by their routing key.
+func ByRoutingKey(delivery amqp.Delivery) string {
+	return delivery.RoutingKey
+}
+
+// WithKeyedConcurrency handles deliveries on n workers while keeping the
+// deliveries that share a key in order. Each key always goes to the same
+// worker, so a slow key holds up the others that hash alongside it. A nil
+// key orders by routing key. Deliveries that are requeued or retried go to
+// the back of the queue and lose their place.
+func WithKeyedConcurrency(n int, key KeyFunc) SubscribeOption {
+	return func(o *subscribeOptions) {
+		if key == nil {
+			key = ByRoutingKey
+		}
+		o.concurrency = n
+		o.key = key
+	}
+}
+
+// dispatcher hands deliveries to the goroutines that handle them.
+type dispatcher interface {
+	// submit arranges for fn to handle delivery. It returns false without
+	// running fn if ctx is done first.
+	submit(ctx context.Context, delivery amqp.Delivery, fn func()) bool
+	// wait blocks until every submitted handler has returned.
+	wait()
+}
+
+func newDispatcher(options subscribeOptions) dispatcher {
+	if options.key != nil {
+		return newKeyedPool(options.concurrency, options.prefetch, options.key)
+	}
+	return newWorkerPool(options.concurrency)
+}
+
+// workerPool runs handlers on at most n goroutines at a time.
+type workerPool struct {
+	sem chan struct{}
+	wg  sync.WaitGroup
+}
+
+func newWorkerPool(n int) *workerPool {
+	if n < 1 {
+		n = 1
+	}
+	return &workerPool{sem: make(chan struct{}, n)}
+}
+
+func (p *workerPool) submit(ctx context.Context, _ amqp.Delivery, fn func()) bool {
+	select {
+	case p.sem <- struct{}{}:
+	case <-ctx.Done():
+		return false
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer func() { <-p.sem }()
+		fn()
+	}()
+	return true
+}
+
+func (p *workerPool) wait() {
+	p.wg.Wait()
+}
+
+// keyedPool runs handlers on n workers, each handling its deliveries in
+// the order they arrived. A delivery's key decides its worker.
+type keyedPool struct {
+	key    KeyFunc
+	queues []chan func()
+	wg     sync.WaitGroup
+}
+
+func newKeyedPool(n, prefetch int, key KeyFunc) *keyedPool {
+	if n < 1 {
+		n = 1
+	}
+	// With room for the whole prefetch window a busy worker never blocks
+	// the others.
+	if prefetch < 1 {
+		prefetch = 1
+	}
+	p := &keyedPool{
+		key:    key,
+		queues: make([]chan func(), n),
+	}
+	for i := range p.queues {
+		queue := make(chan func(), prefetch)
+		p.queues[i] = queue
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for fn := range queue {
+				fn()
+			}
+		}()
+	}
+	return p
+}
+
+func (p *keyedPool) submit(ctx context.Context, delivery amqp.Delivery, fn func()) bool {
+	h := fnv.New32a()
+	h.Write([]byte(p.key(delivery)))
+	queue := p.queues[h.Sum32()%uint32(len(p.queues))]
+
+	work := func() {
+		// Once the subscription is closing, leave queued deliveries
+		// unacked so they go back to the broker.
+		if ctx.Err() != nil {
+			return
+		}
+		fn()
+	}
+	select {
+	case queue <- work:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (p *keyedPool) wait() {
+	for _, queue := range p.queues {
+		close(queue)
+	}
+	p.wg.Wait()
+}
@@ -0,0 +1,69 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestKeyedConcurrencyKeepsOrderWithinAKey(t *testing.T) {
+	_, broker := newTestBroker(t)
+	const workers, keys, perKey = 2, 4, 20
+
+	var mu sync.Mutex
+	var running, maxRunning int
+	got := map[string][]int{}
+	done := make(chan struct{}, keys*perKey)
+	sub, err := SubscribeJSONEnvelope(context.Background(), broker, testTopic, "", "keyed.*", Transient, func(msg Message[int]) AckType {
+		mu.Lock()
+		running++
+		maxRunning = max(maxRunning, running)
+		mu.Unlock()
+
+		time.Sleep(time.Millisecond)
+
+		mu.Lock()
+		running--
+		got[msg.RoutingKey] = append(got[msg.RoutingKey], msg.Body)
+		mu.Unlock()
+		done <- struct{}{}
+		return Ack
+	}, WithKeyedConcurrency(workers, ByRoutingKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	pub := newTestPublisher(t, broker)
+	for i := 0; i < perKey; i++ {
+		for k := 0; k < keys; k++ {
+			if err := PublishJSON(pub, testTopic, fmt.Sprintf("keyed.k%d", k), i); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i := 0; i < keys*perKey; i++ {
+		receive(t, done)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for k := 0; k < keys; k++ {
+		key := fmt.Sprintf("keyed.k%d", k)
+		if len(got[key]) != perKey {
+			t.Errorf("%s: handled %d, want %d", key, len(got[key]), perKey)
+			continue
+		}
+		for i, v := range got[key] {
+			if v != i {
+				t.Errorf("%s: handled %v, want them in publish order", key, got[key])
+				break
+			}
+		}
+	}
+	if maxRunning > workers {
+		t.Errorf("%d handlers ran at once, want at most %d", maxRunning, workers)
+	}
+}
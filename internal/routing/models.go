@@ -11,3 +11,18 @@ type GameLog struct {
 	Message     string
 	Username    string
 }
+
+type JoinRequest struct {
+	Username string
+}
+
+type LeaveRequest struct {
+	Username string
+}
+
+type StatusRequest struct{}
+
+type ServerStatus struct {
+	IsPaused bool
+	Players  []string
+}
@@ -10,7 +10,24 @@ const (
 	GameLogSlug = "game_logs"
 )
 
+// Keys the server answers requests on.
+const (
+	RPCJoinKey   = "rpc.join"
+	RPCLeaveKey  = "rpc.leave"
+	RPCStatusKey = "rpc.status"
+)
+
+// Error codes in the server's replies.
+const (
+	ErrCodeUsernameTaken = "username_taken"
+)
+
 const (
 	ExchangePerilDirect = "peril_direct"
 	ExchangePerilTopic  = "peril_topic"
+	ExchangePerilDLX    = "peril_dlx"
+)
+
+const (
+	QueuePerilDLQ = "peril_dlq"
 )
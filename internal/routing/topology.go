@@ -0,0 +1,41 @@
+package routing
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Topology is everything Peril needs on the broker before any client
+// connects. Per-client queues are declared by the clients themselves.
+var Topology = pubsub.Topology{
+	Exchanges: []pubsub.ExchangeSpec{
+		{Name: ExchangePerilDirect, Kind: amqp.ExchangeDirect, Durable: true},
+		{Name: ExchangePerilTopic, Kind: amqp.ExchangeTopic, Durable: true},
+		{Name: ExchangePerilDLX, Kind: amqp.ExchangeFanout, Durable: true},
+	},
+	Queues: []pubsub.QueueSpec{
+		{Name: QueuePerilDLQ, Durable: true},
+		// Shared queues are declared up front so that nothing published
+		// before the first subscriber arrives is lost.
+		pubsub.DurableQueue(GameLogSlug),
+		pubsub.DurableQueue(WarRecognitionsPrefix),
+	},
+	Bindings: []pubsub.BindingSpec{
+		{Queue: QueuePerilDLQ, Exchange: ExchangePerilDLX},
+		{Queue: GameLogSlug, Exchange: ExchangePerilTopic, Key: fmt.Sprintf("%s.*", GameLogSlug)},
+		{Queue: WarRecognitionsPrefix, Exchange: ExchangePerilTopic, Key: fmt.Sprintf("%s.*", WarRecognitionsPrefix)},
+	},
+}
+
+// WarRetryPolicy is for consumers of the war queue. It is shared by every
+// client and the gateway, so a war one of them isn't part of is retried
+// quickly to give the others a chance at it.
+var WarRetryPolicy = pubsub.RetryPolicy{
+	InitialDelay: 200 * time.Millisecond,
+	MaxDelay:     5 * time.Second,
+	Multiplier:   2,
+	MaxAttempts:  10,
+}